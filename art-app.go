@@ -4,6 +4,15 @@ A trivial application to illustrate how the blockartlib library can be
 used from an application in project 1 for UBC CS 416 2017W2.
 
 Usage:
+$ go run art-app.go -key name [minerAddr]
+  -key string
+        Name of the key pair in the keystore (see blockart-keys.go)
+  -keystore string
+        Keystore file (default ~/.blockart/keystore.json)
+  -log-level string
+        debug, info, warn, error or none (default "info"); debug logs the
+        trace ID of every shape added or deleted
+
 $ go run art-app.go [minerAddr] [minerPrivKey]
 
 $ go run art-app.go [minerAddr] 3081a40201010430dd09bbc48d497df5fa20be98e42cc57b11705d324a1ecac4c04572897fa71accf45d69b90073bbc4f58fb67f235742c9a00706052b81040022a1640362000461521b69e8fc90c3a87d194db94b61a1a09594e54b4602edb2a10f03b4d08d02016234b37ae3cc136dcef0e890786ff926acc74ad376eaeab9bf5fff92ba150685ba1a4918d2ba369b34c9b247f424c561d82f63ce43fd7e116f4871a9cdf9e5
@@ -14,28 +23,58 @@ package main
 // Expects blockartlib.go to be in the ./blockartlib/ dir, relative to
 // this art-app.go file
 import (
+	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"os"
 
 	"./blockartlib"
+	"./keystore"
+	"./logging"
 )
 
 func main() {
-	args := os.Args[1:]
-
-	if len(args) != 2 {
-		fmt.Println("Incorrect number of arguments, need 2")
-		return
+	keyName := flag.String("key", "", "Name of the key pair in the keystore")
+	keystorePath := flag.String("keystore", keystore.DefaultPath(), "Keystore file")
+	logLevel := flag.String("log-level", "info", "debug, info, warn, error or none")
+	flag.Parse()
+	args := flag.Args()
+
+	var privKey *ecdsa.PrivateKey
+	if *keyName != "" {
+		if len(args) != 1 {
+			fmt.Println("Incorrect number of arguments, need 1")
+			return
+		}
+		var err error
+		privKey, err = keystore.LoadKey(*keystorePath, *keyName)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else {
+		if len(args) != 2 {
+			fmt.Println("Incorrect number of arguments, need 2")
+			return
+		}
+		privateKeyBytesRestored, _ := hex.DecodeString(args[1])
+		privKey, _ = x509.ParseECPrivateKey(privateKeyBytesRestored)
 	}
 
 	minerAddr := args[0]
-	privateKeyBytesRestored, _ := hex.DecodeString(args[1])
-	privKey, _ := x509.ParseECPrivateKey(privateKeyBytesRestored)
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	// Open a canvas.
-	canvas, _, err := blockartlib.OpenCanvas(minerAddr, *privKey)
+	canvas, _, err := blockartlib.OpenCanvasWithOptions(minerAddr, *privKey, blockartlib.Options{
+		Logger: logging.New(os.Stderr, level, "art-app"),
+	})
 	fmt.Printf("Canvas %v\n", canvas)
 	if checkError(err) != nil {
 		fmt.Println(err)
@@ -75,7 +114,7 @@ func main() {
 	fmt.Printf("Shape %v %v \n", shapeListInvalid, err)
 
 	// Valid case
-	fmt.Println("TINA: shapeList length ", shapeList)
+	fmt.Println("shapeList length ", len(shapeList))
 	if len(shapeList) > 0 {
 		shapeSvgString, err := canvas.GetSvgString(shapeList[0])
 		fmt.Printf("SVG String %v %v \n", shapeSvgString, err)
@@ -97,7 +136,7 @@ func main() {
 	}
 
 	// Valid case - something
-	fmt.Println("TINA: shapeList2 length ", shapeList)
+	fmt.Println("shapeList2 length ", len(shapeList))
 	shapeList2, err := canvas.GetShapes(blockHash)
 	if len(shapeList2) > 0 {
 		fmt.Printf("Shape %v %v \n", shapeList2, err)
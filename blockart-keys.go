@@ -0,0 +1,116 @@
+/*
+
+Manages the key pairs of miners and art nodes in a passphrase-encrypted
+keystore, so that private keys do not have to be passed on the command
+line where they are visible in ps.
+
+The passphrase is read from $BLOCKART_PASSPHRASE, or else from stdin.
+
+Usage:
+
+$ go run blockart-keys.go [-keystore path] command [name]
+  -keystore string
+        Keystore file (default ~/.blockart/keystore.json)
+
+  generate name   Generates a P-384 key pair
+  import name     Adds the hex private key read from stdin, e.g. one from
+                  data/pubPrivateKeyPairs.txt
+  list            Lists key names and public keys
+  export name     Prints the hex public key
+  delete name     Removes the key pair
+
+  go run blockart-keys.go generate miner1
+  go run ink-miner.go -key miner1 127.0.0.1:12345
+
+*/
+
+package main
+
+import (
+	"./keystore"
+
+	"bufio"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func exitOnError(prefix string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s, err = %s\n", prefix, err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: blockart-keys [-keystore path] generate|import|list|export|delete [name]")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+	path := flag.String("keystore", keystore.DefaultPath(), "Keystore file")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	command := args[0]
+	if (command == "list") != (len(args) == 1) || len(args) > 2 {
+		usage()
+	}
+
+	ks, err := keystore.Open(*path)
+	exitOnError("open keystore", err)
+
+	stdin := bufio.NewReader(os.Stdin)
+	switch command {
+	case "generate":
+		passphrase, err := keystore.ReadPassphrase("Passphrase: ", stdin)
+		exitOnError("read passphrase", err)
+		_, err = ks.Generate(args[1], passphrase)
+		exitOnError("generate", err)
+		exitOnError("save keystore", ks.Save())
+
+		publicKey, _ := ks.Export(args[1])
+		fmt.Println(publicKey)
+
+	case "import":
+		fmt.Fprint(os.Stderr, "Hex private key: ")
+		line, err := stdin.ReadString('\n')
+		if line == "" {
+			exitOnError("read private key", err)
+		}
+		privateKeyBytes, err := hex.DecodeString(strings.TrimSpace(line))
+		exitOnError("decode private key", err)
+		priv, err := x509.ParseECPrivateKey(privateKeyBytes)
+		exitOnError("parse private key", err)
+
+		passphrase, err := keystore.ReadPassphrase("Passphrase: ", stdin)
+		exitOnError("read passphrase", err)
+		exitOnError("import", ks.Import(args[1], priv, passphrase))
+		exitOnError("save keystore", ks.Save())
+
+	case "list":
+		for _, entry := range ks.List() {
+			fmt.Println(entry.Name, entry.PublicKey)
+		}
+
+	case "export":
+		publicKey, err := ks.Export(args[1])
+		exitOnError("export", err)
+		fmt.Println(publicKey)
+
+	case "delete":
+		exitOnError("delete", ks.Delete(args[1]))
+		exitOnError("save keystore", ks.Save())
+
+	default:
+		usage()
+	}
+}
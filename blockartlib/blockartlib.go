@@ -8,26 +8,26 @@ library (blockartlib) to be used in project 1 of UBC CS 416 2017W2.
 package blockartlib
 
 import (
+	"../logging"
 	"../shared"
 	"crypto/ecdsa"
-	"crypto/md5"
 	"crypto/rand"
-	"encoding/hex"
+	"encoding/binary"
 	"fmt"
+	"log/slog"
 	"math"
 	"net/rpc"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Represents a type of shape in the BlockArt system.
 type ShapeType int
 
-var mAddr string
-
 const (
 	// Path shape.
 	PATH ShapeType = iota
@@ -41,6 +41,19 @@ type CanvasSettings struct {
 	// Canvas dimensions
 	CanvasXMax uint32
 	CanvasYMax uint32
+
+	// Names of the layers above the base layer, from the bottom up. The
+	// base layer is named "".
+	Layers []string
+}
+
+// A rectangle of the canvas, from (MinX, MinY) up to but not including
+// (MaxX, MaxY).
+type Region struct {
+	MinX uint32
+	MinY uint32
+	MaxX uint32
+	MaxY uint32
 }
 
 // Settings for an instance of the BlockArt project/network.
@@ -48,6 +61,9 @@ type MinerNetSettings struct {
 	// Hash of the very first (empty) block in the chain.
 	GenesisBlockHash string
 
+	// Name of the network the genesis block hash commits to
+	ChainName string
+
 	// The minimum number of ink miners that an ink miner should be
 	// connected to. If the ink miner dips below this number, then
 	// they have to retrieve more nodes from the server using
@@ -65,6 +81,11 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8
 	PoWDifficultyNoOpBlock uint8
 
+	// Difficulty retargeting: window in blocks (0 disables it) and target
+	// number of milliseconds per block
+	RetargetWindow  uint32
+	TargetBlockTime uint32
+
 	// Canvas settings
 	canvasSettings CanvasSettings
 }
@@ -79,9 +100,6 @@ type Shape struct {
 	InkCost    uint32
 }
 
-var myShapes = make(map[string]Shape)
-var canvasSettings CanvasSettings
-
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <ERROR DEFINITIONS>
 
@@ -156,12 +174,87 @@ func (e InvalidBlockHashError) Error() string {
 	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
 }
 
+// Contains the ID of the refused transfer.
+type InvalidTransferError string
+
+func (e InvalidTransferError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid ink transfer [%s]", string(e))
+}
+
+// Contains the hash of the shape that cannot be given to or shared with
+// the key.
+type InvalidOwnerError string
+
+func (e InvalidOwnerError) Error() string {
+	return fmt.Sprintf("BlockArt: Key cannot be made an owner of the shape [%s]", string(e))
+}
+
+// Contains the name of the layer the canvas does not have.
+type InvalidLayerError string
+
+func (e InvalidLayerError) Error() string {
+	return fmt.Sprintf("BlockArt: Canvas has no such layer [%s]", string(e))
+}
+
+// Contains the ID of the refused claim.
+type InvalidRegionError string
+
+func (e InvalidRegionError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid region claim [%s]", string(e))
+}
+
+// Contains the ID of the claim another key holds on the region.
+type RegionClaimedError string
+
+func (e RegionClaimedError) Error() string {
+	return fmt.Sprintf("BlockArt: Region claimed by someone else [%s]", string(e))
+}
+
 type InvalidArtNodeMinerKeyPairError struct{}
 
 func (e InvalidArtNodeMinerKeyPairError) Error() string {
 	return fmt.Sprintf("BlockArt: Art Node and Miner Key Pairs did not match")
 }
 
+// Returns the error a miner's reply stands for, or nil if the miner did
+// not refuse the call. Codes from a newer version of the miner that this
+// library does not know are returned as a plain error.
+func ErrorFromReply(e shared.ReplyError) error {
+	switch e.Code {
+	case shared.NoError:
+		return nil
+	case shared.InsufficientInk:
+		return InsufficientInkError(e.InkRemaining)
+	case shared.ShapeOverlap:
+		return ShapeOverlapError(e.Subject)
+	case shared.ShapeOwner:
+		return ShapeOwnerError(e.Subject)
+	case shared.InvalidShapeHash:
+		return InvalidShapeHashError(e.Subject)
+	case shared.InvalidBlockHash:
+		return InvalidBlockHashError(e.Subject)
+	case shared.InvalidShapeSvgString:
+		return InvalidShapeSvgStringError(e.Subject)
+	case shared.ShapeSvgStringTooLong:
+		return ShapeSvgStringTooLongError(e.Subject)
+	case shared.OutOfBounds:
+		return new(OutOfBoundsError)
+	case shared.InvalidKeyPair:
+		return new(InvalidArtNodeMinerKeyPairError)
+	case shared.InvalidTransfer:
+		return InvalidTransferError(e.Subject)
+	case shared.InvalidOwner:
+		return InvalidOwnerError(e.Subject)
+	case shared.InvalidLayer:
+		return InvalidLayerError(e.Subject)
+	case shared.InvalidRegion:
+		return InvalidRegionError(e.Subject)
+	case shared.RegionClaimed:
+		return RegionClaimedError(e.Subject)
+	}
+	return fmt.Errorf("BlockArt: Miner refused the call with %s (error codes version %d)", e, e.Version)
+}
+
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -175,8 +268,14 @@ type Canvas interface {
 	// - ShapeSvgStringTooLongError
 	// - ShapeOverlapError
 	// - OutOfBoundsError
+	// - RegionClaimedError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 
+	// Same as AddShape, but puts the shape on the named layer of the
+	// canvas instead of the base layer. It only overlaps shapes there.
+	// Can return the errors AddShape can, and InvalidLayerError.
+	AddShapeOnLayer(validateNum uint8, layer string, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -188,12 +287,67 @@ type Canvas interface {
 	// - DisconnectedError
 	GetInk() (inkRemaining uint32, err error)
 
-	// Removes a shape from the canvas.
+	// Removes a shape from the canvas. Co-owners may remove it too, and
+	// get the ink it cost back.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - ShapeOwnerError
+	// - InvalidShapeHashError
 	DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error)
 
+	// Replaces a shape this art node owns or co-owns with a new one in a
+	// single operation that keeps the shape hash. Only the difference in
+	// ink is charged or refunded, and the new shape may overlap the old. It
+	// stays on the layer of the old.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidShapeSvgStringError
+	// - ShapeSvgStringTooLongError
+	// - ShapeOverlapError
+	// - OutOfBoundsError
+	// - RegionClaimedError
+	// - ShapeOwnerError
+	// - InvalidShapeHashError
+	ModifyShape(validateNum uint8, shapeHash string, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (blockHash string, inkRemaining uint32, err error)
+
+	// Gives a shape this art node owns or co-owns to another key, which
+	// becomes its only owner.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - ShapeOwnerError
+	// - InvalidShapeHashError
+	// - InvalidOwnerError
+	GiveShape(validateNum uint8, shapeHash string, to ecdsa.PublicKey) (blockHash string, err error)
+
+	// Shares a shape this art node owns or co-owns with another key, which
+	// may then delete, give or share the shape, and draw over it.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - ShapeOwnerError
+	// - InvalidShapeHashError
+	// - InvalidOwnerError
+	ShareShape(validateNum uint8, shapeHash string, with ecdsa.PublicKey) (blockHash string, err error)
+
+	// Moves amount ink from this art node's key to the key to.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidTransferError
+	TransferInk(validateNum uint8, to ecdsa.PublicKey, amount uint32) (inkRemaining uint32, err error)
+
+	// Reserves region of the named layer for this art node's key for the
+	// blocks blocks after the one holding the claim: other keys cannot
+	// draw there until then. Costs the area of the region in ink.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - InvalidRegionError
+	// - InvalidLayerError
+	// - OutOfBoundsError
+	// - RegionClaimedError
+	ClaimRegion(validateNum uint8, layer string, region Region, blocks uint32) (claimID string, blockHash string, inkRemaining uint32, err error)
+
 	// Retrieves hashes contained by a specific block.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -220,7 +374,8 @@ type Canvas interface {
 // Check whether Svg is valid
 // Return ShapeSvgStringTooLongError if len is more than 128
 // Return InvalidShapeSvgStringError if it is an invalid Svg Path
-func IsValidSvgShape(shapeType ShapeType, shapeSvgString string, fill string, stroke string) (err error, success bool) {
+// Return OutOfBoundsError if it does not fit on a canvas with settings
+func IsValidSvgShape(canvasSettings CanvasSettings, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (err error, success bool) {
 	if shapeType == PATH {
 		if len(shapeSvgString) > 128 {
 			return ShapeSvgStringTooLongError(shapeSvgString), false
@@ -239,11 +394,12 @@ func IsValidSvgShape(shapeType ShapeType, shapeSvgString string, fill string, st
 			return InvalidShapeSvgStringError(shapeSvgString), false
 		}
 
-		// check bounds
+		// check bounds, before converting to the canvas' uint32 so that
+		// coordinates past it cannot wrap back onto it
 		x_coor, y_coor := SvgToPoints(shapeSvgString)
 		if len(x_coor) == len(y_coor) {
 			for i := 0; i < len(x_coor); i++ {
-				if uint32(x_coor[i]) > canvasSettings.CanvasXMax || uint32(x_coor[i]) < 0 || uint32(y_coor[i]) > canvasSettings.CanvasYMax || uint32(y_coor[i]) < 0 {
+				if x_coor[i] < 0 || int64(x_coor[i]) > int64(canvasSettings.CanvasXMax) || y_coor[i] < 0 || int64(y_coor[i]) > int64(canvasSettings.CanvasYMax) {
 					return new(OutOfBoundsError), false
 				}
 			}
@@ -253,7 +409,8 @@ func IsValidSvgShape(shapeType ShapeType, shapeSvgString string, fill string, st
 }
 
 // Add Shape to map of local shapes
-func AddShape(inkCost uint32, shapeHash string, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (err error, success bool) {
+// Add Shape to the canvas' list of local shapes
+func (canvas *canvasStruct) addLocalShape(inkCost uint32, shapeHash string, shapeType ShapeType, shapeSvgString string, fill string, stroke string) {
 	shape := Shape{
 		SvgString:  "<path d=\"" + shapeSvgString + "\" stroke=\"" + stroke + "\" fill=\"" + fill + "\"/>",
 		DAttribute: shapeSvgString,
@@ -261,8 +418,9 @@ func AddShape(inkCost uint32, shapeHash string, shapeType ShapeType, shapeSvgStr
 		Fill:       fill,
 		Stroke:     stroke,
 		InkCost:    inkCost}
-	myShapes[shapeHash] = shape
-	return nil, true
+	canvas.shapesLock.Lock()
+	canvas.shapes[shapeHash] = shape
+	canvas.shapesLock.Unlock()
 }
 
 func CalculateInkUsed(shapeType ShapeType, shapeSvgString string, fill string, stroke string) (inkUsed uint32) {
@@ -390,16 +548,26 @@ func SvgToPoints(shapeSvgString string) (x_coor []int, y_coor []int) {
 	return x_coor, y_coor
 }
 
-// Remove Shape from the list of local shape
-func DeleteShape(shapeHash string) (success bool) {
-	if _, ok := myShapes[shapeHash]; ok {
-		delete(myShapes, shapeHash)
+// Remove Shape from the canvas' list of local shapes
+func (canvas *canvasStruct) deleteLocalShape(shapeHash string) (success bool) {
+	canvas.shapesLock.Lock()
+	defer canvas.shapesLock.Unlock()
+	if _, ok := canvas.shapes[shapeHash]; ok {
+		delete(canvas.shapes, shapeHash)
 		return true
 	}
 	return false
 }
 
-func CreateHtmlFile(shapes []string) (success bool) {
+// Returns the local shape with shapeHash, if this canvas added it
+func (canvas *canvasStruct) localShape(shapeHash string) (shape Shape, ok bool) {
+	canvas.shapesLock.RLock()
+	defer canvas.shapesLock.RUnlock()
+	shape, ok = canvas.shapes[shapeHash]
+	return shape, ok
+}
+
+func CreateHtmlFile(canvasSettings CanvasSettings, shapes []string) (success bool) {
 	f, err := os.Create("./output.html")
 	if err == nil {
 		_, err = f.WriteString("<svg height=" + fmt.Sprint(canvasSettings.CanvasYMax) + " width=" + fmt.Sprint(canvasSettings.CanvasYMax) + ">\n")
@@ -417,13 +585,33 @@ func CreateHtmlFile(shapes []string) (success bool) {
 	return false
 }
 
+// A Canvas keeps all of its state to itself, so a process can open several
+// canvases, and every method may be called from many goroutines at once.
 type canvasStruct struct {
-	// CanvasSettings?
-	// shapes belonging to this instance - use map with shapeHash as key and {svg string and ink cost} as value?
-	// RPC connection similar to dfslib
+	// Set when the canvas is opened and never changed afterwards
 	MyCanvasSettings *shared.CanvasSettings
-	Miner            *rpc.Client
 	PrivKey          ecdsa.PrivateKey
+	options          Options
+	log              *slog.Logger
+
+	// Shapes added through this canvas, by shapeHash
+	shapesLock sync.RWMutex
+	shapes     map[string]Shape
+
+	// Miners to use, the first one and then the backups
+	minerAddrs []string
+
+	// Guards the connection state below
+	lock sync.Mutex
+
+	// Current miner's address, connection and the session it opened for
+	// this canvas. Miner is nil while the miner cannot be reached.
+	current   int
+	failures  int
+	Miner     *rpc.Client
+	MinerAddr string
+	SessionID string
+	closed    bool
 }
 
 // needs to be accessed by miner
@@ -443,47 +631,78 @@ type ConnectionArgs struct {
 // key type contains the public key). Returns a Canvas instance that
 // can be used for all future interactions with blockartlib.
 //
-// The returned Canvas instance is a singleton: an application is
-// expected to interact with just one Canvas instance at a time.
+// Every call returns a new Canvas instance with its own connection and
+// shapes. A Canvas is safe for concurrent use.
 //
 // Can return the following errors:
 // - DisconnectedError
 func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
+	return OpenCanvasWithOptions(minerAddr, privKey, Options{})
+}
+
+// Same as OpenCanvas, with control over retries and backup miners to fail
+// over to when the miner cannot be reached.
+//
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidArtNodeMinerKeyPairError
+func OpenCanvasWithOptions(minerAddr string, privKey ecdsa.PrivateKey, opts Options) (canvas Canvas, setting CanvasSettings, err error) {
 
 	// establish RPC connection with miner using minerAddr for connection and privkey as args (Connect)
 	// return disconnected error if cannot connect to miner
 	// validate that this miner mines on behalf of the right key pair (whatever that means)
 	// initialize or get existing instance of canvas, I assume Canvas instance is singleton per artnode
 	// wait for miner to respond with settings and then return
-	mAddr = minerAddr
-	miner, err := rpc.Dial("tcp", minerAddr)
-	if err != nil {
-		fmt.Println("Dialing Error", err)
+	if opts.Retries <= 0 {
+		opts.Retries = 3
 	}
-	// verify miner
-	msg := []byte("Hello")
-	r, s, _ := ecdsa.Sign(rand.Reader, &privKey, msg)
-	reply := shared.OpenCanvasReply{}
-	args := shared.Args{R: r, S: s, Message: msg}
-
-	err = miner.Call("ArtNodeMinerRPC.OpenCanvasRPC", &args, &reply)
-	if err != nil {
-		fmt.Println(err)
-		return nil, CanvasSettings{}, DisconnectedError(minerAddr)
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.Logger == nil {
+		opts.Logger = logging.New(os.Stderr, slog.LevelInfo, "blockartlib")
 	}
 
-	fmt.Println("Keys matched?:", reply.KeyMatched)
+	canvasInstance := &canvasStruct{
+		PrivKey:    privKey,
+		shapes:     make(map[string]Shape),
+		options:    opts,
+		log:        opts.Logger.With("key", logging.KeyPrefix(privKey.PublicKey)),
+		minerAddrs: append([]string{minerAddr}, opts.BackupMiners...),
+	}
 
-	//Key pair did not match with the miner
-	if reply.KeyMatched != true {
-		fmt.Println("Keys did not matched: ", reply.KeyMatched)
-		return nil, CanvasSettings{}, new(InvalidArtNodeMinerKeyPairError)
+	var reply shared.OpenCanvasReply
+	backoff := opts.Backoff
+	for i, addr := range canvasInstance.minerAddrs {
+		for attempt := 0; attempt < opts.Retries; attempt++ {
+			var miner *rpc.Client
+			miner, reply, err = connect(addr, privKey, canvasInstance.log)
+			if err == nil {
+				canvasInstance.current = i
+				canvasInstance.Miner = miner
+				canvasInstance.MinerAddr = addr
+				canvasInstance.SessionID = reply.SessionID
+				break
+			}
+			if _, ok := err.(*InvalidArtNodeMinerKeyPairError); ok {
+				// Retrying will not change the miner's key
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if canvasInstance.Miner != nil {
+			break
+		}
+	}
+	if canvasInstance.Miner == nil {
+		return nil, CanvasSettings{}, err
 	}
 
-	canvasSettings = CanvasSettings(reply.MyCanvasSettings)
-	canvasInstance := canvasStruct{&reply.MyCanvasSettings, miner, privKey}
+	settings := CanvasSettings(reply.MyCanvasSettings)
+	canvasInstance.MyCanvasSettings = &reply.MyCanvasSettings
 
-	return canvasInstance, canvasSettings, nil
+	return canvasInstance, settings, nil
 }
 
 // Adds a new shape to the canvas.
@@ -494,7 +713,15 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 // - ShapeSvgStringTooLongError
 // - ShapeOverlapError
 // - OutOfBoundsError
-func (canvas canvasStruct) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+// - RegionClaimedError
+func (canvas *canvasStruct) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return canvas.AddShapeOnLayer(validateNum, "", shapeType, shapeSvgString, fill, stroke)
+}
+
+// Same as AddShape, but puts the shape on the named layer of the canvas
+// instead of the base layer. It only overlaps shapes there.
+// Can return the errors AddShape can, and InvalidLayerError.
+func (canvas *canvasStruct) AddShapeOnLayer(validateNum uint8, layer string, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
 	// if length of shapeSvgString > 128, return ShapeSvgStringTooLongError
 
 	// for now all svg is PATH, so care about shapeType if we do extra
@@ -503,7 +730,7 @@ func (canvas canvasStruct) AddShape(validateNum uint8, shapeType ShapeType, shap
 	// - if shapeSvgString is invalid, return InvalidShapeSvgStringError (shapeSvgString represents 'd' attribute of svg. how to check if svg is invalid?)
 	// - if the path needs to go beyond CanvasSettings x and y, return OutOfBoundsError
 
-	// hash the operation, then send validateNum, operation, its hash, inkRequired and publicKey to miner (AddShape)
+	// sign the operation, then send validateNum, operation, inkRequired and publicKey to miner (AddShape)
 	// if cant connect to miner return DisconnectedError
 	// miner checks the following:
 	// - if not enough ink for inkRequired, return InsufficientInkError
@@ -512,10 +739,11 @@ func (canvas canvasStruct) AddShape(validateNum uint8, shapeType ShapeType, shap
 	// on success miner adds shape to global canvas saveing operation and its ink cost
 	// 		and returns blockHash and inkRemaining after validation
 
-	// save operation and its ink cost to canvas struct shapes with its hash as key
-	// return operation hash, blockHash, inkRemaining and nil error
+	// the miner derives the shape hash from the signed operation (shared.Operation.ContentHash)
+	// save operation and its ink cost to canvas struct shapes with that hash as key
+	// return shape hash, blockHash, inkRemaining and nil error
 
-	err, _ = IsValidSvgShape(shapeType, shapeSvgString, fill, stroke) // will return ShapeSvgStringTooLongError, InvalidShapeSvgStringError, OutOfBoundsError
+	err, _ = IsValidSvgShape(CanvasSettings(*canvas.MyCanvasSettings), shapeType, shapeSvgString, fill, stroke) // will return ShapeSvgStringTooLongError, InvalidShapeSvgStringError, OutOfBoundsError
 	if err != nil {
 		return "", "", 0, err
 	}
@@ -524,60 +752,47 @@ func (canvas canvasStruct) AddShape(validateNum uint8, shapeType ShapeType, shap
 	if len(stroke) == 0 || len(fill) == 0 {
 		return "", "", 0, InvalidShapeSvgStringError(shapeSvgString)
 	}
+	if _, ok := canvas.MyCanvasSettings.LayerIndex(layer); !ok {
+		return "", "", 0, InvalidLayerError(layer)
+	}
 
 	fullSvgString := "<path d=\"" + shapeSvgString + "\" stroke=\"" + stroke + "\" fill=\"" + fill + "\"/>"
 	inkUsed := CalculateInkUsed(shapeType, shapeSvgString, fill, stroke)
-	shapeHash = computeHash(fullSvgString + time.Now().String())
 
 	//sign the operation with node's private key
-	reply := shared.AddShapeReply{"", 0, 0, ""}
-
-	r, s, _ := ecdsa.Sign(rand.Reader, &canvas.PrivKey, []byte(shapeSvgString))
-	args := shared.Operation{Fill: fill, Stroke: stroke, NumBlockValidate: validateNum, AppShapeOp: fullSvgString, InkCost: inkUsed, ShapeHash: shapeHash, R: r, S: s, IsDelete: false, DAttribute: shapeSvgString, ShapeType: int(shapeType)}
-
-	err = canvas.Miner.Call("ArtNodeMinerRPC.AddShapeRPC", &args, &reply)
+	var reply shared.AddShapeReply
+
+	args := shared.Operation{Fill: fill, Stroke: stroke, NumBlockValidate: validateNum, AppShapeOp: fullSvgString, InkCost: inkUsed, IsDelete: false, DAttribute: shapeSvgString, ShapeType: int(shapeType), Layer: layer, TraceID: logging.NewTraceID()}
+	args.R, args.S, _ = ecdsa.Sign(rand.Reader, &canvas.PrivKey, args.SignedBytes())
+	canvas.log.Debug("adding shape", "trace", args.TraceID)
+
+	// If the connection breaks while the miner works on the operation, the
+	// same operation (same signature, so same shape hash) is sent again. Miners recognise it and
+	// wait for the copy they already have instead of adding it twice.
+	err = canvas.call("ArtNodeMinerRPC.AddShapeRPC", func(sessionID string) interface{} {
+		return &shared.OperationArgs{SessionID: sessionID, Operation: args}
+	}, &reply)
 	if err != nil {
-		fmt.Println("ERR", err)
-		return "", "", 0, DisconnectedError(mAddr)
-	}
-	if reply.ErrorCode == -1 {
-		return "", "", 0, InsufficientInkError(inkUsed)
+		canvas.log.Error("ArtNodeMinerRPC.AddShapeRPC failed", "trace", args.TraceID, "err", err)
+		return "", "", 0, DisconnectedError(canvas.minerAddr())
 	}
-	if reply.ErrorCode == -2 {
-		return "", "", 0, ShapeOverlapError(reply.OverlappedShapeHash)
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return "", "", 0, err
 	}
 
-	// TODO AddShape should take fullSvgString
-	AddShape(inkUsed, shapeHash, shapeType, shapeSvgString, fill, stroke)
+	// TODO addLocalShape should take fullSvgString
+	shapeHash = reply.ShapeHash
+	canvas.addLocalShape(inkUsed, shapeHash, shapeType, shapeSvgString, fill, stroke)
+	canvas.log.Debug("shape added", "trace", args.TraceID, "shape", shapeHash, "block", reply.BlockHash)
 
 	return shapeHash, reply.BlockHash, reply.InkRemaining, nil
 }
 
-type AddShapeReply struct {
-	BlockHash           string
-	InkRemaining        uint32
-	ErrorCode           int
-	OverlappedShapeHash string
-}
-
-// Returns the MD5 hash as a hex string for the str
-func computeHash(str string) string {
-	h := md5.New()
-	h.Write([]byte(str))
-	retVal := hex.EncodeToString(h.Sum(nil))
-	return retVal
-}
-
-type GetSvgStringReply struct {
-	Data  string
-	Found bool
-}
-
 // Returns the encoding of the shape as an svg string.
 // Can return the following errors:
 // - DisconnectedError
 // - InvalidShapeHashError
-func (canvas canvasStruct) GetSvgString(shapeHash string) (svgString string, err error) {
+func (canvas *canvasStruct) GetSvgString(shapeHash string) (svgString string, err error) {
 	// if the shape belongs to this artnode return it right away
 	// otherwise ask miner for that shape by sending shapeHash (GetSvgString)
 	// if cant connect to miner return DisconnectedError
@@ -588,17 +803,16 @@ func (canvas canvasStruct) GetSvgString(shapeHash string) (svgString string, err
 	//		2. store shapes only produced by the art nodes of the miner
 	// I think 1. is better, because if other miners fail, their shapes are still available, even though we duplicate lots of data
 
-	//var reply string
-	reply := shared.GetSvgStringReply{"", false}
-	args := shared.Args{ShapeHash: shapeHash}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.GetSvgStringRPC", &args, &reply)
+	var reply shared.GetSvgStringReply
+	err = canvas.call("ArtNodeMinerRPC.GetSvgStringRPC", func(sessionID string) interface{} {
+		return &shared.Args{SessionID: sessionID, ShapeHash: shapeHash}
+	}, &reply)
 	if err != nil {
-		return "", DisconnectedError("")
+		return "", DisconnectedError(canvas.minerAddr())
 	}
 
-	if !reply.Found {
-		fmt.Println("ERR GetSvgStringReply", reply.Found)
-		return "", InvalidShapeHashError(shapeHash)
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return "", err
 	}
 
 	return reply.Data, nil
@@ -607,73 +821,246 @@ func (canvas canvasStruct) GetSvgString(shapeHash string) (svgString string, err
 // Returns the amount of ink currently available.
 // Can return the following errors:
 // - DisconnectedError
-func (canvas canvasStruct) GetInk() (inkRemaining uint32, err error) {
+func (canvas *canvasStruct) GetInk() (inkRemaining uint32, err error) {
 	// just ask miner for inkRemaining (GetInk)
 	// if cant connect to miner return DisconnectedError
 
-	var reply uint32
-	args := shared.Args{}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.GetInkRPC", &args, &reply)
+	var reply shared.InkReply
+	err = canvas.call("ArtNodeMinerRPC.GetInkRPC", func(sessionID string) interface{} {
+		return &shared.Args{SessionID: sessionID}
+	}, &reply)
 	if err != nil {
-
-		fmt.Println(err)
-		return 0, DisconnectedError("")
+		canvas.log.Error("ArtNodeMinerRPC.GetInkRPC failed", "err", err)
+		return 0, DisconnectedError(canvas.minerAddr())
 	}
 
-	return reply, nil
+	return reply.InkRemaining, ErrorFromReply(reply.Error)
 }
 
-// Removes a shape from the canvas.
+// Removes a shape from the canvas. Co-owners may remove it too, and get
+// the ink it cost back.
 // Can return the following errors:
 // - DisconnectedError
 // - ShapeOwnerError
-func (canvas canvasStruct) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
-	// first check if this artnode owns the shape - check the map, if there is entry, it means it belongs to this artnode
-	// otherwise return ShapeOwnerError
-
+// - InvalidShapeHashError
+func (canvas *canvasStruct) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
 	// send shapeHash and validateNum to miner (DeleteShape)
 	// if cant connect to miner return DisconnectedError
-	// if there is no shape in miner network with this shapeHash, return InvalidShapeHashError (not specified in interface?)
+	// if there is no shape in miner network with this shapeHash, return InvalidShapeHashError
 	// miner waits for validation, i.e. there must be validateNum blocks after the block with the operation
 	// on success miner removes this shape from the global canvas and refunds the ink cost specified, and returns inkRemaining
 
-	isOwner := true
-	// TODO validate that local shapeMap has the shape
-	if !isOwner {
-		return 0, ShapeOwnerError(shapeHash)
-	}
+	// Shapes given to or shared with this key were not added by this
+	// canvas; the miner checks that the key owns those
+	myShape, _ := canvas.localShape(shapeHash)
 
-	myShape := myShapes[shapeHash]
 	stroke := myShape.Stroke
 	fill := myShape.Fill
 	dAttribute := myShape.DAttribute
 	shapeType := myShape.ShapeType
 
-	var reply uint32
+	var reply shared.InkReply
+	args := shared.Operation{NumBlockValidate: validateNum, Stroke: stroke, Fill: fill, ShapeHash: shapeHash, DAttribute: dAttribute, ShapeType: int(shapeType), IsDelete: true, TraceID: logging.NewTraceID()}
+	//sign the operation with node's private key
+	args.R, args.S, _ = ecdsa.Sign(rand.Reader, &canvas.PrivKey, args.SignedBytes())
+	canvas.log.Debug("deleting shape", "trace", args.TraceID, "shape", shapeHash)
+	err = canvas.call("ArtNodeMinerRPC.DeleteShapeRPC", func(sessionID string) interface{} {
+		return &shared.OperationArgs{SessionID: sessionID, Operation: args}
+	}, &reply)
+	if err != nil {
+		canvas.log.Error("ArtNodeMinerRPC.DeleteShapeRPC failed", "trace", args.TraceID, "err", err)
+		return 0, DisconnectedError(canvas.minerAddr())
+	}
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return 0, err
+	}
+
+	canvas.deleteLocalShape(shapeHash)
+
+	return reply.InkRemaining, nil
+}
+
+// Moves amount ink from this art node's key to the key to.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidTransferError
+func (canvas *canvasStruct) TransferInk(validateNum uint8, to ecdsa.PublicKey, amount uint32) (inkRemaining uint32, err error) {
+	// The curve goes over gob as its parameters
+	if to.Curve != nil {
+		to.Curve = to.Curve.Params()
+	}
+
+	var reply shared.InkReply
+	args := shared.Operation{NumBlockValidate: validateNum, IsTransfer: true, TransferTo: to, InkCost: amount, Nonce: newNonce(), TraceID: logging.NewTraceID()}
+	//sign the transfer with node's private key
+	args.R, args.S, _ = ecdsa.Sign(rand.Reader, &canvas.PrivKey, args.SignedBytes())
+	canvas.log.Debug("transferring ink", "trace", args.TraceID, "ink", amount)
+
+	// Resent with the same signature, so the same ID, if the connection
+	// breaks, like AddShape
+	err = canvas.call("ArtNodeMinerRPC.TransferInkRPC", func(sessionID string) interface{} {
+		return &shared.OperationArgs{SessionID: sessionID, Operation: args}
+	}, &reply)
+	if err != nil {
+		canvas.log.Error("ArtNodeMinerRPC.TransferInkRPC failed", "trace", args.TraceID, "err", err)
+		return 0, DisconnectedError(canvas.minerAddr())
+	}
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return 0, err
+	}
+
+	return reply.InkRemaining, nil
+}
+
+// Reserves region of the named layer for this art node's key for the blocks
+// blocks after the one holding the claim: other keys cannot draw there
+// until then. Costs the area of the region in ink.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidRegionError
+// - InvalidLayerError
+// - OutOfBoundsError
+// - RegionClaimedError
+func (canvas *canvasStruct) ClaimRegion(validateNum uint8, layer string, region Region, blocks uint32) (claimID string, blockHash string, inkRemaining uint32, err error) {
+	if _, ok := canvas.MyCanvasSettings.LayerIndex(layer); !ok {
+		return "", "", 0, InvalidLayerError(layer)
+	}
+
+	args := shared.Operation{NumBlockValidate: validateNum, IsClaim: true, Layer: layer, Region: shared.Region(region), ClaimBlocks: blocks, TraceID: logging.NewTraceID()}
+	//sign the claim with node's private key
+	args.R, args.S, _ = ecdsa.Sign(rand.Reader, &canvas.PrivKey, args.SignedBytes())
+	canvas.log.Debug("claiming region", "trace", args.TraceID, "layer", layer)
+
+	// Resent with the same signature, so the same ID, if the connection
+	// breaks, like AddShape
+	var reply shared.AddShapeReply
+	err = canvas.call("ArtNodeMinerRPC.ClaimRegionRPC", func(sessionID string) interface{} {
+		return &shared.OperationArgs{SessionID: sessionID, Operation: args}
+	}, &reply)
+	if err != nil {
+		canvas.log.Error("ArtNodeMinerRPC.ClaimRegionRPC failed", "trace", args.TraceID, "err", err)
+		return "", "", 0, DisconnectedError(canvas.minerAddr())
+	}
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return "", "", 0, err
+	}
+	return reply.ShapeHash, reply.BlockHash, reply.InkRemaining, nil
+}
+
+// Replaces a shape this art node owns or co-owns with a new one in a single
+// operation that keeps the shape hash. Only the difference in ink is
+// charged or refunded, and the new shape may overlap the old. It stays on
+// the layer of the old.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - InvalidShapeSvgStringError
+// - ShapeSvgStringTooLongError
+// - ShapeOverlapError
+// - OutOfBoundsError
+// - RegionClaimedError
+// - ShapeOwnerError
+// - InvalidShapeHashError
+func (canvas *canvasStruct) ModifyShape(validateNum uint8, shapeHash string, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (blockHash string, inkRemaining uint32, err error) {
+	err, _ = IsValidSvgShape(CanvasSettings(*canvas.MyCanvasSettings), shapeType, shapeSvgString, fill, stroke)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(stroke) == 0 || len(fill) == 0 {
+		return "", 0, InvalidShapeSvgStringError(shapeSvgString)
+	}
+
+	inkUsed := CalculateInkUsed(shapeType, shapeSvgString, fill, stroke)
+	args := shared.Operation{Fill: fill, Stroke: stroke, NumBlockValidate: validateNum, InkCost: inkUsed, ShapeHash: shapeHash, IsModify: true, DAttribute: shapeSvgString, ShapeType: int(shapeType), Nonce: newNonce(), TraceID: logging.NewTraceID()}
 	//sign the operation with node's private key
-	r, s, _ := ecdsa.Sign(rand.Reader, &canvas.PrivKey, []byte(dAttribute))
-	args := shared.Operation{NumBlockValidate: validateNum, Stroke: stroke, Fill: fill, ShapeHash: shapeHash, R: r, S: s, DAttribute: dAttribute, ShapeType: int(shapeType), IsDelete: true}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.DeleteShapeRPC", &args, &reply)
+	args.R, args.S, _ = ecdsa.Sign(rand.Reader, &canvas.PrivKey, args.SignedBytes())
+	canvas.log.Debug("modifying shape", "trace", args.TraceID, "shape", shapeHash)
+
+	// Resent with the same signature if the connection breaks, like AddShape
+	var reply shared.AddShapeReply
+	err = canvas.call("ArtNodeMinerRPC.ModifyShapeRPC", func(sessionID string) interface{} {
+		return &shared.OperationArgs{SessionID: sessionID, Operation: args}
+	}, &reply)
 	if err != nil {
-		fmt.Println(err)
-		return 0, DisconnectedError("")
+		canvas.log.Error("ArtNodeMinerRPC.ModifyShapeRPC failed", "trace", args.TraceID, "err", err)
+		return "", 0, DisconnectedError(canvas.minerAddr())
+	}
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return "", 0, err
 	}
 
-	// TODO remove the shape from local shapeMap
+	if _, ok := canvas.localShape(shapeHash); ok {
+		canvas.addLocalShape(inkUsed, shapeHash, shapeType, shapeSvgString, fill, stroke)
+	}
+	return reply.BlockHash, reply.InkRemaining, nil
+}
 
-	return 0, nil
+// Gives a shape this art node owns or co-owns to another key, which
+// becomes its only owner.
+// Can return the following errors:
+// - DisconnectedError
+// - ShapeOwnerError
+// - InvalidShapeHashError
+// - InvalidOwnerError
+func (canvas *canvasStruct) GiveShape(validateNum uint8, shapeHash string, to ecdsa.PublicKey) (blockHash string, err error) {
+	blockHash, err = canvas.changeOwners(shared.Operation{NumBlockValidate: validateNum, ShapeHash: shapeHash, IsGive: true, TransferTo: to})
+	if err == nil {
+		canvas.deleteLocalShape(shapeHash)
+	}
+	return blockHash, err
+}
+
+// Shares a shape this art node owns or co-owns with another key, which may
+// then delete, give or share the shape, and draw over it.
+// Can return the following errors:
+// - DisconnectedError
+// - ShapeOwnerError
+// - InvalidShapeHashError
+// - InvalidOwnerError
+func (canvas *canvasStruct) ShareShape(validateNum uint8, shapeHash string, with ecdsa.PublicKey) (blockHash string, err error) {
+	return canvas.changeOwners(shared.Operation{NumBlockValidate: validateNum, ShapeHash: shapeHash, IsShare: true, TransferTo: with})
 }
 
-type GetShapesReply struct {
-	Data  []string
-	Found bool
+// Returns a random nonce for a modify, give, share or transfer.
+func newNonce() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Signs and sends a give or share, and waits for it to be validated.
+func (canvas *canvasStruct) changeOwners(args shared.Operation) (blockHash string, err error) {
+	// The curve goes over gob as its parameters
+	if args.TransferTo.Curve != nil {
+		args.TransferTo.Curve = args.TransferTo.Curve.Params()
+	}
+	args.Nonce = newNonce()
+	args.TraceID = logging.NewTraceID()
+	//sign the change with node's private key
+	args.R, args.S, _ = ecdsa.Sign(rand.Reader, &canvas.PrivKey, args.SignedBytes())
+	canvas.log.Debug("changing owners", "trace", args.TraceID, "shape", args.ShapeHash, "give", args.IsGive)
+
+	var reply shared.ChangeOwnersReply
+	err = canvas.call("ArtNodeMinerRPC.ChangeOwnersRPC", func(sessionID string) interface{} {
+		return &shared.OperationArgs{SessionID: sessionID, Operation: args}
+	}, &reply)
+	if err != nil {
+		canvas.log.Error("ArtNodeMinerRPC.ChangeOwnersRPC failed", "trace", args.TraceID, "err", err)
+		return "", DisconnectedError(canvas.minerAddr())
+	}
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return "", err
+	}
+	return reply.BlockHash, nil
 }
 
 // Retrieves hashes contained by a specific block.
 // Can return the following errors:
 // - DisconnectedError
 // - InvalidBlockHashError
-func (canvas canvasStruct) GetShapes(blockHash string) (shapeHashes []string, err error) {
+func (canvas *canvasStruct) GetShapes(blockHash string) (shapeHashes []string, err error) {
 	// send blockHash to miner
 	// if cant connect to miner return DisconnectedError
 	// if miner cant return shapeHashes return InvalidBlockHashError
@@ -681,83 +1068,90 @@ func (canvas canvasStruct) GetShapes(blockHash string) (shapeHashes []string, er
 	// I assume miner will have access to list of shapeHashes for each block, since they have access to the whole tree of blocks
 	// if there is no block with blockhash that's InvalidBlockHashError
 
-	//var reply []string
-	reply := shared.GetShapesReply{[]string{}, false}
-	args := shared.Args{BlockHash: blockHash}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.GetShapesRPC", &args, &reply)
+	var reply shared.GetShapesReply
+	err = canvas.call("ArtNodeMinerRPC.GetShapesRPC", func(sessionID string) interface{} {
+		return &shared.Args{SessionID: sessionID, BlockHash: blockHash}
+	}, &reply)
 	if err != nil {
-		return []string{}, DisconnectedError("")
+		return []string{}, DisconnectedError(canvas.minerAddr())
 	}
 
-	if !reply.Found {
-		fmt.Println("ERR GetShapesReply", reply.Found)
-		return []string{}, InvalidBlockHashError(blockHash)
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return []string{}, err
 	}
-	return reply.Data, nil
+	return append([]string{}, reply.Data...), nil
 }
 
 // Returns the block hash of the genesis block.
 // Can return the following errors:
 // - DisconnectedError
-func (canvas canvasStruct) GetGenesisBlock() (blockHash string, err error) {
+func (canvas *canvasStruct) GetGenesisBlock() (blockHash string, err error) {
 	// send request to miner
 	// if cant connect to miner return DisconnectedError
 
 	// should be simple, because that is actually in miner settings
 
-	var reply string
-	args := shared.Args{}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.GetGenesisBlockRPC", &args, &reply)
+	var reply shared.GetGenesisBlockReply
+	err = canvas.call("ArtNodeMinerRPC.GetGenesisBlockRPC", func(sessionID string) interface{} {
+		return &shared.Args{SessionID: sessionID}
+	}, &reply)
 	if err != nil {
-		fmt.Println("GetGenesisBlock failed: ", err)
-		return "", DisconnectedError("")
+		canvas.log.Error("ArtNodeMinerRPC.GetGenesisBlockRPC failed", "err", err)
+		return "", DisconnectedError(canvas.minerAddr())
 	}
 
-	return reply, nil
+	return reply.BlockHash, ErrorFromReply(reply.Error)
 }
 
 // Retrieves the children blocks of the block identified by blockHash.
 // Can return the following errors:
 // - DisconnectedError
 // - InvalidBlockHashError
-func (canvas canvasStruct) GetChildren(blockHash string) (blockHashes []string, err error) {
+func (canvas *canvasStruct) GetChildren(blockHash string) (blockHashes []string, err error) {
 	// send blockHash to miner
 	// if cant connect to miner return DisconnectedError
 	// if there is no block with blockHash return InvalidBlockHashError
 	// miner returns all blocks that have blockHash as their prevHash
 
-	//var reply []string
-	reply := shared.GetChildrenReply{[]string{}, false}
-	args := shared.Args{BlockHash: blockHash}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.GetChildrenRPC", &args, &reply)
+	var reply shared.GetChildrenReply
+	err = canvas.call("ArtNodeMinerRPC.GetChildrenRPC", func(sessionID string) interface{} {
+		return &shared.Args{SessionID: sessionID, BlockHash: blockHash}
+	}, &reply)
 	if err != nil {
-		return []string{}, DisconnectedError("")
+		return []string{}, DisconnectedError(canvas.minerAddr())
 	}
 
-	if !reply.Found {
-		fmt.Println("ERR GetChildren", reply.Found)
-		return []string{}, InvalidBlockHashError(blockHash)
+	if err := ErrorFromReply(reply.Error); err != nil {
+		return []string{}, err
 	}
 
-	return reply.Data, nil
+	return append([]string{}, reply.Data...), nil
 }
 
 // Closes the canvas/connection to the BlockArt network.
 // - DisconnectedError
-func (canvas canvasStruct) CloseCanvas() (inkRemaining uint32, err error) {
+func (canvas *canvasStruct) CloseCanvas() (inkRemaining uint32, err error) {
 	// let miner know that this art node is disconnecting
 	// also ask for inkRemaining
 	// if cant connect to miner return DisconnectedError
 	// close the RPC connection
-	var reply uint32
-	args := shared.Args{}
-	err = canvas.Miner.Call("ArtNodeMinerRPC.CloseCanvasRPC", &args, &reply)
-	if err != nil {
-		return 0, DisconnectedError("")
+	// The canvas is closed even if the miner is unreachable, so that every
+	// later call on it fails with DisconnectedError
+	canvas.lock.Lock()
+	defer canvas.lock.Unlock()
+	if canvas.closed || canvas.Miner == nil {
+		canvas.closed = true
+		return 0, DisconnectedError(canvas.MinerAddr)
 	}
+	canvas.closed = true
 
+	var reply shared.InkReply
+	args := shared.Args{SessionID: canvas.SessionID}
+	err = canvas.Miner.Call("ArtNodeMinerRPC.CloseCanvasRPC", &args, &reply)
 	canvas.Miner.Close()
-	canvas.Miner = nil
+	if err != nil {
+		return 0, DisconnectedError(canvas.MinerAddr)
+	}
 
-	return reply, nil
+	return reply.InkRemaining, ErrorFromReply(reply.Error)
 }
@@ -0,0 +1,176 @@
+package blockartlib
+
+import (
+	"../shared"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"log/slog"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+func init() {
+	// For the public key in ink transfers
+	gob.Register(&elliptic.CurveParams{})
+}
+
+// Settings for how a Canvas deals with miners that cannot be reached.
+type Options struct {
+	// Miners that mine on behalf of the same key pair as the first miner.
+	// They are tried in order once a miner has failed Retries times.
+	BackupMiners []string
+
+	// Number of attempts to reach a miner before moving on to the next
+	// one (3)
+	Retries int
+
+	// Delay before the first retry, doubled after every failed attempt
+	// (100ms)
+	Backoff time.Duration
+
+	// Where the canvas logs connection problems and the trace IDs of the
+	// operations it submits. Defaults to info and above on stderr.
+	Logger *slog.Logger
+}
+
+// Messages of the errors a miner returns when it has no session for the
+// art node, e.g. because it was restarted, or when it is stopping.
+var reconnectErrors = []string{"Unknown art node session", "Miner stopped"}
+
+// Whether err means the miner could not be reached, as opposed to the
+// miner rejecting the call.
+func isConnectionError(err error) bool {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		// ErrShutdown, io.EOF, net errors...
+		return true
+	}
+	for _, prefix := range reconnectErrors {
+		if strings.HasPrefix(string(serverErr), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dials the miner at minerAddr and opens a session for the art node with
+// privKey.
+func connect(minerAddr string, privKey ecdsa.PrivateKey, log *slog.Logger) (*rpc.Client, shared.OpenCanvasReply, error) {
+	reply := shared.OpenCanvasReply{}
+
+	miner, err := rpc.Dial("tcp", minerAddr)
+	if err != nil {
+		log.Error("cannot connect to miner", "miner", minerAddr, "err", err)
+		return nil, reply, DisconnectedError(minerAddr)
+	}
+
+	// verify miner
+	msg := []byte("Hello")
+	r, s, _ := ecdsa.Sign(rand.Reader, &privKey, msg)
+	args := shared.Args{R: r, S: s, Message: msg}
+
+	err = miner.Call("ArtNodeMinerRPC.OpenCanvasRPC", &args, &reply)
+	if err != nil {
+		log.Error("ArtNodeMinerRPC.OpenCanvasRPC failed", "miner", minerAddr, "err", err)
+		miner.Close()
+		return nil, reply, DisconnectedError(minerAddr)
+	}
+
+	//Key pair did not match with the miner
+	if err := ErrorFromReply(reply.Error); err != nil {
+		log.Error("miner refused to open a canvas", "miner", minerAddr, "err", err)
+		miner.Close()
+		return nil, reply, err
+	}
+	return miner, reply, nil
+}
+
+// Calls method on the current miner with the args built for the current
+// session. If the miner cannot be reached the call is retried with
+// exponential backoff, reconnecting first, and moves on to the backup
+// miners once the current one has failed opts.Retries times. Errors
+// returned by the miner itself are returned as is.
+func (canvas *canvasStruct) call(method string, args func(sessionID string) interface{}, reply interface{}) error {
+	canvas.lock.Lock()
+	if canvas.closed {
+		canvas.lock.Unlock()
+		return DisconnectedError(canvas.MinerAddr)
+	}
+	client, sessionID := canvas.Miner, canvas.SessionID
+	canvas.lock.Unlock()
+
+	backoff := canvas.options.Backoff
+	attempts := canvas.options.Retries * len(canvas.minerAddrs)
+	for attempt := 0; ; attempt++ {
+		if client != nil {
+			err := client.Call(method, args(sessionID), reply)
+			if err == nil || !isConnectionError(err) {
+				return err
+			}
+			canvas.log.Warn("call failed", "method", method, "err", err)
+		}
+
+		if attempt >= attempts {
+			return DisconnectedError(canvas.minerAddr())
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+
+		var ok bool
+		client, sessionID, ok = canvas.reconnect(client)
+		if !ok {
+			return DisconnectedError(canvas.minerAddr())
+		}
+	}
+}
+
+// Address of the miner the canvas currently talks to.
+func (canvas *canvasStruct) minerAddr() string {
+	canvas.lock.Lock()
+	defer canvas.lock.Unlock()
+	return canvas.MinerAddr
+}
+
+// Replaces the broken connection stale with a new one to the current
+// miner, or to the next miner if the current one has failed too often.
+// Returns a nil client if no miner could be reached this time, and false
+// if the canvas was closed.
+func (canvas *canvasStruct) reconnect(stale *rpc.Client) (*rpc.Client, string, bool) {
+	canvas.lock.Lock()
+	defer canvas.lock.Unlock()
+
+	if canvas.closed {
+		return nil, "", false
+	}
+	if canvas.Miner != stale {
+		// Another call already reconnected
+		return canvas.Miner, canvas.SessionID, true
+	}
+	if canvas.Miner != nil {
+		canvas.Miner.Close()
+		canvas.Miner = nil
+	}
+
+	if canvas.failures >= canvas.options.Retries {
+		canvas.current = (canvas.current + 1) % len(canvas.minerAddrs)
+		canvas.failures = 0
+	}
+	minerAddr := canvas.minerAddrs[canvas.current]
+
+	miner, reply, err := connect(minerAddr, canvas.PrivKey, canvas.log)
+	if err != nil {
+		canvas.failures++
+		return nil, "", true
+	}
+
+	canvas.log.Info("reconnected to miner", "miner", minerAddr)
+	canvas.failures = 0
+	canvas.Miner = miner
+	canvas.MinerAddr = minerAddr
+	canvas.SessionID = reply.SessionID
+	return miner, reply.SessionID, true
+}
@@ -4,46 +4,45 @@ import "fmt"
 import "testing"
 
 func TestIsValidSvgShape(t *testing.T) {
-    canvasSettings.CanvasXMax = 1024
-    canvasSettings.CanvasYMax = 1024
-    err, success := IsValidSvgShape(PATH, "M 0 0", "transparent", "red")
+    canvasSettings := CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+    err, success := IsValidSvgShape(canvasSettings, PATH, "M 0 0", "transparent", "red")
     if !success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "true", "false")
     }
 
     // InvalidShapeSvgStringError
-    err, success = IsValidSvgShape(PATH, "Lasd 0 0", "transparent", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "Lasd 0 0", "transparent", "red")
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 0 0 L 3 Z", "transparent", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 0 0 L 3 Z", "transparent", "red")
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
 
-    err, success = IsValidSvgShape(PATH, " M 0 0 L 3 Z", "transparent", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, " M 0 0 L 3 Z", "transparent", "red")
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 0 0 L 3 Z ", "transparent", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 0 0 L 3 Z ", "transparent", "red")
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 0 0 L 3 Z ", "transparent", "transparent")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 0 0 L 3 Z ", "transparent", "transparent")
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 0 0 M 3 6 Z ", "red", "transparent")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 0 0 M 3 6 Z ", "red", "transparent")
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
@@ -51,9 +50,8 @@ func TestIsValidSvgShape(t *testing.T) {
 }
 
 func TestSimpleLine(t *testing.T) {
-    canvasSettings.CanvasXMax = 1024
-    canvasSettings.CanvasYMax = 1024
-    err, success := IsValidSvgShape(PATH, "M 0 0 L 3 4", "transparent", "red")
+    canvasSettings := CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+    err, success := IsValidSvgShape(canvasSettings, PATH, "M 0 0 L 3 4", "transparent", "red")
     if success {
         area := CalculateInkUsed(PATH, "M 0 0 L 3 4", "transparent", "red")
         if area != 5 {
@@ -64,7 +62,7 @@ func TestSimpleLine(t *testing.T) {
         t.Error("Test fail expected: '%s', got: '%s'", "true", "false")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 0 0 L 20 20", "transparent", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 0 0 L 20 20", "transparent", "red")
     if success {
         area := CalculateInkUsed(PATH, "M 0 0 L 20 20", "transparent", "red")
         if area != 29 {
@@ -77,9 +75,8 @@ func TestSimpleLine(t *testing.T) {
 }
 
 func TestSimpleAreas(t *testing.T) {
-    canvasSettings.CanvasXMax = 1024
-    canvasSettings.CanvasYMax = 1024
-    err, success := IsValidSvgShape(PATH, "M 0 0 h 20 v 20 h -20 z", "red", "red")
+    canvasSettings := CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+    err, success := IsValidSvgShape(canvasSettings, PATH, "M 0 0 h 20 v 20 h -20 z", "red", "red")
     if success {
         area := CalculateInkUsed(PATH, "M 0 0 h 20 v 20 h -20 z", "red", "red")
         if area != 480 {
@@ -90,7 +87,7 @@ func TestSimpleAreas(t *testing.T) {
         t.Error("Test fail expected: '%s', got: '%s'", "true", "false")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 0 0 H 50 V 40 h -20 Z", "red", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 0 0 H 50 V 40 h -20 Z", "red", "red")
     if success {
         area := CalculateInkUsed(PATH, "M 0 0 H 50 V 40 h -20 Z", "red", "red")
         if area != 1560 {
@@ -103,28 +100,32 @@ func TestSimpleAreas(t *testing.T) {
 }
 
 func TestOutOfBounds(t *testing.T) {
-    canvasSettings.CanvasXMax = 5
-    canvasSettings.CanvasYMax = 5
+    canvasSettings := CanvasSettings{CanvasXMax: 5, CanvasYMax: 5}
 
-    err, success := IsValidSvgShape(PATH, "M 5 6", "red", "red")
+    err, success := IsValidSvgShape(canvasSettings, PATH, "M 5 6", "red", "red")
 
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
 
-    _, success = IsValidSvgShape(PATH, "M -1 1", "red", "red")
+    _, success = IsValidSvgShape(canvasSettings, PATH, "M -1 1", "red", "red")
 
     if success {
         fmt.Println("Error ", err)
         t.Error("Test fail expected: '%s', got: '%s'", "false", "true")
     }
+
+    _, success = IsValidSvgShape(canvasSettings, PATH, "M 4294967296 1", "red", "red")
+
+    if success {
+        t.Error("Expected a coordinate that wraps to 0 as a uint32 to be out of bounds")
+    }
 }
 
 func TestComplicatedInkUsed(t *testing.T) {
-    canvasSettings.CanvasXMax = 1024
-    canvasSettings.CanvasYMax = 1024
-    err, success := IsValidSvgShape(PATH, "M 50 50 h -40 l 20 50 h 60 v 30 h 210 z", "transparent", "red")
+    canvasSettings := CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+    err, success := IsValidSvgShape(canvasSettings, PATH, "M 50 50 h -40 l 20 50 h 60 v 30 h 210 z", "transparent", "red")
     if success {
         area := CalculateInkUsed(PATH, "M 50 50 h -40 l 20 50 h 60 v 30 h 210 z", "transparent", "red")
         if area != 657 {
@@ -147,14 +148,13 @@ func TestComplicatedInkUsed(t *testing.T) {
 }
 
 func TestStar(t *testing.T) {
-    canvasSettings.CanvasXMax = 1024
-    canvasSettings.CanvasYMax = 1024
-    err, success := IsValidSvgShape(PATH, "M 250 350 l 100 -200 l 100 200 l -200 -150 h 200 z", "transparent", "red")
+    canvasSettings := CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+    err, success := IsValidSvgShape(canvasSettings, PATH, "M 250 350 l 100 -200 l 100 200 l -200 -150 h 200 z", "transparent", "red")
     if !success {
         t.Error("Test fail expected: '%d', got: '%d'", "true", "false")
     }
 
-    err, success = IsValidSvgShape(PATH, "M 250 350 l 100 -200 l 100 200 l -200 -150 h 200 z", "transparent", "red")
+    err, success = IsValidSvgShape(canvasSettings, PATH, "M 250 350 l 100 -200 l 100 200 l -200 -150 h 200 z", "transparent", "red")
     if success {
         area := CalculateInkUsed(PATH, "M 250 350 l 100 -200 l 100 200 l -200 -150 h 200 z", "transparent", "red")
         if area != 1148 {
@@ -0,0 +1,112 @@
+/*
+
+Generates and checks chain specs: the settings of a BlockArt network, with
+a genesis block hash that commits to all of them. The BlockArt server reads
+a chain spec through "chain-spec-file" in its json config.
+
+Usage:
+
+$ go run chain-spec.go [flags]
+  -name string
+        Name of the network (default: random test network name)
+  -o string
+        File to write the chain spec to (default: stdout)
+  -verify string
+        Chain spec file to check instead of generating one
+  ... plus one flag per setting, see -h
+
+  go run chain-spec.go -name blockart-test -pow-difficulty-op-block 5 -o proj1-server/chain-spec.json
+  go run chain-spec.go -verify proj1-server/chain-spec.json
+
+*/
+
+package main
+
+import (
+	"./genesis"
+	"./shared"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func exitOnError(prefix string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s, err = %s\n", prefix, err.Error())
+		os.Exit(1)
+	}
+}
+
+func randomName() string {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	exitOnError("random name", err)
+	return "blockart-test-" + hex.EncodeToString(b)
+}
+
+// Returns the layer names in the comma-separated list, leaving out empty
+// ones.
+func splitLayers(list string) []string {
+	var layers []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			layers = append(layers, name)
+		}
+	}
+	return layers
+}
+
+func main() {
+	name := flag.String("name", "", "Name of the network (default: random test network name)")
+	out := flag.String("o", "", "File to write the chain spec to (default: stdout)")
+	verify := flag.String("verify", "", "Chain spec file to check instead of generating one")
+
+	minConnections := flag.Uint("min-num-miner-connections", 1, "Minimum number of peers per miner")
+	inkPerOp := flag.Uint("ink-per-op-block", 100, "Ink reward per op block")
+	inkPerNoOp := flag.Uint("ink-per-no-op-block", 20, "Ink reward per no-op block")
+	heartBeat := flag.Uint("heartbeat", 2000, "Milliseconds between heartbeats to the server")
+	difficultyOp := flag.Uint("pow-difficulty-op-block", 4, "Proof of work difficulty of op blocks")
+	difficultyNoOp := flag.Uint("pow-difficulty-no-op-block", 4, "Proof of work difficulty of no-op blocks")
+	retargetWindow := flag.Uint("retarget-window", 16, "Blocks between difficulty retargets (0 never)")
+	targetBlockTime := flag.Uint("target-block-time", 2000, "Target milliseconds per block")
+	canvasX := flag.Uint("canvas-x-max", 1024, "Canvas width")
+	canvasY := flag.Uint("canvas-y-max", 1024, "Canvas height")
+	layers := flag.String("layers", "", "Comma-separated names of the canvas layers above the base layer, bottom up")
+	flag.Parse()
+
+	if *verify != "" {
+		settings, err := genesis.Load(*verify)
+		exitOnError("verify "+*verify, err)
+		fmt.Println("OK", settings.ChainName, settings.GenesisBlockHash)
+		return
+	}
+
+	if *name == "" {
+		*name = randomName()
+	}
+	settings := genesis.New(shared.MinerNetSettings{
+		ChainName:              *name,
+		MinNumMinerConnections: uint8(*minConnections),
+		InkPerOpBlock:          uint32(*inkPerOp),
+		InkPerNoOpBlock:        uint32(*inkPerNoOp),
+		HeartBeat:              uint32(*heartBeat),
+		PoWDifficultyOpBlock:   uint8(*difficultyOp),
+		PoWDifficultyNoOpBlock: uint8(*difficultyNoOp),
+		RetargetWindow:         uint32(*retargetWindow),
+		TargetBlockTime:        uint32(*targetBlockTime),
+		CanvasSettings:         shared.CanvasSettings{CanvasXMax: uint32(*canvasX), CanvasYMax: uint32(*canvasY), Layers: splitLayers(*layers)},
+	})
+
+	if *out != "" {
+		exitOnError("write "+*out, genesis.Save(*out, settings))
+		return
+	}
+	buffer, err := json.MarshalIndent(settings, "", "  ")
+	exitOnError("encode chain spec", err)
+	fmt.Println(string(buffer))
+}
@@ -85,8 +85,14 @@ func CollideWithShape(svgShape string, svgShape2 string) bool {
 }
 
 func CollideWithOtherShapes(shape shared.Operation, shapes map[string]shared.Operation) (bool, string) {
+	if shape.IsTransfer || shape.IsOwnerChange() || shape.IsClaim {
+		// Moves ink, changes owners or reserves a region, draws nothing
+		return false, ""
+	}
 	for _, op := range shapes {
-		if shape.ArtNodeKey.X.Cmp(op.ArtNodeKey.X) == 0 && shape.ArtNodeKey.Y.Cmp(op.ArtNodeKey.Y) == 0 {
+		// Shapes may overlap shapes on other layers, shapes their key owns
+		// or co-owns, and a modified shape the version it replaces
+		if op.Layer != shape.Layer || op.OwnedBy(shape.ArtNodeKey) || (shape.IsModify && op.ShapeHash == shape.ShapeHash) {
 			continue
 		}
 		if isLine(shape.DAttribute) && isLine(op.DAttribute) {
@@ -5,10 +5,10 @@ package createhtml
 import "../blockartlib"
 
 func main() {
-    // NOTE: make sure that canvas settings are setup
+    canvasSettings := blockartlib.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
     shapes := []string{}
     // empty shapes
-    blockartlib.CreateHtmlFile(shapes)
+    blockartlib.CreateHtmlFile(canvasSettings, shapes)
 
     shape1 := "<path d=\"M150 0 L75 200 L225 200 Z\" stroke=\"black\" fill=\"blue\"/>"
 
@@ -17,5 +17,5 @@ func main() {
     shapes = append(shapes, shape2)
 
     // one shape
-    blockartlib.CreateHtmlFile(shapes)
+    blockartlib.CreateHtmlFile(canvasSettings, shapes)
 }
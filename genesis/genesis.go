@@ -0,0 +1,105 @@
+/*
+
+Package genesis implements chain specs: the MinerNetSettings of a BlockArt
+network saved as a JSON file. The genesis block hash of a chain spec is the
+hash of all of its other settings, so miners given settings that were
+changed after the spec was made, or peers on another network, can tell.
+
+*/
+
+package genesis
+
+import (
+	"../shared"
+
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Returned for settings whose genesis block hash is not the hash of the
+// rest of the settings.
+type MismatchError string
+
+func (e MismatchError) Error() string {
+	return fmt.Sprintf("Settings do not match genesis block hash [%s]", string(e))
+}
+
+// Returns the genesis block hash that settings commit to: the MD5 hash of
+// every setting except GenesisBlockHash itself. Layers only count when
+// there are some, so chain specs without them keep their hash.
+func Hash(settings shared.MinerNetSettings) string {
+	spec := fmt.Sprintf("chain-name=%s\n"+
+		"min-num-miner-connections=%d\n"+
+		"ink-per-op-block=%d\n"+
+		"ink-per-no-op-block=%d\n"+
+		"heartbeat=%d\n"+
+		"pow-difficulty-op-block=%d\n"+
+		"pow-difficulty-no-op-block=%d\n"+
+		"retarget-window=%d\n"+
+		"target-block-time=%d\n"+
+		"canvas-x-max=%d\n"+
+		"canvas-y-max=%d\n",
+		settings.ChainName,
+		settings.MinNumMinerConnections,
+		settings.InkPerOpBlock,
+		settings.InkPerNoOpBlock,
+		settings.HeartBeat,
+		settings.PoWDifficultyOpBlock,
+		settings.PoWDifficultyNoOpBlock,
+		settings.RetargetWindow,
+		settings.TargetBlockTime,
+		settings.CanvasSettings.CanvasXMax,
+		settings.CanvasSettings.CanvasYMax)
+	if len(settings.CanvasSettings.Layers) > 0 {
+		spec += fmt.Sprintf("layers=%q\n", settings.CanvasSettings.Layers)
+	}
+
+	h := md5.Sum([]byte(spec))
+	return hex.EncodeToString(h[:])
+}
+
+// Returns settings with GenesisBlockHash set to their hash.
+func New(settings shared.MinerNetSettings) shared.MinerNetSettings {
+	settings.GenesisBlockHash = Hash(settings)
+	return settings
+}
+
+// Checks that the genesis block hash of settings commits to the rest of
+// them.
+func Verify(settings shared.MinerNetSettings) error {
+	if settings.GenesisBlockHash != Hash(settings) {
+		return MismatchError(settings.GenesisBlockHash)
+	}
+	return nil
+}
+
+// Returns the first block of the chain described by settings.
+func Block(settings shared.MinerNetSettings) shared.Block {
+	return shared.Block{Hash: settings.GenesisBlockHash}
+}
+
+// Reads and verifies the chain spec at path.
+func Load(path string) (shared.MinerNetSettings, error) {
+	var settings shared.MinerNetSettings
+
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(buffer, &settings); err != nil {
+		return settings, err
+	}
+	return settings, Verify(settings)
+}
+
+// Writes settings to path as a chain spec.
+func Save(path string, settings shared.MinerNetSettings) error {
+	buffer, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(buffer, '\n'), 0644)
+}
@@ -0,0 +1,65 @@
+package genesis
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"../shared"
+)
+
+var testSettings = shared.MinerNetSettings{
+	ChainName:              "genesis-test",
+	MinNumMinerConnections: 1,
+	InkPerOpBlock:          100,
+	InkPerNoOpBlock:        20,
+	HeartBeat:              2000,
+	PoWDifficultyOpBlock:   4,
+	PoWDifficultyNoOpBlock: 4,
+	CanvasSettings:         shared.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+}
+
+func TestHashCommitsToEverySetting(t *testing.T) {
+	changes := []func(*shared.MinerNetSettings){
+		func(s *shared.MinerNetSettings) { s.ChainName = "other" },
+		func(s *shared.MinerNetSettings) { s.MinNumMinerConnections++ },
+		func(s *shared.MinerNetSettings) { s.InkPerOpBlock++ },
+		func(s *shared.MinerNetSettings) { s.InkPerNoOpBlock++ },
+		func(s *shared.MinerNetSettings) { s.HeartBeat++ },
+		func(s *shared.MinerNetSettings) { s.PoWDifficultyOpBlock++ },
+		func(s *shared.MinerNetSettings) { s.PoWDifficultyNoOpBlock++ },
+		func(s *shared.MinerNetSettings) { s.RetargetWindow++ },
+		func(s *shared.MinerNetSettings) { s.TargetBlockTime++ },
+		func(s *shared.MinerNetSettings) { s.CanvasSettings.CanvasXMax++ },
+		func(s *shared.MinerNetSettings) { s.CanvasSettings.CanvasYMax++ },
+		func(s *shared.MinerNetSettings) { s.CanvasSettings.Layers = []string{"top"} },
+	}
+
+	settings := New(testSettings)
+	if err := Verify(settings); err != nil {
+		t.Fatal(err)
+	}
+	for i, change := range changes {
+		changed := settings
+		change(&changed)
+		if Verify(changed) == nil {
+			t.Error("Change", i, "kept the genesis block hash")
+		}
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain-spec.json")
+	settings := New(testSettings)
+	if err := Save(path, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, settings) {
+		t.Error("Expected", settings, "got", loaded)
+	}
+}
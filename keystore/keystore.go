@@ -0,0 +1,286 @@
+/*
+
+Package keystore keeps named P-384 key pairs in a JSON file, with every
+private key encrypted under a passphrase (AES-256-GCM with a key derived
+by PBKDF2-SHA256). Public keys are stored in the clear so that keys can be
+listed and exported without the passphrase.
+
+*/
+
+package keystore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* ERRORS */
+type KeyNotFoundError string
+
+func (e KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Keystore: no key named [%s]", string(e))
+}
+
+type KeyExistsError string
+
+func (e KeyExistsError) Error() string {
+	return fmt.Sprintf("Keystore: key already exists [%s]", string(e))
+}
+
+var WrongPassphraseError = errors.New("Keystore: wrong passphrase or corrupted key")
+
+// PBKDF2 iterations used for keys added from now on. Keys keep the count
+// they were encrypted with.
+var Iterations = 600000
+
+// Environment variable read by ReadPassphrase before prompting.
+const PassphraseEnv = "BLOCKART_PASSPHRASE"
+
+// A key pair as stored in the keystore file.
+type Entry struct {
+	Name string `json:"name"`
+
+	// Hex of the PKIX DER public key, as printed by Export
+	PublicKey string `json:"public-key"`
+
+	// Hex of the random salt and nonce and of the AES-GCM sealed EC
+	// private key DER
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+	Iterations int    `json:"iterations"`
+}
+
+// Key pairs loaded from a keystore file. Changes are written back by Save.
+type Keystore struct {
+	path    string
+	entries []Entry
+}
+
+// Returns the default keystore file, ~/.blockart/keystore.json.
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".blockart", "keystore.json")
+}
+
+// Reads the keystore file at path. A missing file is an empty keystore.
+func Open(path string) (*Keystore, error) {
+	ks := &Keystore{path: path}
+
+	buffer, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buffer, &ks.entries); err != nil {
+		return nil, fmt.Errorf("keystore %s: %s", path, err)
+	}
+	return ks, nil
+}
+
+// Writes the keystore back to its file, readable by the owner only.
+func (ks *Keystore) Save() error {
+	buffer, err := json.MarshalIndent(ks.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0700); err != nil {
+		return err
+	}
+
+	// Written to a temporary file first so that a crash cannot leave a
+	// half-written keystore behind
+	tmp := ks.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(buffer, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+// Returns the keys in the keystore, by name.
+func (ks *Keystore) List() []Entry {
+	entries := append([]Entry(nil), ks.entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+func (ks *Keystore) find(name string) (int, bool) {
+	for i, entry := range ks.entries {
+		if entry.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Generates a P-384 key pair and adds it under name.
+func (ks *Keystore) Generate(name, passphrase string) (*ecdsa.PrivateKey, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Import(name, priv, passphrase); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// Adds an existing key pair under name.
+func (ks *Keystore) Import(name string, priv *ecdsa.PrivateKey, passphrase string) error {
+	if name == "" {
+		return errors.New("Keystore: key name is empty")
+	}
+	if _, ok := ks.find(name); ok {
+		return KeyExistsError(name)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+	privateKey, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(passphrase, salt, Iterations)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	ks.entries = append(ks.entries, Entry{
+		Name:       name,
+		PublicKey:  hex.EncodeToString(publicKey),
+		Salt:       hex.EncodeToString(salt),
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(aead.Seal(nil, nonce, privateKey, []byte(name))),
+		Iterations: Iterations,
+	})
+	return nil
+}
+
+// Decrypts the key pair named name.
+func (ks *Keystore) Load(name, passphrase string) (*ecdsa.PrivateKey, error) {
+	i, ok := ks.find(name)
+	if !ok {
+		return nil, KeyNotFoundError(name)
+	}
+	entry := ks.entries[i]
+
+	salt, err := hex.DecodeString(entry.Salt)
+	if err != nil {
+		return nil, WrongPassphraseError
+	}
+	nonce, err := hex.DecodeString(entry.Nonce)
+	if err != nil {
+		return nil, WrongPassphraseError
+	}
+	ciphertext, err := hex.DecodeString(entry.Ciphertext)
+	if err != nil {
+		return nil, WrongPassphraseError
+	}
+
+	aead, err := newAEAD(passphrase, salt, entry.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, WrongPassphraseError
+	}
+	privateKey, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, WrongPassphraseError
+	}
+	return x509.ParseECPrivateKey(privateKey)
+}
+
+// Returns the hex of the PKIX DER public key named name, the format used
+// for public keys on the command line.
+func (ks *Keystore) Export(name string) (string, error) {
+	i, ok := ks.find(name)
+	if !ok {
+		return "", KeyNotFoundError(name)
+	}
+	return ks.entries[i].PublicKey, nil
+}
+
+// Removes the key pair named name.
+func (ks *Keystore) Delete(name string) error {
+	i, ok := ks.find(name)
+	if !ok {
+		return KeyNotFoundError(name)
+	}
+	ks.entries = append(ks.entries[:i], ks.entries[i+1:]...)
+	return nil
+}
+
+func newAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the passphrase from $BLOCKART_PASSPHRASE, or else prompts for it
+// on stderr and reads a line from in, so that it never has to appear in
+// argv.
+func ReadPassphrase(prompt string, in io.Reader) (string, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return passphrase, nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Loads the key named name from the keystore at path, reading the
+// passphrase with ReadPassphrase. Used by the miner and art apps.
+func LoadKey(path, name string) (*ecdsa.PrivateKey, error) {
+	ks, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := ReadPassphrase("Passphrase for "+name+": ", os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return ks.Load(name, passphrase)
+}
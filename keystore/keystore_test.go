@@ -0,0 +1,100 @@
+package keystore
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// Keeps the tests fast
+	Iterations = 1000
+}
+
+func TestGenerateSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	ks, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ks.Generate("miner1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := reopened.Load("miner1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.D.Cmp(priv.D) != 0 {
+		t.Error("Loaded a different private key")
+	}
+
+	exported, err := reopened.Export("miner1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if exported != hex.EncodeToString(publicKey) {
+		t.Error("Exported a different public key")
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	ks, _ := Open(filepath.Join(t.TempDir(), "keystore.json"))
+	if _, err := ks.Generate("miner1", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Load("miner1", "guess"); err != WrongPassphraseError {
+		t.Error("Expected WrongPassphraseError, got", err)
+	}
+}
+
+func TestNamesAreUnique(t *testing.T) {
+	ks, _ := Open(filepath.Join(t.TempDir(), "keystore.json"))
+	ks.Generate("b", "secret")
+	ks.Generate("a", "secret")
+	if _, err := ks.Generate("a", "secret"); err == nil {
+		t.Error("Expected a second key named a to fail")
+	}
+
+	entries := ks.List()
+	if len(entries) != 2 || entries[0].Name != "a" || entries[1].Name != "b" {
+		t.Error("Expected keys a and b, got", entries)
+	}
+
+	if err := ks.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Load("a", "secret"); err == nil {
+		t.Error("Loaded a deleted key")
+	}
+}
+
+func TestCiphertextIsBoundToName(t *testing.T) {
+	ks, _ := Open(filepath.Join(t.TempDir(), "keystore.json"))
+	ks.Generate("a", "secret")
+	ks.Generate("b", "secret")
+	ks.entries[0].Ciphertext, ks.entries[1].Ciphertext = ks.entries[1].Ciphertext, ks.entries[0].Ciphertext
+	ks.entries[0].Salt, ks.entries[1].Salt = ks.entries[1].Salt, ks.entries[0].Salt
+	ks.entries[0].Nonce, ks.entries[1].Nonce = ks.entries[1].Nonce, ks.entries[0].Nonce
+	if _, err := ks.Load("a", "secret"); err != WrongPassphraseError {
+		t.Error("Swapped key decrypted under another name:", err)
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	t.Setenv(PassphraseEnv, "from env")
+	if passphrase, _ := ReadPassphrase("", strings.NewReader("typed\n")); passphrase != "from env" {
+		t.Error("Expected the passphrase from the environment, got", passphrase)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+
+Package logging sets up the structured loggers (log/slog) of the miner, the
+art node library and the tools built on them. Every logger tags its lines
+with the component that wrote them, and miners also with a prefix of their
+key, so that the logs of a whole network can be merged and filtered.
+
+Operations carry a trace ID, created by blockartlib, that every component
+logs as "trace" so that one operation can be followed from AddShape to the
+block that holds it.
+
+*/
+
+package logging
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Level above every slog level: nothing is logged.
+const LevelNone = slog.Level(100)
+
+// Parses "debug", "info", "warn", "error" or "none".
+func ParseLevel(s string) (slog.Level, error) {
+	if strings.ToLower(s) == "none" {
+		return LevelNone, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn, error or none)", s)
+	}
+	return level, nil
+}
+
+// Returns a logger writing key=value lines at level and above to w, tagged
+// with component.
+func New(w io.Writer, level slog.Level, component string) *slog.Logger {
+	handler := slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})
+	return slog.New(handler).With("component", component)
+}
+
+// Returns a short, stable tag for key: the first 4 bytes of its X
+// coordinate in hex.
+func KeyPrefix(key ecdsa.PublicKey) string {
+	if key.X == nil {
+		return ""
+	}
+	x := hex.EncodeToString(key.X.Bytes())
+	if len(x) > 8 {
+		x = x[:8]
+	}
+	return x
+}
+
+// Returns a new random trace ID for an operation.
+func NewTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
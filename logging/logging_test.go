@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	levels := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+		"none":  LevelNone,
+	}
+	for s, want := range levels {
+		if level, err := ParseLevel(s); err != nil || level != want {
+			t.Error("ParseLevel", s, "=", level, err, "want", want)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
+
+func TestNewTagsComponent(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, slog.LevelInfo, "miner")
+	logger.Debug("dropped")
+	logger.Info("kept", "trace", "abc")
+
+	if strings.Contains(out.String(), "dropped") {
+		t.Error("Debug line logged at info level:", out.String())
+	}
+	if !strings.Contains(out.String(), "msg=kept component=miner trace=abc") {
+		t.Error("Unexpected log output:", out.String())
+	}
+
+	out.Reset()
+	New(&out, LevelNone, "miner").Error("dropped")
+	if out.Len() != 0 {
+		t.Error("Line logged at level none:", out.String())
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	prefix := KeyPrefix(priv.PublicKey)
+	if len(prefix) != 8 || prefix != KeyPrefix(priv.PublicKey) {
+		t.Error("Unexpected key prefix", prefix)
+	}
+	if KeyPrefix(ecdsa.PublicKey{}) != "" {
+		t.Error("Expected no prefix for an empty key")
+	}
+}
+
+func TestNewTraceID(t *testing.T) {
+	a, b := NewTraceID(), NewTraceID()
+	if len(a) != 16 || a == b {
+		t.Error("Unexpected trace IDs", a, b)
+	}
+}
@@ -0,0 +1,464 @@
+package miner
+
+import (
+	"../shared"
+	"../verification"
+
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// ===================== Art Node - Ink Miner RPC Functions =======================================
+
+// RPC service used by art nodes (blockartlib) to talk to their miner.
+type ArtNodeMinerRPC struct {
+	m *Miner
+}
+
+// Ink left for this miner's art nodes: what the longest chain credits the
+// miner with, less the shapes still waiting for a block.
+func (m *Miner) inkRemaining() uint32 {
+	m.blockChainThread.RLock()
+	defer m.blockChainThread.RUnlock()
+	ink := m.inkBalanceLocked(m.minerInfo.Key)
+
+	m.opsNotInBlockThread.Lock()
+	defer m.opsNotInBlockThread.Unlock()
+	for _, op := range m.opsNotInBlockThread.operations {
+		if _, onCanvas := m.allShapes[op.ShapeHash]; onCanvas && !op.IsModify {
+			continue
+		}
+		if spent := op.InkSpent(); spent > 0 && verification.EqualPublicKey(op.ArtNodeKey, m.minerInfo.Key) {
+			if uint32(spent) > ink {
+				return 0
+			}
+			ink -= uint32(spent)
+		}
+	}
+	return ink
+}
+
+// An art node that opened a canvas on this miner and has not closed it.
+type session struct {
+	opened time.Time
+}
+
+func (m *Miner) openSession() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	if m.ctx.Err() != nil {
+		return "", StoppedError(m.myAddr.String())
+	}
+	m.sessions[hex.EncodeToString(id)] = session{opened: time.Now()}
+	return hex.EncodeToString(id), nil
+}
+
+// Returns an error unless id is an open session.
+func (m *Miner) checkSession(id string) error {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return UnknownSessionError(id)
+	}
+	return nil
+}
+
+func (m *Miner) closeSession(id string) error {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return UnknownSessionError(id)
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+// Ends every session, e.g. when the miner stops.
+func (m *Miner) closeAllSessions() {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	m.sessions = make(map[string]session)
+}
+
+// args: artnode's pubkey
+// reply: CanvasSettings, SessionID, InvalidKeyPair if the key does not match
+func (t *ArtNodeMinerRPC) OpenCanvasRPC(args *shared.Args, reply *shared.OpenCanvasReply) error {
+	//validate the artnode's message and signature
+	reply.MyCanvasSettings = t.m.minerNetSettings.CanvasSettings
+	if !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.Message, args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+
+	id, err := t.m.openSession()
+	if err != nil {
+		return err
+	}
+	reply.SessionID = id
+	return nil
+}
+
+// args: validateNum, operation, inkRequired, artnode's publicKey
+// reply: shapeHash, blockHash, inkRemaining, InvalidKeyPair,
+// InsufficientInk, ShapeOverlap or why the shape is invalid
+// The ink cost, svg string and hash sent by the art node are ignored and
+// recomputed from the checked shape.
+func (t *ArtNodeMinerRPC) AddShapeRPC(opArgs *shared.OperationArgs, reply *shared.AddShapeReply) error {
+	if err := t.m.checkSession(opArgs.SessionID); err != nil {
+		return err
+	}
+	checked, refused := verification.CheckShape(opArgs.Operation, t.m.minerNetSettings.CanvasSettings)
+	if refused.Code != shared.NoError {
+		reply.Error = refused
+		return nil
+	}
+	args := &checked
+	args.ArtNodeKey = t.m.minerInfo.Key
+	args.ShapeHash = args.ContentHash()
+
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.SignedBytes(), args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+
+	if t.m.operationKnown(*args) {
+		// Sent again by an art node that lost its connection: wait for the
+		// copy this miner already has instead of adding it twice
+		reply.BlockHash, reply.Error = t.m.submitOperation(*args)
+	} else if ink := t.m.inkRemaining(); args.InkCost > ink {
+		reply.Error = shared.NewReplyError(shared.InsufficientInk, "")
+	} else {
+		//TODO make opSig in blockartlib
+		reply.BlockHash, reply.Error = t.m.AddOperationHelper(*args)
+	}
+
+	if reply.BlockHash == "" && reply.Error.Code == shared.NoError {
+		return StoppedError(t.m.myAddr.String())
+	}
+	if reply.Error.Code == shared.NoError {
+		reply.ShapeHash = args.ShapeHash
+	}
+	reply.InkRemaining = t.m.inkRemaining()
+	if reply.Error.Code == shared.InsufficientInk {
+		reply.Error.InkRemaining = reply.InkRemaining
+	}
+	return nil
+}
+
+// args: shapeHash, the new shape, validateNum
+// reply: blockHash, inkRemaining, InvalidShapeHash, ShapeOwner,
+// InsufficientInk, RegionClaimed, ShapeOverlap or why the new shape is
+// invalid
+// Replaces a shape this miner's key owns or co-owns in place, on the same
+// layer, charging or refunding the difference in ink. The new shape may
+// overlap the old one.
+func (t *ArtNodeMinerRPC) ModifyShapeRPC(opArgs *shared.OperationArgs, reply *shared.AddShapeReply) error {
+	if err := t.m.checkSession(opArgs.SessionID); err != nil {
+		return err
+	}
+	args := &opArgs.Operation
+	args.ArtNodeKey = t.m.minerInfo.Key
+	args.IsModify = true
+
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.SignedBytes(), args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+
+	t.m.blockChainThread.RLock()
+	shape, onCanvas := t.m.allShapes[args.ShapeHash]
+	checked, refused := verification.CheckModify(*args, shape, onCanvas, t.m.minerNetSettings.CanvasSettings)
+	intersected, shapeHashCollided := HasIntersection(checked, t.m.allShapes)
+	claimID, claimed := t.m.claimInTheWayLocked(checked)
+	t.m.blockChainThread.RUnlock()
+
+	switch {
+	case t.m.operationKnown(*args):
+		// Sent again by an art node that lost its connection
+		reply.BlockHash, reply.Error = t.m.submitOperation(*args)
+	case refused.Code != shared.NoError:
+		reply.Error = refused
+	case checked.InkSpent() > int64(t.m.inkRemaining()):
+		reply.Error = shared.NewReplyError(shared.InsufficientInk, "")
+	case claimed:
+		reply.Error = shared.NewReplyError(shared.RegionClaimed, claimID)
+	case intersected:
+		reply.Error = shared.NewReplyError(shared.ShapeOverlap, shapeHashCollided)
+	default:
+		t.m.log.Debug("modifying shape", "trace", args.TraceID, "shape", args.ShapeHash, "version", checked.Version)
+		reply.BlockHash, reply.Error = t.m.submitOperation(checked)
+	}
+
+	if reply.BlockHash == "" && reply.Error.Code == shared.NoError {
+		return StoppedError(t.m.myAddr.String())
+	}
+	reply.InkRemaining = t.m.inkRemaining()
+	if reply.Error.Code == shared.InsufficientInk {
+		reply.Error.InkRemaining = reply.InkRemaining
+	}
+	return nil
+}
+
+// args: shapeHash
+// reply: shape's svgstring, InvalidShapeHash if it is not on the canvas
+func (t *ArtNodeMinerRPC) GetSvgStringRPC(args *shared.Args, reply *shared.GetSvgStringReply) error {
+	if err := t.m.checkSession(args.SessionID); err != nil {
+		return err
+	}
+	t.m.blockChainThread.RLock()
+	defer t.m.blockChainThread.RUnlock()
+
+	thisShape, ok := t.m.allShapes[args.ShapeHash]
+	if !ok {
+		reply.Error = shared.NewReplyError(shared.InvalidShapeHash, args.ShapeHash)
+		return nil
+	}
+	// grab the SVG string for this shape
+	reply.Data = thisShape.AppShapeOp
+	return nil
+}
+
+// args: none
+// reply: inkRemaining
+func (t *ArtNodeMinerRPC) GetInkRPC(args *shared.Args, reply *shared.InkReply) error {
+	if err := t.m.checkSession(args.SessionID); err != nil {
+		return err
+	}
+	// should we take the ink used/returned in blocks not added into the blockchain into consideration?
+	reply.InkRemaining = t.m.inkRemaining()
+	return nil
+}
+
+// args: shapeHash, validateNum
+// reply: inkRemaining, InvalidKeyPair, InvalidShapeHash or ShapeOwner
+func (t *ArtNodeMinerRPC) DeleteShapeRPC(opArgs *shared.OperationArgs, reply *shared.InkReply) error {
+	if err := t.m.checkSession(opArgs.SessionID); err != nil {
+		return err
+	}
+	args := &opArgs.Operation
+	args.ArtNodeKey = t.m.minerInfo.Key
+	args.IsDelete = true
+
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.SignedBytes(), args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+
+	// The refund is the ink the shape cost when it was added or last
+	// modified, and goes to the key that paid it. A delete sent again
+	// after a lost connection keeps the refund of the first copy.
+	if !t.m.operationKnown(*args) {
+		t.m.blockChainThread.RLock()
+		shape := t.m.allShapes[args.ShapeHash]
+		args.InkCost = shape.InkCost
+		args.PaidBy = shape.Payer()
+		t.m.blockChainThread.RUnlock()
+	}
+
+	var blockHash string
+	blockHash, reply.Error = t.m.DeleteOperationHelper(*args)
+	if blockHash == "" && reply.Error.Code == shared.NoError {
+		return StoppedError(t.m.myAddr.String())
+	}
+	reply.InkRemaining = t.m.inkRemaining()
+	return nil
+}
+
+// args: amount (InkCost), recipient (TransferTo), validateNum
+// reply: inkRemaining, InsufficientInk or InvalidTransfer
+// Moves ink from this miner's key to another key once the transfer has
+// validateNum blocks after it. The transfer ID (ShapeHash) sent by the art
+// node is ignored and derived from the signed transfer.
+func (t *ArtNodeMinerRPC) TransferInkRPC(opArgs *shared.OperationArgs, reply *shared.InkReply) error {
+	if err := t.m.checkSession(opArgs.SessionID); err != nil {
+		return err
+	}
+	args := &opArgs.Operation
+	args.ArtNodeKey = t.m.minerInfo.Key
+	args.TransferTo = fixKeyCurve(args.TransferTo)
+	args.ShapeHash = args.ContentHash()
+
+	if reply.Error = verification.CheckTransfer(*args); reply.Error.Code != shared.NoError {
+		return nil
+	}
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.SignedBytes(), args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+
+	var blockHash string
+	if t.m.operationKnown(*args) {
+		// Sent again by an art node that lost its connection
+		blockHash, reply.Error = t.m.submitOperation(*args)
+	} else if ink := t.m.inkRemaining(); args.InkCost > ink {
+		reply.Error = shared.NewReplyError(shared.InsufficientInk, "")
+	} else {
+		t.m.log.Debug("transferring ink", "trace", args.TraceID, "transfer", args.ShapeHash, "ink", args.InkCost)
+		blockHash, reply.Error = t.m.submitOperation(*args)
+	}
+
+	if blockHash == "" && reply.Error.Code == shared.NoError {
+		return StoppedError(t.m.myAddr.String())
+	}
+	reply.InkRemaining = t.m.inkRemaining()
+	if reply.Error.Code == shared.InsufficientInk {
+		reply.Error.InkRemaining = reply.InkRemaining
+	}
+	return nil
+}
+
+// args: layer, region, number of blocks, validateNum
+// reply: claim ID, blockHash, inkRemaining, InsufficientInk, InvalidRegion,
+// InvalidLayer, OutOfBounds or RegionClaimed
+// Reserves a region of a layer for this miner's key once the claim has
+// validateNum blocks after it. The ink cost and claim ID (ShapeHash) sent
+// by the art node are ignored and recomputed from the signed claim.
+func (t *ArtNodeMinerRPC) ClaimRegionRPC(opArgs *shared.OperationArgs, reply *shared.AddShapeReply) error {
+	if err := t.m.checkSession(opArgs.SessionID); err != nil {
+		return err
+	}
+	args := &opArgs.Operation
+	args.ArtNodeKey = t.m.minerInfo.Key
+	args.IsClaim = true
+	args.ShapeHash = args.ContentHash()
+
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.SignedBytes(), args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+
+	t.m.blockChainThread.RLock()
+	checked, refused := verification.CheckClaim(*args, verification.ActiveClaims(t.m.blockChain), t.m.minerNetSettings.CanvasSettings)
+	t.m.blockChainThread.RUnlock()
+
+	switch {
+	case t.m.operationKnown(*args):
+		// Sent again by an art node that lost its connection
+		reply.BlockHash, reply.Error = t.m.submitOperation(checked)
+	case refused.Code != shared.NoError:
+		reply.Error = refused
+	case checked.InkCost > t.m.inkRemaining():
+		reply.Error = shared.NewReplyError(shared.InsufficientInk, "")
+	default:
+		t.m.log.Debug("claiming region", "trace", args.TraceID, "claim", args.ShapeHash, "layer", args.Layer, "blocks", args.ClaimBlocks)
+		reply.BlockHash, reply.Error = t.m.submitOperation(checked)
+	}
+
+	if reply.BlockHash == "" && reply.Error.Code == shared.NoError {
+		return StoppedError(t.m.myAddr.String())
+	}
+	if reply.Error.Code == shared.NoError {
+		reply.ShapeHash = args.ShapeHash
+	}
+	reply.InkRemaining = t.m.inkRemaining()
+	if reply.Error.Code == shared.InsufficientInk {
+		reply.Error.InkRemaining = reply.InkRemaining
+	}
+	return nil
+}
+
+// args: shapeHash, new owner (TransferTo), give or share, validateNum
+// reply: blockHash, InvalidShapeHash, ShapeOwner or InvalidOwner
+// Gives a shape this miner's key owns or co-owns to another key, or
+// shares it with one, once the change has validateNum blocks after it.
+func (t *ArtNodeMinerRPC) ChangeOwnersRPC(opArgs *shared.OperationArgs, reply *shared.ChangeOwnersReply) error {
+	if err := t.m.checkSession(opArgs.SessionID); err != nil {
+		return err
+	}
+	args := &opArgs.Operation
+	args.ArtNodeKey = t.m.minerInfo.Key
+	args.TransferTo = fixKeyCurve(args.TransferTo)
+
+	if args.R == nil || args.S == nil || !ecdsa.Verify(&t.m.minerPrivateKey.PublicKey, args.SignedBytes(), args.R, args.S) {
+		reply.Error = shared.NewReplyError(shared.InvalidKeyPair, "")
+		return nil
+	}
+	if !t.m.operationKnown(*args) {
+		t.m.blockChainThread.RLock()
+		shape, onCanvas := t.m.allShapes[args.ShapeHash]
+		t.m.blockChainThread.RUnlock()
+		if reply.Error = verification.CheckOwnerChange(*args, shape, onCanvas); reply.Error.Code != shared.NoError {
+			return nil
+		}
+		t.m.log.Debug("changing owners", "trace", args.TraceID, "shape", args.ShapeHash, "give", args.IsGive)
+	}
+
+	reply.BlockHash, reply.Error = t.m.submitOperation(*args)
+	if reply.BlockHash == "" && reply.Error.Code == shared.NoError {
+		return StoppedError(t.m.myAddr.String())
+	}
+	return nil
+}
+
+// args: blockHash
+// reply: shapeHashes []string, InvalidBlockHash if the block is unknown
+func (t *ArtNodeMinerRPC) GetShapesRPC(args *shared.Args, reply *shared.GetShapesReply) error {
+	if err := t.m.checkSession(args.SessionID); err != nil {
+		return err
+	}
+	t.m.log.Debug("ArtNodeMinerRPC.GetShapesRPC")
+	t.m.blockChainThread.RLock()
+	defer t.m.blockChainThread.RUnlock()
+
+	block, ok := t.m.existingBlockHashes[args.BlockHash]
+	if !ok {
+		reply.Error = shared.NewReplyError(shared.InvalidBlockHash, args.BlockHash)
+		return nil
+	}
+
+	// grab the shape hash list of this block
+	for _, op := range block.Operations {
+		if op.IsAdd() {
+			reply.Data = append(reply.Data, op.ShapeHash)
+		}
+	}
+	return nil
+}
+
+// args: none
+// reply: GenesisBlockHash from MinerNetSettings
+func (t *ArtNodeMinerRPC) GetGenesisBlockRPC(args *shared.Args, reply *shared.GetGenesisBlockReply) error {
+	if err := t.m.checkSession(args.SessionID); err != nil {
+		return err
+	}
+	t.m.log.Debug("ArtNodeMinerRPC.GetGenesisBlockRPC")
+	reply.BlockHash = t.m.minerNetSettings.GenesisBlockHash
+	return nil
+}
+
+// args: blockHash
+// reply: blockHashes []string, InvalidBlockHash if the block is unknown
+func (t *ArtNodeMinerRPC) GetChildrenRPC(args *shared.Args, reply *shared.GetChildrenReply) error {
+	if err := t.m.checkSession(args.SessionID); err != nil {
+		return err
+	}
+	t.m.log.Debug("ArtNodeMinerRPC.GetChildrenRPC")
+	t.m.blockChainThread.RLock()
+	defer t.m.blockChainThread.RUnlock()
+
+	if _, ok := t.m.existingBlockHashes[args.BlockHash]; !ok {
+		reply.Error = shared.NewReplyError(shared.InvalidBlockHash, args.BlockHash)
+		return nil
+	}
+	// loop through list of blocks
+	reply.Data = append([]string{}, t.m.childrenMap[args.BlockHash]...)
+	return nil
+}
+
+// args: none
+// reply: inkRemaining
+// Ends the art node's session; later calls in that session fail.
+func (t *ArtNodeMinerRPC) CloseCanvasRPC(args *shared.Args, reply *shared.InkReply) error {
+	if err := t.m.closeSession(args.SessionID); err != nil {
+		return err
+	}
+	reply.InkRemaining = t.m.inkRemaining()
+	return nil
+}
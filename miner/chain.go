@@ -0,0 +1,382 @@
+package miner
+
+import (
+	"../shared"
+	"../verification"
+
+	"crypto/ecdsa"
+)
+
+// Maximum number of missing ancestors fetched from peers for a single block.
+const maxFetchDepth = 1024
+
+// Key for an operation in the op pool. An add and a delete of the same
+// shape share a shape hash, so deletes get their own key. A shape can be
+// given, shared or modified any number of times, so those are told apart
+// by their signature.
+func opKey(op shared.Operation) string {
+	switch {
+	case op.IsDelete:
+		return op.ShapeHash + "/delete"
+	case op.IsTransfer:
+		return op.ShapeHash + "/transfer"
+	case op.IsClaim:
+		return op.ShapeHash + "/claim"
+	case op.IsGive:
+		return op.ShapeHash + "/give/" + op.R.String()
+	case op.IsShare:
+		return op.ShapeHash + "/share/" + op.R.String()
+	case op.IsModify:
+		return op.ShapeHash + "/modify/" + op.R.String()
+	}
+	return op.ShapeHash
+}
+
+// Returns the trace IDs of the operations in block, for logging.
+func traceIDs(block shared.Block) []string {
+	ids := make([]string, len(block.Operations))
+	for i, op := range block.Operations {
+		ids[i] = op.TraceID
+	}
+	return ids
+}
+
+// Replaces the curve parameters of keys received from other nodes with
+// those of the curve they name, so that a peer cannot make up parameters
+// for a known curve name.
+func fixKeyCurve(key ecdsa.PublicKey) ecdsa.PublicKey {
+	return wireKey(verification.NamedCurveKey(key))
+}
+
+func fixBlockKeys(block *shared.Block) {
+	block.MinerKey = fixKeyCurve(block.MinerKey)
+	for i := range block.Operations {
+		block.Operations[i].ArtNodeKey = fixKeyCurve(block.Operations[i].ArtNodeKey)
+		block.Operations[i].TransferTo = fixKeyCurve(block.Operations[i].TransferTo)
+		block.Operations[i].PaidBy = fixKeyCurve(block.Operations[i].PaidBy)
+	}
+}
+
+// Adds a block to the block tree. The block becomes the new tip if it makes
+// its branch the longest one; forks are kept in existingBlockHashes and
+// childrenMap. Blocks whose parent is unknown are held back until the
+// parent arrives.
+func (m *Miner) UpdateBlockChain(block shared.Block) {
+	m.blockChainThread.Lock()
+	defer m.blockChainThread.Unlock()
+
+	m.addBlockLocked(block)
+}
+
+func (m *Miner) addBlockLocked(block shared.Block) {
+	if _, ok := m.existingBlockHashes[block.Hash]; ok {
+		return
+	}
+
+	parentHeight, ok := m.heights[block.PreviousBlockHash]
+	if !ok {
+		m.orphans[block.PreviousBlockHash] = append(m.orphans[block.PreviousBlockHash], block)
+		return
+	}
+
+	// Updates the block hashes that exist
+	m.existingBlockHashes[block.Hash] = block
+	m.heights[block.Hash] = parentHeight + 1
+	delete(m.blocksNotInChain.Blocks, block.Hash)
+	delete(m.blocksNotInChain.InkUsedForBlock, block.Hash)
+
+	hash_val := block.PreviousBlockHash
+	childrenList := m.childrenMap[hash_val]
+	contains := false
+	for _, value := range childrenList {
+		if value == block.Hash {
+			contains = true
+		}
+	}
+	if !contains {
+		m.childrenMap[hash_val] = append(childrenList, block.Hash)
+		if len(childrenList) > 0 {
+			m.metrics.forks.Add(1)
+		}
+	}
+
+	// Drops the block's operations from the pool of operations still
+	// waiting for a block
+	m.opsNotInBlockThread.Lock()
+	for _, op := range block.Operations {
+		delete(m.opsNotInBlockThread.operations, opKey(op))
+		m.log.Debug("operation in block", "trace", op.TraceID, "block", block.Hash, "height", m.heights[block.Hash])
+	}
+	m.opsNotInBlockThread.Unlock()
+
+	if m.heights[block.Hash] > m.heights[m.prevHash] {
+		m.setTipLocked(block.Hash)
+	}
+
+	// Blocks that were waiting on this one
+	waiting := m.orphans[block.Hash]
+	delete(m.orphans, block.Hash)
+	for _, orphan := range waiting {
+		m.addBlockLocked(orphan)
+	}
+}
+
+// Moves the tip of the longest chain to hash, rebuilding the canvas if the
+// chain switched branches.
+func (m *Miner) setTipLocked(hash string) {
+	block := m.existingBlockHashes[hash]
+
+	if block.PreviousBlockHash == m.prevHash {
+		tempBlockChain := m.blockChain
+		m.blockChain = shared.Node{Block: block, Prev: &tempBlockChain}
+		applyOperations(m.allShapes, block.Operations)
+	} else {
+		m.log.Info("switching to fork", "block", hash)
+		m.metrics.reorgs.Add(1)
+		m.blockChain = m.chainToLocked(hash)
+		m.allShapes = m.shapesAtLocked(hash)
+	}
+
+	// Updates the previous hash here
+	m.prevHash = hash
+}
+
+// Applies ops to the shapes on the canvas, keyed by shape hash.
+func applyOperations(shapes map[string]shared.Operation, ops []shared.Operation) {
+	for _, op := range ops {
+		if op.IsTransfer || op.IsClaim {
+			continue
+		}
+		if op.IsOwnerChange() {
+			if shape, ok := shapes[op.ShapeHash]; ok {
+				shapes[op.ShapeHash] = verification.ChangeOwners(shape, op)
+			}
+		} else if op.IsModify {
+			if shape, ok := shapes[op.ShapeHash]; ok {
+				shapes[op.ShapeHash] = verification.ApplyModify(shape, op)
+			}
+		} else if op.IsDelete {
+			delete(shapes, op.ShapeHash)
+		} else {
+			shapes[op.ShapeHash] = op
+		}
+	}
+}
+
+// Returns the chain ending at hash.
+func (m *Miner) chainToLocked(hash string) shared.Node {
+	var blocks []shared.Block
+	for {
+		block, ok := m.existingBlockHashes[hash]
+		if !ok {
+			break
+		}
+		blocks = append(blocks, block)
+		if hash == m.minerNetSettings.GenesisBlockHash {
+			break
+		}
+		hash = block.PreviousBlockHash
+	}
+
+	var node *shared.Node
+	for i := len(blocks) - 1; i >= 0; i-- {
+		node = &shared.Node{Block: blocks[i], Prev: node}
+	}
+	if node == nil {
+		return shared.Node{}
+	}
+	return *node
+}
+
+// Returns the shapes on the canvas as of the block hash.
+func (m *Miner) shapesAtLocked(hash string) map[string]shared.Operation {
+	chain := m.chainToLocked(hash)
+
+	var blocks []shared.Block
+	for current := &chain; current != nil; current = current.Prev {
+		blocks = append(blocks, current.Block)
+	}
+
+	shapes := make(map[string]shared.Operation)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		applyOperations(shapes, blocks[i].Operations)
+	}
+	return shapes
+}
+
+// Starts the block tree over from the genesis block and adds blocks to it,
+// parents first, as if they had been received one by one. Blocks that fail
+// verification are dropped with the blocks built on them, so that a peer
+// or an edited file cannot hand this miner a chain it would not have
+// accepted block by block. Returns the number of blocks dropped.
+func (m *Miner) replayBlocksLocked(blocks map[string]shared.Block) (dropped int) {
+	m.resetToGenesisLocked()
+
+	children := make(map[string][]shared.Block)
+	for _, block := range blocks {
+		fixBlockKeys(&block)
+		children[block.PreviousBlockHash] = append(children[block.PreviousBlockHash], block)
+	}
+	queue := []string{m.prevHash}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		for _, block := range children[hash] {
+			if _, known := m.existingBlockHashes[block.Hash]; known || !m.verifyBlockLocked(block) {
+				continue
+			}
+			m.addBlockLocked(block)
+			queue = append(queue, block.Hash)
+		}
+	}
+
+	for hash := range blocks {
+		if _, ok := m.existingBlockHashes[hash]; !ok {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// Ink available to key on the longest chain: mining rewards, minus shapes
+// drawn, plus shapes deleted, give or take what modifies changed.
+func (m *Miner) inkBalanceLocked(key ecdsa.PublicKey) uint32 {
+	var ink int64
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		block := current.Block
+
+		if verification.EqualPublicKey(block.MinerKey, key) {
+			if block.IsNoopBlock {
+				ink += int64(m.minerNetSettings.InkPerNoOpBlock)
+			} else {
+				ink += int64(m.minerNetSettings.InkPerOpBlock)
+			}
+		}
+
+		for _, op := range block.Operations {
+			if verification.EqualPublicKey(op.ArtNodeKey, key) {
+				ink -= op.InkSpent()
+			}
+			if op.IsTransfer && verification.EqualPublicKey(op.TransferTo, key) {
+				ink += int64(op.InkCost)
+			}
+			if payer, refund := op.InkRefunded(); verification.EqualPublicKey(payer, key) {
+				ink += refund
+			}
+		}
+	}
+
+	if ink < 0 {
+		return 0
+	}
+	return uint32(ink)
+}
+
+// Returns the ID of a claim on the longest chain that keeps op's key from
+// drawing op's shape or claiming op's region, or false if there is none.
+func (m *Miner) claimInTheWayLocked(op shared.Operation) (claimID string, inTheWay bool) {
+	claim, inTheWay := verification.ClaimInTheWay(op, verification.ActiveClaims(m.blockChain))
+	return claim.ShapeHash, inTheWay
+}
+
+// Number of blocks on the longest chain after the block that contains op.
+// Returns -1 if op is not on the longest chain.
+func (m *Miner) confirmationsLocked(op shared.Operation) (blockHash string, confirmations int) {
+	depth := 0
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		for _, v := range current.Block.Operations {
+			if opKey(v) == opKey(op) {
+				return current.Block.Hash, depth
+			}
+		}
+		depth++
+	}
+	return "", -1
+}
+
+// Verifies a block received from another miner against the chain it
+// extends and adds it to the block tree. Missing ancestors are fetched from
+// peers first.
+func (m *Miner) receiveBlock(block shared.Block) bool {
+	m.blockChainThread.RLock()
+	_, known := m.existingBlockHashes[block.Hash]
+	m.blockChainThread.RUnlock()
+	if known {
+		return true
+	}
+
+	if !m.fetchMissingAncestors(block) {
+		return false
+	}
+
+	m.blockChainThread.Lock()
+	defer m.blockChainThread.Unlock()
+	if !m.verifyBlockLocked(block) {
+		return false
+	}
+	m.addBlockLocked(block)
+	return true
+}
+
+func (m *Miner) verifyBlockLocked(block shared.Block) bool {
+	failed := verification.CheckBlock(block, m.chainToLocked(block.PreviousBlockHash), m.minerNetSettings, m.existingBlockHashes, m.shapesAtLocked(block.PreviousBlockHash))
+	if failed != "" {
+		m.metrics.reject(failed)
+		return false
+	}
+	if !verification.EqualPublicKey(block.MinerKey, m.minerInfo.Key) {
+		m.metrics.blocksReceived.Add(1)
+	}
+	return true
+}
+
+// Asks peers for the ancestors of block that this miner has not seen, e.g.
+// blocks mined on the other side of a partition, and adds them oldest first.
+func (m *Miner) fetchMissingAncestors(block shared.Block) bool {
+	var missing []shared.Block
+	hash := block.PreviousBlockHash
+	for i := 0; i < maxFetchDepth; i++ {
+		m.blockChainThread.RLock()
+		_, known := m.existingBlockHashes[hash]
+		m.blockChainThread.RUnlock()
+		if known {
+			break
+		}
+
+		parent, ok := m.fetchBlock(hash)
+		if !ok {
+			m.log.Error("cannot find parent block", "block", hash)
+			return false
+		}
+		missing = append(missing, parent)
+		hash = parent.PreviousBlockHash
+	}
+
+	m.blockChainThread.Lock()
+	defer m.blockChainThread.Unlock()
+	for i := len(missing) - 1; i >= 0; i-- {
+		if !m.verifyBlockLocked(missing[i]) {
+			return false
+		}
+		m.addBlockLocked(missing[i])
+	}
+	return true
+}
+
+func (m *Miner) fetchBlock(hash string) (shared.Block, bool) {
+	for _, k := range m.getPeerList() {
+		client, err := m.dial(k.String())
+		if err != nil {
+			continue
+		}
+
+		var reply shared.Block
+		err = client.Call("MinerRPC.GetBlock", hash, &reply)
+		client.Close()
+		if err == nil && reply.Hash == hash {
+			fixBlockKeys(&reply)
+			return reply, true
+		}
+	}
+	return shared.Block{}, false
+}
@@ -0,0 +1,487 @@
+package miner
+
+import (
+	"../logging"
+	"../shared"
+	"../verification"
+
+	"crypto/ecdsa"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Address the block explorer listens on, or nil without
+// Config.ExplorerAddr.
+func (m *Miner) ExplorerAddr() net.Addr {
+	if m.explorerListener == nil {
+		return nil
+	}
+	return m.explorerListener.Addr()
+}
+
+// Serves the block explorer until the miner is stopped:
+//
+//	/                the block tree by height, ink balances and the canvas
+//	/block/{hash}    a block and its operations
+//	/shape/{hash}    every add and delete of a shape
+//	/canvas.svg      the canvas at the tip of the longest chain
+func (m *Miner) serveExplorer() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.explorerIndex)
+	mux.HandleFunc("/block/", m.explorerBlock)
+	mux.HandleFunc("/shape/", m.explorerShape)
+	mux.HandleFunc("/canvas.svg", m.explorerCanvas)
+
+	ln, err := m.serveHTTP(m.config.ExplorerAddr, mux)
+	if err != nil {
+		return err
+	}
+	m.explorerListener = ln
+	return nil
+}
+
+// A block as the explorer shows it.
+type blockView struct {
+	Hash       string
+	Parent     string
+	Children   []string
+	Height     int
+	Noop       bool
+	Nonce      uint32
+	Timestamp  int64
+	Miner      string
+	MinerKey   string
+	OnChain    bool
+	Operations []opView
+}
+
+// An operation as the explorer shows it.
+type opView struct {
+	ShapeHash  string
+	Delete     bool
+	Transfer   bool
+	Give       bool
+	Share      bool
+	Modify     bool
+	Version    uint32
+	Claim      bool
+	Layer      string
+	Region     shared.Region // Region a claim holds
+	Blocks     uint32        // Blocks a claim holds it for
+	Owner      string
+	OwnerKey   string
+	To         string // Key prefix a transfer, give or share is to
+	ToKey      string
+	CoOwners   []string
+	DAttribute string
+	Fill       string
+	Stroke     string
+	InkCost    uint32
+	TraceID    string
+}
+
+// An add, delete, give, share or modify of a shape, in the block that
+// holds it.
+type shapeEvent struct {
+	opView
+	Block   string
+	Height  int
+	OnChain bool
+}
+
+// Ink the longest chain credits a key with.
+type inkBalance struct {
+	Key    string
+	Prefix string
+	Ink    int64
+}
+
+// Returns the hex public key, or "" for the genesis block's empty key.
+func explorerKey(key ecdsa.PublicKey) string {
+	if key.X == nil {
+		return ""
+	}
+	return verification.EncodePublicKey(key)
+}
+
+func newOpView(op shared.Operation) opView {
+	view := opView{
+		ShapeHash:  op.ShapeHash,
+		Delete:     op.IsDelete,
+		Transfer:   op.IsTransfer,
+		Give:       op.IsGive,
+		Share:      op.IsShare,
+		Modify:     op.IsModify,
+		Version:    op.Version,
+		Claim:      op.IsClaim,
+		Layer:      op.Layer,
+		Region:     op.Region,
+		Blocks:     op.ClaimBlocks,
+		Owner:      logging.KeyPrefix(op.ArtNodeKey),
+		OwnerKey:   explorerKey(op.ArtNodeKey),
+		To:         logging.KeyPrefix(op.TransferTo),
+		ToKey:      explorerKey(op.TransferTo),
+		DAttribute: op.DAttribute,
+		Fill:       op.Fill,
+		Stroke:     op.Stroke,
+		InkCost:    op.InkCost,
+		TraceID:    op.TraceID,
+	}
+	for _, key := range op.CoOwners {
+		view.CoOwners = append(view.CoOwners, explorerKey(key))
+	}
+	return view
+}
+
+func (m *Miner) blockViewLocked(block shared.Block, onChain map[string]bool) blockView {
+	view := blockView{
+		Hash:      block.Hash,
+		Parent:    block.PreviousBlockHash,
+		Children:  m.childrenMap[block.Hash],
+		Height:    m.heights[block.Hash],
+		Noop:      block.IsNoopBlock,
+		Nonce:     block.Nonce,
+		Timestamp: block.Timestamp,
+		Miner:     logging.KeyPrefix(block.MinerKey),
+		MinerKey:  explorerKey(block.MinerKey),
+		OnChain:   onChain[block.Hash],
+	}
+	for _, op := range block.Operations {
+		view.Operations = append(view.Operations, newOpView(op))
+	}
+	return view
+}
+
+// Hashes of the blocks on the longest chain.
+func (m *Miner) onChainLocked() map[string]bool {
+	onChain := make(map[string]bool)
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		onChain[current.Block.Hash] = true
+	}
+	return onChain
+}
+
+// Ink the longest chain credits every key that mined a block, drew a
+// shape or took part in a transfer with, computed as inkBalanceLocked does for a single key.
+func (m *Miner) inkBalancesLocked() []inkBalance {
+	balances := make(map[string]*inkBalance)
+	add := func(key string, prefix string, ink int64) {
+		balance, ok := balances[key]
+		if !ok {
+			balance = &inkBalance{Key: key, Prefix: prefix}
+			balances[key] = balance
+		}
+		balance.Ink += ink
+	}
+
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		block := current.Block
+		if block.MinerKey.X != nil {
+			reward := int64(m.minerNetSettings.InkPerOpBlock)
+			if block.IsNoopBlock {
+				reward = int64(m.minerNetSettings.InkPerNoOpBlock)
+			}
+			add(explorerKey(block.MinerKey), logging.KeyPrefix(block.MinerKey), reward)
+		}
+		for _, op := range block.Operations {
+			add(explorerKey(op.ArtNodeKey), logging.KeyPrefix(op.ArtNodeKey), -op.InkSpent())
+			if op.IsTransfer {
+				add(explorerKey(op.TransferTo), logging.KeyPrefix(op.TransferTo), int64(op.InkCost))
+			}
+			if payer, refund := op.InkRefunded(); refund > 0 {
+				add(explorerKey(payer), logging.KeyPrefix(payer), refund)
+			}
+		}
+	}
+
+	result := make([]inkBalance, 0, len(balances))
+	for _, balance := range balances {
+		if balance.Ink < 0 {
+			balance.Ink = 0
+		}
+		result = append(result, *balance)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+func (m *Miner) explorerIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.blockChainThread.RLock()
+	onChain := m.onChainLocked()
+	var blocks []blockView
+	for _, block := range m.existingBlockHashes {
+		blocks = append(blocks, m.blockViewLocked(block, onChain))
+	}
+	data := struct {
+		Tip      string
+		Height   int
+		Settings shared.CanvasSettings
+		Heights  [][]blockView
+		Balances []inkBalance
+		Forks    int
+	}{
+		Tip:      m.prevHash,
+		Height:   m.heights[m.prevHash],
+		Settings: m.minerNetSettings.CanvasSettings,
+		Balances: m.inkBalancesLocked(),
+	}
+	m.blockChainThread.RUnlock()
+
+	// Newest blocks first, the longest chain first at each height
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].Height != blocks[j].Height {
+			return blocks[i].Height > blocks[j].Height
+		}
+		if blocks[i].OnChain != blocks[j].OnChain {
+			return blocks[i].OnChain
+		}
+		return blocks[i].Hash < blocks[j].Hash
+	})
+	for i, block := range blocks {
+		if i == 0 || block.Height != blocks[i-1].Height {
+			data.Heights = append(data.Heights, nil)
+		}
+		data.Heights[len(data.Heights)-1] = append(data.Heights[len(data.Heights)-1], block)
+		if !block.OnChain {
+			data.Forks++
+		}
+	}
+	m.renderExplorer(w, "index", data)
+}
+
+func (m *Miner) explorerBlock(w http.ResponseWriter, r *http.Request) {
+	m.blockChainThread.RLock()
+	block, ok := m.existingBlockHashes[strings.TrimPrefix(r.URL.Path, "/block/")]
+	var data blockView
+	if ok {
+		data = m.blockViewLocked(block, m.onChainLocked())
+	}
+	settings := m.minerNetSettings.CanvasSettings
+	m.blockChainThread.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	m.renderExplorer(w, "block", struct {
+		blockView
+		Settings shared.CanvasSettings
+	}{data, settings})
+}
+
+func (m *Miner) explorerShape(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/shape/")
+
+	m.blockChainThread.RLock()
+	onChain := m.onChainLocked()
+	var events []shapeEvent
+	for _, block := range m.existingBlockHashes {
+		for _, op := range block.Operations {
+			if op.ShapeHash == hash && !op.IsTransfer && !op.IsClaim {
+				events = append(events, shapeEvent{newOpView(op), block.Hash, m.heights[block.Hash], onChain[block.Hash]})
+			}
+		}
+	}
+	current, onCanvas := m.allShapes[hash]
+	settings := m.minerNetSettings.CanvasSettings
+	m.blockChainThread.RUnlock()
+
+	if len(events) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Height != events[j].Height {
+			return events[i].Height < events[j].Height
+		}
+		return events[i].Block < events[j].Block
+	})
+
+	// The add operation tells what the shape looked like, and the canvas
+	// what it looks like and who owns it now
+	shape := events[0].opView
+	for _, event := range events {
+		if !event.Delete && !event.Give && !event.Share && !event.Modify {
+			shape = event.opView
+			break
+		}
+	}
+	if onCanvas {
+		shape = newOpView(current)
+	}
+	m.renderExplorer(w, "shape", struct {
+		Shape    opView
+		OnCanvas bool
+		Events   []shapeEvent
+		Settings shared.CanvasSettings
+	}{shape, onCanvas, events, settings})
+}
+
+// A layer of the canvas and the shapes on it.
+type layerView struct {
+	Name   string
+	Shapes []opView
+}
+
+// Draws the canvas at the tip one layer over the other, from the base
+// layer up.
+func (m *Miner) explorerCanvas(w http.ResponseWriter, r *http.Request) {
+	settings := m.minerNetSettings.CanvasSettings
+	layers := make([]layerView, len(settings.Layers)+1)
+	for i, name := range settings.Layers {
+		layers[i+1].Name = name
+	}
+
+	m.blockChainThread.RLock()
+	for _, op := range m.allShapes {
+		i, _ := settings.LayerIndex(op.Layer)
+		layers[i].Shapes = append(layers[i].Shapes, newOpView(op))
+	}
+	m.blockChainThread.RUnlock()
+
+	for _, layer := range layers {
+		shapes := layer.Shapes
+		sort.Slice(shapes, func(i, j int) bool { return shapes[i].ShapeHash < shapes[j].ShapeHash })
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if err := explorerTemplates.ExecuteTemplate(w, "canvas", struct {
+		Settings shared.CanvasSettings
+		Layers   []layerView
+	}{settings, layers}); err != nil {
+		m.log.Error("cannot render explorer canvas", "err", err)
+	}
+}
+
+func (m *Miner) renderExplorer(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := explorerTemplates.ExecuteTemplate(w, name, data); err != nil {
+		m.log.Error("cannot render explorer page", "page", name, "err", err)
+	}
+}
+
+// Shapes are drawn from their d attribute, fill and stroke, never from the
+// AppShapeOp markup, so that the template escapes everything a peer sent.
+var explorerTemplates = template.Must(template.New("explorer").Funcs(template.FuncMap{
+	"short": func(hash string) string {
+		if len(hash) > 12 {
+			return hash[:12]
+		}
+		return hash
+	},
+	"preview": func(settings shared.CanvasSettings, op opView) interface{} {
+		return struct {
+			Settings shared.CanvasSettings
+			Op       opView
+		}{settings, op}
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>BlockArt explorer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+.fork { background: #fdd; }
+.noop { color: #888; }
+svg.canvas, svg.preview { border: 1px solid #ccc; background: #fff; }
+code { font-size: 0.9em; }
+</style></head><body>
+<p><a href="/">Block tree</a> · <a href="/canvas.svg">Canvas</a></p>
+{{end}}
+
+{{define "footer"}}</body></html>
+{{end}}
+
+{{define "shape-svg"}}<path d="{{.DAttribute}}" fill="{{.Fill}}" stroke="{{.Stroke}}"/>{{end}}
+
+{{define "operation"}}{{if .Delete}}delete{{else if .Give}}give to <code title="{{.ToKey}}">{{.To}}</code>{{else if .Share}}share with <code title="{{.ToKey}}">{{.To}}</code>{{else if .Modify}}modify to version {{.Version}}{{else}}add{{if .Layer}} on layer {{.Layer}}{{end}}{{end}}{{end}}
+
+{{define "claim"}}claim {{.Region.MinX}},{{.Region.MinY}} to {{.Region.MaxX}},{{.Region.MaxY}}{{if .Layer}} on layer {{.Layer}}{{end}} for {{.Blocks}} blocks{{end}}
+
+{{define "preview"}}<svg class="preview" width="120" height="120" viewBox="0 0 {{.Settings.CanvasXMax}} {{.Settings.CanvasYMax}}">{{template "shape-svg" .Op}}</svg>{{end}}
+
+{{define "index"}}{{template "header"}}
+<h1>Block tree</h1>
+<p>Tip <a href="/block/{{.Tip}}"><code>{{short .Tip}}</code></a> at height {{.Height}}.
+{{.Forks}} blocks are off the longest chain and <span class="fork">highlighted</span>.</p>
+<h2>Canvas</h2>
+<img src="/canvas.svg" alt="Canvas at the tip" class="canvas">
+<h2>Ink</h2>
+<table>
+<tr><th>Key</th><th>Ink</th></tr>
+{{range .Balances}}<tr><td><code title="{{.Key}}">{{.Prefix}}</code></td><td>{{.Ink}}</td></tr>
+{{end}}</table>
+<h2>Blocks</h2>
+<table>
+<tr><th>Height</th><th>Blocks</th></tr>
+{{range .Heights}}<tr><td>{{(index . 0).Height}}</td><td>
+{{range .}}<div class="{{if not .OnChain}}fork{{end}} {{if .Noop}}noop{{end}}">
+<a href="/block/{{.Hash}}"><code>{{short .Hash}}</code></a>
+{{if .Noop}}no-op{{else}}op ({{len .Operations}}){{end}}
+by <code title="{{.MinerKey}}">{{.Miner}}</code>
+{{if not .OnChain}}fork of <a href="/block/{{.Parent}}"><code>{{short .Parent}}</code></a>{{end}}
+</div>{{end}}
+</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "block"}}{{template "header"}}
+<h1>Block <code>{{.Hash}}</code></h1>
+<table>
+<tr><th>Height</th><td>{{.Height}}{{if not .OnChain}} <span class="fork">(fork, not on the longest chain)</span>{{end}}</td></tr>
+<tr><th>Type</th><td>{{if .Noop}}no-op{{else}}op{{end}}</td></tr>
+<tr><th>Miner</th><td><code>{{.MinerKey}}</code></td></tr>
+<tr><th>Nonce</th><td>{{.Nonce}}</td></tr>
+<tr><th>Timestamp</th><td>{{.Timestamp}}</td></tr>
+<tr><th>Parent</th><td>{{if .Parent}}<a href="/block/{{.Parent}}"><code>{{.Parent}}</code></a>{{end}}</td></tr>
+<tr><th>Children</th><td>{{range .Children}}<a href="/block/{{.}}"><code>{{.}}</code></a><br>{{end}}</td></tr>
+</table>
+{{if .Operations}}<h2>Operations</h2>
+<table>
+<tr><th>Shape</th><th>Operation</th><th>Owner</th><th>Ink</th><th>Trace</th><th>Preview</th></tr>
+{{$settings := .Settings}}{{range .Operations}}<tr>
+{{if .Transfer}}<td><code>{{short .ShapeHash}}</code></td>
+<td>transfer to <code title="{{.ToKey}}">{{.To}}</code></td>{{else if .Claim}}<td><code>{{short .ShapeHash}}</code></td>
+<td>{{template "claim" .}}</td>{{else}}<td><a href="/shape/{{.ShapeHash}}"><code>{{short .ShapeHash}}</code></a></td>
+<td>{{template "operation" .}}</td>{{end}}
+<td><code title="{{.OwnerKey}}">{{.Owner}}</code></td>
+<td>{{.InkCost}}</td>
+<td><code>{{.TraceID}}</code></td>
+<td>{{if not (or .Transfer .Give .Share .Claim)}}{{template "preview" (preview $settings .)}}{{end}}</td>
+</tr>
+{{end}}</table>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "shape"}}{{template "header"}}
+<h1>Shape <code>{{.Shape.ShapeHash}}</code></h1>
+<p>Version {{.Shape.Version}}{{if .Shape.Layer}} on layer {{.Shape.Layer}}{{end}}, owned by <code>{{.Shape.OwnerKey}}</code>{{range .Shape.CoOwners}} and <code>{{.}}</code>{{end}}.
+{{if .OnCanvas}}On the canvas at the tip.{{else}}Not on the canvas at the tip.{{end}}</p>
+{{template "preview" (preview .Settings .Shape)}}
+<h2>History</h2>
+<table>
+<tr><th>Height</th><th>Block</th><th>Operation</th><th>Ink</th><th>Trace</th></tr>
+{{range .Events}}<tr class="{{if not .OnChain}}fork{{end}}">
+<td>{{.Height}}</td>
+<td><a href="/block/{{.Block}}"><code>{{short .Block}}</code></a></td>
+<td>{{template "operation" .}}</td>
+<td>{{.InkCost}}</td>
+<td><code>{{.TraceID}}</code></td>
+</tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "canvas"}}<svg xmlns="http://www.w3.org/2000/svg" width="{{.Settings.CanvasXMax}}" height="{{.Settings.CanvasYMax}}">
+{{range .Layers}}<g class="layer" data-layer="{{.Name}}">
+{{range .Shapes}}{{template "shape-svg" .}}
+{{end}}</g>
+{{end}}</svg>
+{{end}}
+`))
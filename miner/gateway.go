@@ -0,0 +1,642 @@
+package miner
+
+import (
+	"../blockartlib"
+	"../logging"
+	"../shared"
+	"../verification"
+
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+
+The gateway serves the Canvas API as JSON over HTTP for art nodes that
+cannot use net/rpc and gob. Every endpoint takes a POST with a JSON object
+and answers 200 with a JSON object, or with an error:
+
+	{"error": {"code": "shape-overlap", "message": "BlockArt: Shape overlaps ..."}}
+
+Keys are the miner's key pair: an art node proves it holds the private key
+by signing a challenge, and signs every operation it submits. Signatures
+are ECDSA over the given bytes used directly as the digest (as Go's
+ecdsa.Sign does), ASN.1 DER encoded, in hex. Modifies, transfers, gives
+and shares carry a nonce that is signed with them: a number the key has
+not used for one of them before, best picked at random.
+
+	POST /v1/challenge      {}
+	  -> {"challenge": hex}  (32 random bytes, valid for one open, 1 minute)
+	POST /v1/open           {"challenge": hex, "signature": hex}
+	  -> {"session": string, "canvas-settings": {"canvas-x-max": n, "canvas-y-max": n,
+	                                             "layers": [names, bottom up]}}
+	POST /v1/add-shape      {"session", "validate-num": n, "shape-type": "path",
+	                         "d": svg path, "fill", "stroke", "layer": "" for the base layer,
+	                         "signature": signature of shared.Operation.SignedBytes}
+	  -> {"shape-hash": shared.Operation.ContentHash, "block-hash", "ink-remaining": n}
+	POST /v1/delete-shape   {"session", "validate-num": n, "shape-hash",
+	                         "signature": signature of shared.Operation.SignedBytes}
+	  -> {"ink-remaining": n}
+	POST /v1/modify-shape   {"session", "validate-num": n, "shape-hash", "shape-type": "path",
+	                         "d", "fill", "stroke", "nonce": n,
+	                         "signature": signature of shared.Operation.SignedBytes}
+	  -> {"shape-hash", "block-hash", "ink-remaining": n}
+	POST /v1/transfer-ink   {"session", "validate-num": n,
+	                         "to": hex PKIX public key, "amount": n, "nonce": n,
+	                         "signature": signature of shared.Operation.SignedBytes}
+	  -> {"ink-remaining": n}
+	POST /v1/claim-region   {"session", "validate-num": n, "layer",
+	                         "region": {"min-x": n, "min-y": n, "max-x": n, "max-y": n},
+	                         "blocks": n, "signature": signature of shared.Operation.SignedBytes}
+	  -> {"claim-id": shared.Operation.ContentHash, "block-hash", "ink-remaining": n}
+	POST /v1/give-shape     {"session", "validate-num": n, "shape-hash", "to": hex PKIX public key, "nonce": n,
+	                         "signature": signature of shared.Operation.SignedBytes}
+	  -> {"block-hash"}
+	POST /v1/share-shape    same as give-shape, "to" is the new co-owner
+	  -> {"block-hash"}
+	POST /v1/ink            {"session"} -> {"ink-remaining": n}
+	POST /v1/svg-string     {"session", "shape-hash"} -> {"svg-string"}
+	POST /v1/shapes         {"session", "block-hash"} -> {"shape-hashes": [...]}
+	POST /v1/children       {"session", "block-hash"} -> {"block-hashes": [...]}
+	POST /v1/genesis-block  {"session"} -> {"block-hash"}
+	POST /v1/close          {"session"} -> {"ink-remaining": n}
+
+Error codes, with the blockartlib error they stand for and the HTTP status.
+A miner's refusals use the names of their shared.ErrorCode:
+
+	bad-request                 malformed request                      400
+	unknown-challenge           challenge expired, used or never made  401
+	invalid-key-pair            InvalidArtNodeMinerKeyPairError        401
+	invalid-session             session closed or never opened         401
+	invalid-signature           signature does not match the shape     400
+	invalid-shape-svg-string    InvalidShapeSvgStringError             400
+	invalid-transfer            InvalidTransferError                   400
+	invalid-owner               InvalidOwnerError                      400
+	invalid-layer               InvalidLayerError                      400
+	invalid-region              InvalidRegionError                     400
+	shape-svg-string-too-long   ShapeSvgStringTooLongError             400
+	out-of-bounds               OutOfBoundsError                       400
+	shape-owner                 ShapeOwnerError                        403
+	invalid-shape-hash          InvalidShapeHashError                  404
+	invalid-block-hash          InvalidBlockHashError                  404
+	insufficient-ink            InsufficientInkError                   409
+	shape-overlap               ShapeOverlapError                      409
+	region-claimed              RegionClaimedError                     409
+	disconnected                DisconnectedError, the miner stopped   503
+	internal                    anything else                          500
+
+*/
+
+// How long a challenge can be used to open a canvas.
+const challengeTimeout = time.Minute
+
+// An error answered by the gateway, with its code and HTTP status.
+type gatewayError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e gatewayError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return gatewayError{http.StatusBadRequest, "bad-request", fmt.Sprintf(format, a...)}
+}
+
+var (
+	unknownChallengeError = gatewayError{http.StatusUnauthorized, "unknown-challenge", "Unknown or expired challenge"}
+	invalidSignatureError = gatewayError{http.StatusBadRequest, "invalid-signature", "Signature does not match"}
+)
+
+// Returns the error code and HTTP status for err.
+func gatewayErrorCode(err error) (status int, code string) {
+	switch e := err.(type) {
+	case gatewayError:
+		return e.status, e.code
+	case blockartlib.InvalidArtNodeMinerKeyPairError, *blockartlib.InvalidArtNodeMinerKeyPairError:
+		return http.StatusUnauthorized, "invalid-key-pair"
+	case UnknownSessionError:
+		return http.StatusUnauthorized, "invalid-session"
+	case blockartlib.InvalidShapeSvgStringError:
+		return http.StatusBadRequest, "invalid-shape-svg-string"
+	case blockartlib.InvalidTransferError:
+		return http.StatusBadRequest, "invalid-transfer"
+	case blockartlib.InvalidOwnerError:
+		return http.StatusBadRequest, "invalid-owner"
+	case blockartlib.InvalidLayerError:
+		return http.StatusBadRequest, "invalid-layer"
+	case blockartlib.InvalidRegionError:
+		return http.StatusBadRequest, "invalid-region"
+	case blockartlib.ShapeSvgStringTooLongError:
+		return http.StatusBadRequest, "shape-svg-string-too-long"
+	case blockartlib.OutOfBoundsError, *blockartlib.OutOfBoundsError:
+		return http.StatusBadRequest, "out-of-bounds"
+	case blockartlib.ShapeOwnerError:
+		return http.StatusForbidden, "shape-owner"
+	case blockartlib.InvalidShapeHashError:
+		return http.StatusNotFound, "invalid-shape-hash"
+	case blockartlib.InvalidBlockHashError:
+		return http.StatusNotFound, "invalid-block-hash"
+	case blockartlib.InsufficientInkError:
+		return http.StatusConflict, "insufficient-ink"
+	case blockartlib.ShapeOverlapError:
+		return http.StatusConflict, "shape-overlap"
+	case blockartlib.RegionClaimedError:
+		return http.StatusConflict, "region-claimed"
+	case blockartlib.DisconnectedError, StoppedError:
+		return http.StatusServiceUnavailable, "disconnected"
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+// The fields of every gateway request. Each endpoint reads the ones it
+// needs.
+type gatewayRequest struct {
+	Session     string        `json:"session"`
+	Challenge   string        `json:"challenge"`
+	Signature   string        `json:"signature"`
+	ValidateNum uint8         `json:"validate-num"`
+	ShapeType   string        `json:"shape-type"`
+	D           string        `json:"d"`
+	Fill        string        `json:"fill"`
+	Stroke      string        `json:"stroke"`
+	ShapeHash   string        `json:"shape-hash"`
+	BlockHash   string        `json:"block-hash"`
+	To          string        `json:"to"`
+	Amount      uint32        `json:"amount"`
+	Layer       string        `json:"layer"`
+	Region      shared.Region `json:"region"`
+	Blocks      uint32        `json:"blocks"`
+	Nonce       uint64        `json:"nonce"`
+}
+
+type challengeReply struct {
+	Challenge string `json:"challenge"`
+}
+
+type openReply struct {
+	Session        string                `json:"session"`
+	CanvasSettings shared.CanvasSettings `json:"canvas-settings"`
+}
+
+type addShapeReply struct {
+	ShapeHash    string `json:"shape-hash"`
+	BlockHash    string `json:"block-hash"`
+	InkRemaining uint32 `json:"ink-remaining"`
+}
+
+type claimRegionReply struct {
+	ClaimID      string `json:"claim-id"`
+	BlockHash    string `json:"block-hash"`
+	InkRemaining uint32 `json:"ink-remaining"`
+}
+
+type inkReply struct {
+	InkRemaining uint32 `json:"ink-remaining"`
+}
+
+type svgStringReply struct {
+	SvgString string `json:"svg-string"`
+}
+
+type shapesReply struct {
+	ShapeHashes []string `json:"shape-hashes"`
+}
+
+type childrenReply struct {
+	BlockHashes []string `json:"block-hashes"`
+}
+
+type blockHashReply struct {
+	BlockHash string `json:"block-hash"`
+}
+
+// Address the gateway listens on, or nil without Config.GatewayAddr.
+func (m *Miner) GatewayAddr() net.Addr {
+	if m.gatewayListener == nil {
+		return nil
+	}
+	return m.gatewayListener.Addr()
+}
+
+// Serves the gateway until the miner is stopped.
+func (m *Miner) serveGateway() error {
+	mux := http.NewServeMux()
+	for path, handle := range map[string]func(*gatewayRequest) (interface{}, error){
+		"/v1/challenge":     m.gatewayChallenge,
+		"/v1/open":          m.gatewayOpen,
+		"/v1/add-shape":     m.gatewayAddShape,
+		"/v1/delete-shape":  m.gatewayDeleteShape,
+		"/v1/modify-shape":  m.gatewayModifyShape,
+		"/v1/transfer-ink":  m.gatewayTransferInk,
+		"/v1/claim-region":  m.gatewayClaimRegion,
+		"/v1/give-shape":    m.gatewayChangeOwners(false),
+		"/v1/share-shape":   m.gatewayChangeOwners(true),
+		"/v1/ink":           m.gatewayInk,
+		"/v1/svg-string":    m.gatewaySvgString,
+		"/v1/shapes":        m.gatewayShapes,
+		"/v1/children":      m.gatewayChildren,
+		"/v1/genesis-block": m.gatewayGenesisBlock,
+		"/v1/close":         m.gatewayClose,
+	} {
+		mux.HandleFunc(path, m.gatewayEndpoint(handle))
+	}
+
+	ln, err := m.serveHTTP(m.config.GatewayAddr, mux)
+	if err != nil {
+		return err
+	}
+	m.gatewayListener = ln
+	return nil
+}
+
+// Decodes the request, calls handle and encodes its reply or error.
+func (m *Miner) gatewayEndpoint(handle func(*gatewayRequest) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reply interface{}
+		var err error
+		if r.Method != http.MethodPost {
+			err = badRequest("%s needs a POST", r.URL.Path)
+		} else {
+			var req gatewayRequest
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			if decodeErr := decoder.Decode(&req); decodeErr != nil {
+				err = badRequest("Cannot decode request: %s", decodeErr)
+			} else {
+				reply, err = handle(&req)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			status, code := gatewayErrorCode(err)
+			if status == http.StatusInternalServerError {
+				m.log.Error("gateway request failed", "path", r.URL.Path, "err", err)
+			}
+			w.WriteHeader(status)
+			reply = map[string]interface{}{"error": map[string]string{"code": code, "message": err.Error()}}
+		}
+		json.NewEncoder(w).Encode(reply)
+	}
+}
+
+// Decodes a hex ASN.1 DER ECDSA signature.
+func decodeSignature(signature string) (r, s *big.Int, err error) {
+	der, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, nil, badRequest("Signature is not hex: %s", err)
+	}
+	var sig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) != 0 {
+		return nil, nil, badRequest("Signature is not an ASN.1 ECDSA signature")
+	}
+	return sig.R, sig.S, nil
+}
+
+// Decodes a hex PKIX ECDSA public key.
+func decodePublicKey(key string) (ecdsa.PublicKey, error) {
+	der, err := hex.DecodeString(key)
+	if err != nil {
+		return ecdsa.PublicKey{}, badRequest("Public key is not hex: %s", err)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return ecdsa.PublicKey{}, badRequest("Public key is not a PKIX public key: %s", err)
+	}
+	pub, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return ecdsa.PublicKey{}, badRequest("Public key is not an ECDSA key")
+	}
+	return *pub, nil
+}
+
+// Checks that signature signs message with the miner's private key.
+func (m *Miner) checkSignature(message []byte, signature string) (r, s *big.Int, err error) {
+	r, s, err = decodeSignature(signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ecdsa.Verify(&m.minerPrivateKey.PublicKey, message, r, s) {
+		return nil, nil, invalidSignatureError
+	}
+	return r, s, nil
+}
+
+func (m *Miner) gatewayChallenge(req *gatewayRequest) (interface{}, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	now := time.Now()
+	for c, expires := range m.challenges {
+		if now.After(expires) {
+			delete(m.challenges, c)
+		}
+	}
+	m.challenges[hex.EncodeToString(challenge)] = now.Add(challengeTimeout)
+	return challengeReply{hex.EncodeToString(challenge)}, nil
+}
+
+func (m *Miner) gatewayOpen(req *gatewayRequest) (interface{}, error) {
+	m.sessionsLock.Lock()
+	expires, ok := m.challenges[req.Challenge]
+	delete(m.challenges, req.Challenge)
+	m.sessionsLock.Unlock()
+	if !ok || time.Now().After(expires) {
+		return nil, unknownChallengeError
+	}
+
+	challenge, _ := hex.DecodeString(req.Challenge)
+	r, s, err := decodeSignature(req.Signature)
+	if err != nil {
+		return nil, err
+	}
+	var reply shared.OpenCanvasReply
+	if err := (&ArtNodeMinerRPC{m}).OpenCanvasRPC(&shared.Args{R: r, S: s, Message: challenge}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return openReply{reply.SessionID, reply.MyCanvasSettings}, nil
+}
+
+// Builds the operation blockartlib's AddShape would send.
+func (m *Miner) gatewayAddShape(req *gatewayRequest) (interface{}, error) {
+	if err := m.checkSession(req.Session); err != nil {
+		return nil, err
+	}
+	if req.ShapeType != "" && req.ShapeType != "path" {
+		return nil, badRequest("Unsupported shape type %q", req.ShapeType)
+	}
+	op, refused := verification.CheckShape(shared.Operation{
+		Fill:             req.Fill,
+		Stroke:           req.Stroke,
+		DAttribute:       req.D,
+		ShapeType:        int(blockartlib.PATH),
+		Layer:            req.Layer,
+		NumBlockValidate: req.ValidateNum,
+		TraceID:          logging.NewTraceID(),
+	}, m.minerNetSettings.CanvasSettings)
+	if err := blockartlib.ErrorFromReply(refused); err != nil {
+		return nil, err
+	}
+	var err error
+	if op.R, op.S, err = m.checkSignature(op.SignedBytes(), req.Signature); err != nil {
+		return nil, err
+	}
+	m.log.Debug("gateway adding shape", "trace", op.TraceID)
+
+	var reply shared.AddShapeReply
+	if err := (&ArtNodeMinerRPC{m}).AddShapeRPC(&shared.OperationArgs{SessionID: req.Session, Operation: op}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return addShapeReply{reply.ShapeHash, reply.BlockHash, reply.InkRemaining}, nil
+}
+
+// Builds the operation blockartlib's DeleteShape would send. Shapes added
+// by any art node of this miner may be deleted, as they share its key;
+// DeleteShapeRPC refuses the others.
+func (m *Miner) gatewayDeleteShape(req *gatewayRequest) (interface{}, error) {
+	if err := m.checkSession(req.Session); err != nil {
+		return nil, err
+	}
+	m.blockChainThread.RLock()
+	shape, ok := m.allShapes[req.ShapeHash]
+	m.blockChainThread.RUnlock()
+	if !ok {
+		return nil, blockartlib.InvalidShapeHashError(req.ShapeHash)
+	}
+	op := shared.Operation{
+		Fill:             shape.Fill,
+		Stroke:           shape.Stroke,
+		DAttribute:       shape.DAttribute,
+		ShapeType:        shape.ShapeType,
+		IsDelete:         true,
+		NumBlockValidate: req.ValidateNum,
+		ShapeHash:        req.ShapeHash,
+		TraceID:          logging.NewTraceID(),
+	}
+	var err error
+	if op.R, op.S, err = m.checkSignature(op.SignedBytes(), req.Signature); err != nil {
+		return nil, err
+	}
+	m.log.Debug("gateway deleting shape", "trace", op.TraceID, "shape", op.ShapeHash)
+
+	var reply shared.InkReply
+	if err := (&ArtNodeMinerRPC{m}).DeleteShapeRPC(&shared.OperationArgs{SessionID: req.Session, Operation: op}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return inkReply{reply.InkRemaining}, nil
+}
+
+// Builds the modify blockartlib's ModifyShape would send.
+func (m *Miner) gatewayModifyShape(req *gatewayRequest) (interface{}, error) {
+	if err := m.checkSession(req.Session); err != nil {
+		return nil, err
+	}
+	if req.ShapeType != "" && req.ShapeType != "path" {
+		return nil, badRequest("Unsupported shape type %q", req.ShapeType)
+	}
+	op := shared.Operation{
+		Fill:             req.Fill,
+		Stroke:           req.Stroke,
+		DAttribute:       req.D,
+		ShapeType:        int(blockartlib.PATH),
+		IsModify:         true,
+		NumBlockValidate: req.ValidateNum,
+		ShapeHash:        req.ShapeHash,
+		Nonce:            req.Nonce,
+		TraceID:          logging.NewTraceID(),
+	}
+	var err error
+	if op.R, op.S, err = m.checkSignature(op.SignedBytes(), req.Signature); err != nil {
+		return nil, err
+	}
+	m.log.Debug("gateway modifying shape", "trace", op.TraceID, "shape", op.ShapeHash)
+
+	var reply shared.AddShapeReply
+	if err := (&ArtNodeMinerRPC{m}).ModifyShapeRPC(&shared.OperationArgs{SessionID: req.Session, Operation: op}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return addShapeReply{op.ShapeHash, reply.BlockHash, reply.InkRemaining}, nil
+}
+
+// Builds the transfer blockartlib's TransferInk would send, with the
+// transfer ID the art node signed.
+func (m *Miner) gatewayTransferInk(req *gatewayRequest) (interface{}, error) {
+	if err := m.checkSession(req.Session); err != nil {
+		return nil, err
+	}
+	to, err := decodePublicKey(req.To)
+	if err != nil {
+		return nil, err
+	}
+	op := shared.Operation{
+		IsTransfer:       true,
+		TransferTo:       to,
+		InkCost:          req.Amount,
+		NumBlockValidate: req.ValidateNum,
+		Nonce:            req.Nonce,
+		TraceID:          logging.NewTraceID(),
+	}
+	if op.R, op.S, err = m.checkSignature(op.SignedBytes(), req.Signature); err != nil {
+		return nil, err
+	}
+	m.log.Debug("gateway transferring ink", "trace", op.TraceID, "ink", op.InkCost)
+
+	var reply shared.InkReply
+	if err := (&ArtNodeMinerRPC{m}).TransferInkRPC(&shared.OperationArgs{SessionID: req.Session, Operation: op}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return inkReply{reply.InkRemaining}, nil
+}
+
+// Builds the claim blockartlib's ClaimRegion would send.
+func (m *Miner) gatewayClaimRegion(req *gatewayRequest) (interface{}, error) {
+	if err := m.checkSession(req.Session); err != nil {
+		return nil, err
+	}
+	op := shared.Operation{
+		IsClaim:          true,
+		Layer:            req.Layer,
+		Region:           req.Region,
+		ClaimBlocks:      req.Blocks,
+		NumBlockValidate: req.ValidateNum,
+		TraceID:          logging.NewTraceID(),
+	}
+	var err error
+	if op.R, op.S, err = m.checkSignature(op.SignedBytes(), req.Signature); err != nil {
+		return nil, err
+	}
+	m.log.Debug("gateway claiming region", "trace", op.TraceID, "layer", op.Layer)
+
+	var reply shared.AddShapeReply
+	if err := (&ArtNodeMinerRPC{m}).ClaimRegionRPC(&shared.OperationArgs{SessionID: req.Session, Operation: op}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return claimRegionReply{reply.ShapeHash, reply.BlockHash, reply.InkRemaining}, nil
+}
+
+// Builds the give or share blockartlib's GiveShape or ShareShape would
+// send.
+func (m *Miner) gatewayChangeOwners(share bool) func(*gatewayRequest) (interface{}, error) {
+	return func(req *gatewayRequest) (interface{}, error) {
+		if err := m.checkSession(req.Session); err != nil {
+			return nil, err
+		}
+		to, err := decodePublicKey(req.To)
+		if err != nil {
+			return nil, err
+		}
+		op := shared.Operation{
+			IsGive:           !share,
+			IsShare:          share,
+			TransferTo:       to,
+			NumBlockValidate: req.ValidateNum,
+			ShapeHash:        req.ShapeHash,
+			Nonce:            req.Nonce,
+			TraceID:          logging.NewTraceID(),
+		}
+		if op.R, op.S, err = m.checkSignature(op.SignedBytes(), req.Signature); err != nil {
+			return nil, err
+		}
+		m.log.Debug("gateway changing owners", "trace", op.TraceID, "shape", op.ShapeHash, "give", op.IsGive)
+
+		var reply shared.ChangeOwnersReply
+		if err := (&ArtNodeMinerRPC{m}).ChangeOwnersRPC(&shared.OperationArgs{SessionID: req.Session, Operation: op}, &reply); err != nil {
+			return nil, err
+		}
+		if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+			return nil, err
+		}
+		return blockHashReply{reply.BlockHash}, nil
+	}
+}
+
+func (m *Miner) gatewayInk(req *gatewayRequest) (interface{}, error) {
+	var reply shared.InkReply
+	if err := (&ArtNodeMinerRPC{m}).GetInkRPC(&shared.Args{SessionID: req.Session}, &reply); err != nil {
+		return nil, err
+	}
+	return inkReply{reply.InkRemaining}, blockartlib.ErrorFromReply(reply.Error)
+}
+
+func (m *Miner) gatewaySvgString(req *gatewayRequest) (interface{}, error) {
+	var reply shared.GetSvgStringReply
+	if err := (&ArtNodeMinerRPC{m}).GetSvgStringRPC(&shared.Args{SessionID: req.Session, ShapeHash: req.ShapeHash}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return svgStringReply{reply.Data}, nil
+}
+
+func (m *Miner) gatewayShapes(req *gatewayRequest) (interface{}, error) {
+	var reply shared.GetShapesReply
+	if err := (&ArtNodeMinerRPC{m}).GetShapesRPC(&shared.Args{SessionID: req.Session, BlockHash: req.BlockHash}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return shapesReply{append([]string{}, reply.Data...)}, nil
+}
+
+func (m *Miner) gatewayChildren(req *gatewayRequest) (interface{}, error) {
+	var reply shared.GetChildrenReply
+	if err := (&ArtNodeMinerRPC{m}).GetChildrenRPC(&shared.Args{SessionID: req.Session, BlockHash: req.BlockHash}, &reply); err != nil {
+		return nil, err
+	}
+	if err := blockartlib.ErrorFromReply(reply.Error); err != nil {
+		return nil, err
+	}
+	return childrenReply{append([]string{}, reply.Data...)}, nil
+}
+
+func (m *Miner) gatewayGenesisBlock(req *gatewayRequest) (interface{}, error) {
+	var reply shared.GetGenesisBlockReply
+	if err := (&ArtNodeMinerRPC{m}).GetGenesisBlockRPC(&shared.Args{SessionID: req.Session}, &reply); err != nil {
+		return nil, err
+	}
+	return blockHashReply{reply.BlockHash}, blockartlib.ErrorFromReply(reply.Error)
+}
+
+func (m *Miner) gatewayClose(req *gatewayRequest) (interface{}, error) {
+	var reply shared.InkReply
+	if err := (&ArtNodeMinerRPC{m}).CloseCanvasRPC(&shared.Args{SessionID: req.Session}, &reply); err != nil {
+		return nil, err
+	}
+	return inkReply{reply.InkRemaining}, blockartlib.ErrorFromReply(reply.Error)
+}
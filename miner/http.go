@@ -0,0 +1,23 @@
+package miner
+
+import (
+	"net"
+	"net/http"
+)
+
+// Serves handler on addr until the miner is stopped.
+func (m *Miner) serveHTTP(addr string, handler http.Handler) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	m.httpServers = append(m.httpServers, server)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		server.Serve(ln)
+	}()
+	return ln, nil
+}
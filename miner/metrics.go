@@ -0,0 +1,144 @@
+package miner
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters behind the metrics endpoint. Gauges such as the chain height are
+// read from the miner's state when the endpoint is scraped.
+type metrics struct {
+	// Hashes tried by FindSecret, and how many per second over the last
+	// second
+	hashes   atomic.Uint64
+	hashRate atomic.Uint64
+
+	opBlocksMined   atomic.Uint64
+	noopBlocksMined atomic.Uint64
+
+	// Blocks from other miners that were verified, and the blocks that
+	// failed verification by failing check
+	blocksReceived atomic.Uint64
+	rejectedLock   sync.Mutex
+	rejected       map[string]uint64
+
+	// Blocks that started a new branch, and tip moves to another branch
+	forks  atomic.Uint64
+	reorgs atomic.Uint64
+}
+
+func (s *metrics) reject(check string) {
+	s.rejectedLock.Lock()
+	defer s.rejectedLock.Unlock()
+	if s.rejected == nil {
+		s.rejected = make(map[string]uint64)
+	}
+	s.rejected[check]++
+}
+
+// Address the metrics endpoint listens on, or nil without
+// Config.MetricsAddr.
+func (m *Miner) MetricsAddr() net.Addr {
+	if m.metricsListener == nil {
+		return nil
+	}
+	return m.metricsListener.Addr()
+}
+
+// Serves the metrics on http://MetricsAddr/metrics in the Prometheus text
+// format until the miner is stopped.
+func (m *Miner) serveMetrics() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.writeMetrics(w)
+	})
+	ln, err := m.serveHTTP(m.config.MetricsAddr, mux)
+	if err != nil {
+		return err
+	}
+	m.metricsListener = ln
+
+	m.wg.Add(1)
+	go m.sampleHashRate()
+	return nil
+}
+
+// Updates the hash rate once a second.
+func (m *Miner) sampleHashRate() {
+	defer m.wg.Done()
+
+	last := m.metrics.hashes.Load()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		hashes := m.metrics.hashes.Load()
+		m.metrics.hashRate.Store(hashes - last)
+		last = hashes
+	}
+}
+
+// Writes every metric to w in the Prometheus text format.
+func (m *Miner) writeMetrics(w io.Writer) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("blockart_hashes_total", "counter", "Hashes tried while searching for nonces.")
+	fmt.Fprintf(w, "blockart_hashes_total %d\n", m.metrics.hashes.Load())
+	metric("blockart_hash_rate", "gauge", "Hashes tried in the last second.")
+	fmt.Fprintf(w, "blockart_hash_rate %d\n", m.metrics.hashRate.Load())
+
+	metric("blockart_blocks_mined_total", "counter", "Blocks mined by this miner and added to its block tree.")
+	fmt.Fprintf(w, "blockart_blocks_mined_total{kind=\"op\"} %d\n", m.metrics.opBlocksMined.Load())
+	fmt.Fprintf(w, "blockart_blocks_mined_total{kind=\"noop\"} %d\n", m.metrics.noopBlocksMined.Load())
+
+	metric("blockart_blocks_received_total", "counter", "Blocks from other miners that passed verification.")
+	fmt.Fprintf(w, "blockart_blocks_received_total %d\n", m.metrics.blocksReceived.Load())
+
+	metric("blockart_blocks_rejected_total", "counter", "Blocks that failed verification, by the first check they failed.")
+	m.metrics.rejectedLock.Lock()
+	checks := make([]string, 0, len(m.metrics.rejected))
+	for check := range m.metrics.rejected {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	for _, check := range checks {
+		fmt.Fprintf(w, "blockart_blocks_rejected_total{check=%q} %d\n", check, m.metrics.rejected[check])
+	}
+	m.metrics.rejectedLock.Unlock()
+
+	metric("blockart_forks_total", "counter", "Blocks that started a new branch of the block tree.")
+	fmt.Fprintf(w, "blockart_forks_total %d\n", m.metrics.forks.Load())
+	metric("blockart_reorgs_total", "counter", "Times the longest chain switched to another branch.")
+	fmt.Fprintf(w, "blockart_reorgs_total %d\n", m.metrics.reorgs.Load())
+
+	m.opsNotInBlockThread.Lock()
+	pool := len(m.opsNotInBlockThread.operations)
+	m.opsNotInBlockThread.Unlock()
+	metric("blockart_op_pool_size", "gauge", "Operations waiting for a block.")
+	fmt.Fprintf(w, "blockart_op_pool_size %d\n", pool)
+
+	metric("blockart_peers", "gauge", "Miners this miner floods to.")
+	fmt.Fprintf(w, "blockart_peers %d\n", len(m.getPeerList()))
+
+	m.blockChainThread.RLock()
+	height := m.heights[m.prevHash]
+	ink := m.inkBalanceLocked(m.minerInfo.Key)
+	m.blockChainThread.RUnlock()
+	metric("blockart_chain_height", "gauge", "Blocks on the longest chain after the genesis block.")
+	fmt.Fprintf(w, "blockart_chain_height %d\n", height)
+	metric("blockart_ink", "gauge", "Ink the longest chain credits this miner with.")
+	fmt.Fprintf(w, "blockart_ink %d\n", ink)
+}
@@ -0,0 +1,755 @@
+/*
+
+Package miner implements the BlockArt ink miner. All of the miner's state
+lives in a Miner instance and its RPC services are registered on a
+per-instance rpc.Server, so several miners can run in the same process.
+
+With Config.MetricsAddr set, a miner serves its hash rate, blocks mined,
+received and rejected, forks, op pool, peers, chain height and ink in the
+Prometheus text format at /metrics. With Config.ExplorerAddr set, it
+serves a block explorer: the block tree with its forks, blocks, shape
+histories, ink balances and the canvas at the tip. With Config.GatewayAddr
+set, it serves the Canvas API as JSON over HTTP (see gateway.go).
+
+*/
+
+package miner
+
+import (
+	"../genesis"
+	"../logging"
+	"../shared"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* ERRORS */
+type NotFoundError string
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("Not found [%s]", string(e))
+}
+
+// Returned to art nodes that use a session the miner does not know, e.g.
+// after CloseCanvas.
+type UnknownSessionError string
+
+func (e UnknownSessionError) Error() string {
+	return fmt.Sprintf("Unknown art node session [%s]", string(e))
+}
+
+// Returned to art nodes whose request was cut short by the miner stopping.
+type StoppedError string
+
+func (e StoppedError) Error() string {
+	return fmt.Sprintf("Miner stopped [%s]", string(e))
+}
+
+// Returned to miners that try to peer from a network with another chain
+// spec.
+type WrongChainError string
+
+func (e WrongChainError) Error() string {
+	return fmt.Sprintf("Different genesis block hash [%s]", string(e))
+}
+
+var ExpectedError = errors.New("Expected error, none found")
+
+func init() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+}
+
+// Settings needed to start a miner.
+type Config struct {
+	// Address of the BlockArt server (ip:port).
+	ServerAddr string
+
+	// Local address to listen on for miner and art node RPCs.
+	// Defaults to ":0".
+	ListenAddr string
+
+	// Address given to the server and other miners, as ip or ip:port.
+	// The port defaults to the one listened on. Defaults to the listen
+	// address, or to a non-loopback IPv4 address of this host when
+	// listening on all interfaces.
+	AdvertiseAddr string
+
+	// Key pair this miner mines on behalf of.
+	PrivateKey *ecdsa.PrivateKey
+
+	// Opens connections to the server and to other miners. Defaults to
+	// dialing TCP; tests replace it to simulate latency, drops and
+	// partitions.
+	Dial func(addr string) (net.Conn, error)
+
+	// Directory the block tree is saved to on Stop and reloaded from on
+	// Start when no peer has a chain (none)
+	DataDir string
+
+	// Number of goroutines searching for a nonce. Defaults to 1.
+	MiningThreads int
+
+	// Where the miner logs to, tagged with a prefix of its key. Defaults
+	// to info and above on stdout.
+	Logger *slog.Logger
+
+	// Address to serve Prometheus metrics on at /metrics (none)
+	MetricsAddr string
+
+	// Address to serve the block explorer web UI on (none)
+	ExplorerAddr string
+
+	// Address to serve the HTTP/JSON art node gateway on (none)
+	GatewayAddr string
+}
+
+type NoopThread struct {
+	sync.RWMutex
+	runNoopGeneration bool
+}
+
+type BlockChainThread struct {
+	sync.RWMutex
+	accessToChain bool
+}
+
+type OpThread struct {
+	sync.RWMutex
+	operations map[string]shared.Operation
+}
+
+// An ink miner instance. Create one with New and run it with Start.
+type Miner struct {
+	config Config
+	log    *slog.Logger
+
+	// Every block seen, including forks, and the longest chain ending at
+	// prevHash in a chain format
+	existingBlockHashes map[string]shared.Block
+	heights             map[string]int
+	blockChain          shared.Node
+	haveChain           bool
+	prevHash            string
+	childrenMap         map[string][]string
+
+	// Blocks waiting for their parent, by parent hash
+	orphans map[string][]shared.Block
+
+	// Blocks that need to be verified that are not current in the chain yet
+	blocksNotInChain shared.BlockNotChain
+
+	// Shapes on the canvas at prevHash (shapeHash to Operation)
+	allShapes map[string]shared.Operation
+
+	// Guards the chain state above
+	blockChainThread BlockChainThread
+
+	minerNetSettings shared.MinerNetSettings
+	minerPrivateKey  *ecdsa.PrivateKey
+	minerInfo        shared.MinerInfo
+	myAddr           *net.TCPAddr
+
+	peersLock sync.RWMutex
+	peers     map[string]shared.PeerInfo
+	peerList  []net.Addr
+
+	noopThread NoopThread
+
+	// Only one op block is mined at a time
+	opBlockLock sync.Mutex
+
+	// Operations that need to disseminated to other blocks
+	opsNotInBlockThread OpThread
+
+	// Open art node sessions by session ID
+	sessionsLock sync.Mutex
+	sessions     map[string]session
+	// Gateway challenges not yet used to open a canvas, with when they
+	// expire
+	challenges map[string]time.Time
+
+	metrics          metrics
+	metricsListener  net.Listener
+	explorerListener net.Listener
+	gatewayListener  net.Listener
+	httpServers      []*http.Server
+
+	server   *rpc.Server
+	listener net.Listener
+	connLock sync.Mutex
+	conns    map[net.Conn]bool
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// Creates a miner from the given config. The miner does not listen or
+// contact the server until Start is called.
+func New(config Config) (*Miner, error) {
+	if config.PrivateKey == nil {
+		return nil, errors.New("miner: config is missing a private key")
+	}
+	if config.ListenAddr == "" {
+		config.ListenAddr = ":0"
+	}
+	if config.MiningThreads <= 0 {
+		config.MiningThreads = 1
+	}
+	if config.Logger == nil {
+		config.Logger = logging.New(os.Stdout, slog.LevelInfo, "miner")
+	}
+	if config.Dial == nil {
+		config.Dial = func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+	}
+
+	m := &Miner{
+		config:              config,
+		log:                 config.Logger.With("key", logging.KeyPrefix(config.PrivateKey.PublicKey)),
+		existingBlockHashes: make(map[string]shared.Block),
+		heights:             make(map[string]int),
+		childrenMap:         make(map[string][]string),
+		orphans:             make(map[string][]shared.Block),
+		blocksNotInChain:    shared.BlockNotChain{Blocks: make(map[string]shared.Block), InkUsedForBlock: make(map[string]uint32)},
+		allShapes:           make(map[string]shared.Operation),
+		minerPrivateKey:     config.PrivateKey,
+		peers:               make(map[string]shared.PeerInfo),
+		noopThread:          NoopThread{runNoopGeneration: true},
+		blockChainThread:    BlockChainThread{accessToChain: true},
+		opsNotInBlockThread: OpThread{operations: make(map[string]shared.Operation)},
+		conns:               make(map[net.Conn]bool),
+		sessions:            make(map[string]session),
+		challenges:          make(map[string]time.Time),
+	}
+	m.minerInfo.Key = wireKey(config.PrivateKey.PublicKey)
+
+	m.server = rpc.NewServer()
+	if err := m.server.RegisterName("MinerRPC", &MinerRPC{m}); err != nil {
+		return nil, err
+	}
+	if err := m.server.RegisterName("ArtNodeMinerRPC", &ArtNodeMinerRPC{m}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Starts listening for RPCs, registers with the server, starts the
+// heartbeat, connects to peers, obtains the existing blockchain and starts
+// mining no-op blocks. The miner runs until ctx is cancelled or Stop is
+// called.
+func (m *Miner) Start(ctx context.Context) error {
+	m.ctx, m.cancel = context.WithCancel(ctx)
+
+	ln, err := net.Listen("tcp", m.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	m.listener = ln
+	m.myAddr, err = m.advertisedAddr(ln)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	m.minerInfo.Address = m.myAddr
+
+	m.wg.Add(1)
+	go m.accept()
+
+	if m.config.MetricsAddr != "" {
+		if err := m.serveMetrics(); err != nil {
+			m.Stop()
+			return err
+		}
+	}
+	if m.config.ExplorerAddr != "" {
+		if err := m.serveExplorer(); err != nil {
+			m.Stop()
+			return err
+		}
+	}
+	if m.config.GatewayAddr != "" {
+		if err := m.serveGateway(); err != nil {
+			m.Stop()
+			return err
+		}
+	}
+
+	if err := m.SetupMiner(); err != nil {
+		m.Stop()
+		return err
+	}
+	return nil
+}
+
+// Stops the miner: ends all art node sessions, cancels no-op and op mining
+// and the heartbeat, waits for its goroutines to exit, saves the block tree
+// to the data dir, deregisters from the server and closes the listener and
+// all open RPC connections.
+func (m *Miner) Stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.sessionsLock.Lock()
+	m.cancel()
+	m.sessionsLock.Unlock()
+	m.closeAllSessions()
+
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	for _, server := range m.httpServers {
+		server.Close()
+	}
+	m.wg.Wait()
+
+	m.stopOnce.Do(func() {
+		if err := m.saveBlocks(); err != nil {
+			m.log.Error("cannot save blocks", "err", err)
+		}
+		m.deregister()
+	})
+
+	m.connLock.Lock()
+	for conn := range m.conns {
+		conn.Close()
+	}
+	m.connLock.Unlock()
+}
+
+// Tells the server this miner is gone, so that it is no longer handed out
+// to other miners.
+func (m *Miner) deregister() {
+	if m.myAddr == nil {
+		return
+	}
+	c, err := m.dial(m.config.ServerAddr)
+	if err != nil {
+		m.log.Error("cannot reach server to deregister", "err", err)
+		return
+	}
+	defer c.Close()
+
+	var ignored bool
+	if err := c.Call("RServer.Deregister", m.minerInfo.Key, &ignored); err != nil {
+		m.log.Error("RServer.Deregister failed", "err", err)
+	}
+}
+
+// Address other miners and art nodes should use to reach this miner.
+func (m *Miner) Addr() *net.TCPAddr {
+	return m.myAddr
+}
+
+// Public key this miner mines on behalf of.
+func (m *Miner) PublicKey() ecdsa.PublicKey {
+	return m.minerInfo.Key
+}
+
+// Blocks on the longest chain, from the genesis block to the tip.
+func (m *Miner) Chain() []shared.Block {
+	m.blockChainThread.RLock()
+	defer m.blockChainThread.RUnlock()
+
+	var blocks []shared.Block
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		blocks = append(blocks, current.Block)
+	}
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks
+}
+
+// Shapes on the canvas at the tip of the longest chain (shapeHash to Operation).
+func (m *Miner) Shapes() map[string]shared.Operation {
+	m.blockChainThread.RLock()
+	defer m.blockChainThread.RUnlock()
+	return copyShapes(m.allShapes)
+}
+
+// Ink the longest chain credits key with.
+func (m *Miner) InkBalance(key ecdsa.PublicKey) uint32 {
+	m.blockChainThread.RLock()
+	defer m.blockChainThread.RUnlock()
+	return m.inkBalanceLocked(key)
+}
+
+func (m *Miner) accept() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.connLock.Lock()
+		m.conns[conn] = true
+		m.connLock.Unlock()
+
+		go func() {
+			m.server.ServeConn(conn)
+			m.connLock.Lock()
+			delete(m.conns, conn)
+			m.connLock.Unlock()
+		}()
+	}
+}
+
+// Returns config.AdvertiseAddr, with the listener's port if it has none.
+func (m *Miner) advertisedAddr(ln net.Listener) (*net.TCPAddr, error) {
+	if m.config.AdvertiseAddr == "" {
+		return defaultAdvertisedAddr(ln), nil
+	}
+
+	host, port := m.config.AdvertiseAddr, ""
+	if h, p, err := net.SplitHostPort(m.config.AdvertiseAddr); err == nil {
+		host, port = h, p
+	}
+	if port == "" || port == "0" {
+		port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("advertised address %s: %s", m.config.AdvertiseAddr, err)
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return nil, fmt.Errorf("advertised address %s: not an address other miners can reach", m.config.AdvertiseAddr)
+	}
+	return addr, nil
+}
+
+// Returns the listener's address if it is bound to a specific IP. Otherwise
+// returns a non-loopback IPv4 address with the listener's port, falling back
+// to loopback when the host has no such interface.
+func defaultAdvertisedAddr(ln net.Listener) *net.TCPAddr {
+	listenAddr := ln.Addr().(*net.TCPAddr)
+	if !listenAddr.IP.IsUnspecified() {
+		return listenAddr
+	}
+
+	port := listenAddr.Port
+	var myAddr *net.TCPAddr
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			if ipnet.IP.To4() != nil {
+				minerIPString := ipnet.IP.String() + ":" + strconv.Itoa(port)
+				myAddr, _ = net.ResolveTCPAddr("tcp", minerIPString)
+			}
+		}
+	}
+
+	if myAddr == nil {
+		myAddr, _ = net.ResolveTCPAddr("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	}
+	return myAddr
+}
+
+func (m *Miner) dial(addr string) (*rpc.Client, error) {
+	conn, err := m.config.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Public keys are kept and sent with their curve reduced to its parameters,
+// since gob can only carry the registered *elliptic.CurveParams type.
+func wireKey(key ecdsa.PublicKey) ecdsa.PublicKey {
+	if key.Curve != nil {
+		key.Curve = key.Curve.Params()
+	}
+	return key
+}
+
+// Registers with the server, starts heartbeat, and gets the existing
+// blockchain from other miners.
+// Once the current blockchain is obtained from other miners, returns from method
+func (m *Miner) SetupMiner() error {
+	c, err := m.dial(m.config.ServerAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	pubKey := m.minerInfo.Key
+
+	err = c.Call("RServer.Register", shared.MinerInfo{Address: m.myAddr, Key: pubKey}, &m.minerNetSettings)
+	if err != nil {
+		return fmt.Errorf("client registration for %s: %s", m.myAddr.String(), err)
+	}
+	if err := genesis.Verify(m.minerNetSettings); err != nil {
+		return fmt.Errorf("settings from server: %s", err)
+	}
+
+	m.log.Info("running miner", "addr", m.myAddr)
+	m.wg.Add(1)
+	go m.RunHeartBeat(m.config.ServerAddr, pubKey)
+
+	// Get all Nodes
+	var addrSet []net.Addr
+	err = c.Call("RServer.GetNodes", pubKey, &addrSet)
+	if err != nil {
+		return fmt.Errorf("Get nodes was unsuccessful with public key %s: %s", m.myAddr.String(), err)
+	}
+
+	m.log.Debug("peer list", "peers", addrSet)
+	for i := 0; i < len(addrSet); i++ {
+		m.ConnectToMiners(addrSet[i])
+	}
+
+	m.GetInitialBlockChain()
+
+	m.wg.Add(1)
+	go m.GenerateNoopBlock()
+
+	return nil
+}
+
+func (m *Miner) GetInitialBlockChain() {
+	success := false
+	for _, peer := range m.getPeerList() {
+		client, err := m.dial(peer.String())
+		if err == nil {
+			var reply shared.BlockChainInit
+			err = client.Call("MinerRPC.GetBlockChain", m.myAddr, &reply)
+			client.Close()
+			if err == nil && len(reply.ExistingBlocks) > 0 {
+				// The peer's blocks are checked like any other, and its
+				// tip is whichever of them ends up the longest chain
+				m.blockChainThread.Lock()
+				if dropped := m.replayBlocksLocked(reply.ExistingBlocks); dropped > 0 {
+					m.log.Info("dropped blocks from peer that fail verification", "peer", peer, "blocks", dropped)
+				}
+				m.blockChainThread.Unlock()
+				success = true
+				break
+			}
+		}
+	}
+	if !success {
+		m.blockChainThread.Lock()
+		loaded, err := m.loadBlocksLocked()
+		m.blockChainThread.Unlock()
+		if err != nil {
+			m.log.Error("cannot load saved blocks", "err", err)
+		}
+		success = loaded
+	}
+	if !success {
+		m.blockChainThread.Lock()
+		m.resetToGenesisLocked()
+		m.blockChainThread.Unlock()
+	}
+}
+
+// Starts the block tree over with just the genesis block.
+func (m *Miner) resetToGenesisLocked() {
+	genBlock := genesis.Block(m.minerNetSettings)
+
+	m.blockChain = shared.Node{Block: genBlock}
+	m.existingBlockHashes = map[string]shared.Block{genBlock.Hash: genBlock}
+	m.heights = map[string]int{genBlock.Hash: 0}
+	m.childrenMap = make(map[string][]string)
+	m.allShapes = make(map[string]shared.Operation)
+	m.haveChain = true
+
+	// Updates the previous hash here
+	m.prevHash = genBlock.Hash
+}
+
+// Connects to a peer and asks it to connect back to this miner.
+func (m *Miner) ConnectToMiners(peer net.Addr) {
+	if m.addPeer(peer) {
+		client, err := m.dial(peer.String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		// tell miner to connect to self
+		var result bool
+		client.Call("MinerRPC.ConnectToMe", m.myAddr, &result)
+	}
+}
+
+// Dials peer and records its public key. Returns true if the peer is
+// reachable and on the same chain spec as this miner.
+func (m *Miner) addPeer(peer net.Addr) bool {
+	client, err := m.dial(peer.String())
+	if err != nil {
+		m.log.Error("cannot connect to miner", "peer", peer)
+		return false
+	}
+	defer client.Close()
+
+	var reply shared.ConnectReply
+	args := shared.ConnectArgs{Addr: m.myAddr, GenesisBlockHash: m.minerNetSettings.GenesisBlockHash}
+	err = client.Call("MinerRPC.Connect", args, &reply)
+	if err == nil && reply.GenesisBlockHash != m.minerNetSettings.GenesisBlockHash {
+		err = WrongChainError(reply.GenesisBlockHash)
+	}
+
+	m.peersLock.Lock()
+	defer m.peersLock.Unlock()
+	if err != nil {
+		m.log.Error("MinerRPC.Connect failed", "peer", peer, "err", err)
+		delete(m.peers, peer.String())
+		return false
+	}
+
+	m.peers[peer.String()] = shared.PeerInfo{PubKey: reply.Key}
+	if !Contains(m.peerList, peer) {
+		m.peerList = append(m.peerList, peer)
+	}
+	return true
+}
+
+func (m *Miner) getPeerList() []net.Addr {
+	m.peersLock.RLock()
+	defer m.peersLock.RUnlock()
+	return append([]net.Addr(nil), m.peerList...)
+}
+
+func (m *Miner) removePeers(peersToRemove []net.Addr) {
+	m.peersLock.Lock()
+	defer m.peersLock.Unlock()
+
+	var temp []net.Addr
+	for _, peer := range m.peerList {
+		if !Contains(peersToRemove, peer) {
+			temp = append(temp, peer)
+		} else {
+			delete(m.peers, peer.String())
+		}
+	}
+	m.peerList = temp
+}
+
+// Pings the known peers, drops the ones that are gone and asks the server
+// for more if fewer than MinNumMinerConnections are left.
+func (m *Miner) GetNodes() {
+	count := uint8(0)
+	var peersToRemove []net.Addr
+	for _, peer := range m.getPeerList() {
+		if count >= m.minerNetSettings.MinNumMinerConnections {
+			break
+		}
+		neighbour, err := m.dial(peer.String())
+		if err != nil {
+			m.log.Error("cannot connect to miner", "peer", peer)
+			peersToRemove = append(peersToRemove, peer)
+			continue
+		}
+
+		var reply string
+		var message = "hi"
+		err = neighbour.Call("MinerRPC.Ping", message, &reply)
+		neighbour.Close()
+
+		if err != nil {
+			peersToRemove = append(peersToRemove, peer)
+			m.log.Error("MinerRPC.Ping failed", "peer", peer, "err", err)
+		} else if "hi" == reply {
+			count++
+		}
+	}
+
+	//clean up peerList
+	if len(peersToRemove) > 0 {
+		m.removePeers(peersToRemove)
+	}
+
+	if count < m.minerNetSettings.MinNumMinerConnections {
+		server, err := m.dial(m.config.ServerAddr)
+		if err == nil {
+			defer server.Close()
+			var addrSet []net.Addr
+			err = server.Call("RServer.GetNodes", m.minerInfo.Key, &addrSet)
+			if err != nil {
+				m.log.Error("RServer.GetNodes failed", "server", m.config.ServerAddr, "err", err)
+				return
+			}
+			for i := 0; i < len(addrSet); i++ {
+				m.ConnectToMiners(addrSet[i])
+			}
+		}
+	}
+}
+
+// Sends heartbeats to the server until the miner stops. A failed heartbeat
+// is retried over a new connection, and the miner registers again if the
+// server has dropped it in the meantime.
+func (m *Miner) RunHeartBeat(ipPort string, pubKey ecdsa.PublicKey) {
+	defer m.wg.Done()
+
+	var c *rpc.Client
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	var _ignored bool
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(time.Duration(m.minerNetSettings.HeartBeat/2) * time.Millisecond):
+		}
+
+		if c == nil {
+			var err error
+			if c, err = m.dial(ipPort); err != nil {
+				m.log.Error("cannot reach server for heartbeat", "err", err)
+				c = nil
+				continue
+			}
+		}
+
+		err := c.Call("RServer.HeartBeat", pubKey, &_ignored)
+		if err == nil || m.ctx.Err() != nil {
+			continue
+		}
+		m.log.Error("heartbeat failed", "err", err)
+
+		if _, ok := err.(rpc.ServerError); ok {
+			// The server timed this miner out
+			var settings shared.MinerNetSettings
+			err = c.Call("RServer.Register", shared.MinerInfo{Address: m.myAddr, Key: pubKey}, &settings)
+			if err != nil {
+				m.log.Error("registering again failed", "err", err)
+			}
+		} else {
+			c.Close()
+			c = nil
+		}
+	}
+}
+
+func Contains(peers []net.Addr, element net.Addr) bool {
+	for _, value := range peers {
+		if element.String() == value.String() {
+			return true
+		}
+	}
+	return false
+}
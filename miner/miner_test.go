@@ -0,0 +1,1096 @@
+package miner
+
+import (
+	"../blockartlib"
+	"../genesis"
+	"../logging"
+	"../shared"
+	"../verification"
+
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Minimal stand-in for the BlockArt server: registers miners and hands
+// every miner all of the others in GetNodes.
+type testServer struct {
+	sync.Mutex
+	settings shared.MinerNetSettings
+	miners   map[string]net.Addr
+}
+
+func (s *testServer) Register(m shared.MinerInfo, r *shared.MinerNetSettings) error {
+	s.Lock()
+	defer s.Unlock()
+	s.miners[EncodePublicKey(m.Key)+m.Address.String()] = m.Address
+	*r = s.settings
+	return nil
+}
+
+func (s *testServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, addr := range s.miners {
+		*addrSet = append(*addrSet, addr)
+	}
+	return nil
+}
+
+func (s *testServer) Deregister(key ecdsa.PublicKey, _ignored *bool) error {
+	s.Lock()
+	defer s.Unlock()
+	for k := range s.miners {
+		if strings.HasPrefix(k, EncodePublicKey(key)) {
+			delete(s.miners, k)
+		}
+	}
+	return nil
+}
+
+func (s *testServer) HeartBeat(key ecdsa.PublicKey, _ignored *bool) error {
+	return nil
+}
+
+var testSettings = shared.MinerNetSettings{
+	ChainName:              "miner-test",
+	MinNumMinerConnections: 1,
+	InkPerOpBlock:          100,
+	InkPerNoOpBlock:        20,
+	HeartBeat:              2000,
+	PoWDifficultyOpBlock:   2,
+	PoWDifficultyNoOpBlock: 2,
+	CanvasSettings:         shared.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024, Layers: []string{"top"}},
+}
+
+func startTestServer(t *testing.T) (string, func()) {
+	return startTestServerWithSettings(t, genesis.New(testSettings))
+}
+
+func startTestServerWithSettings(t *testing.T, settings shared.MinerNetSettings) (string, func()) {
+	s := &testServer{
+		settings: settings,
+		miners:   make(map[string]net.Addr),
+	}
+
+	server := rpc.NewServer()
+	server.RegisterName("RServer", s)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(ln)
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func startTestMiner(t *testing.T, serverAddr string) *Miner {
+	return startTestMinerOnCurve(t, serverAddr, elliptic.P384())
+}
+
+func startTestMinerOnCurve(t *testing.T, serverAddr string, curve elliptic.Curve) *Miner {
+	priv, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	m, err := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", PrivateKey: priv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNewRequiresPrivateKey(t *testing.T) {
+	if _, err := New(Config{ServerAddr: "127.0.0.1:12345"}); err == nil {
+		t.Error("Expected an error for a config without a private key")
+	}
+}
+
+func TestTwoMinersInOneProcess(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m1 := startTestMiner(t, serverAddr)
+	m2 := startTestMiner(t, serverAddr)
+
+	if m1.Addr().String() == m2.Addr().String() {
+		t.Fatal("Both miners are listening on the same address", m1.Addr())
+	}
+
+	// m2 was handed m1 by the server and asked m1 to connect back
+	if !Contains(m1.getPeerList(), m2.Addr()) || !Contains(m2.getPeerList(), m1.Addr()) {
+		t.Fatal("Miners did not peer with each other")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	m1.Stop()
+	m2.Stop()
+
+	if m1.inkRemaining() == 0 {
+		t.Error("Miner 1 did not mine any no-op blocks")
+	}
+
+	// Every block one miner has was flooded to the other
+	for hash := range m1.existingBlockHashes {
+		if _, ok := m2.existingBlockHashes[hash]; !ok {
+			t.Error("Block mined by miner 1 missing from miner 2:", hash)
+		}
+	}
+}
+
+func TestStopEndsMining(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	time.Sleep(100 * time.Millisecond)
+	m.Stop()
+
+	numBlocks := len(m.existingBlockHashes)
+	time.Sleep(200 * time.Millisecond)
+	if len(m.existingBlockHashes) != numBlocks {
+		t.Error("Miner kept mining after Stop")
+	}
+
+	if _, err := rpc.Dial("tcp", m.Addr().String()); err == nil {
+		t.Error("Miner still accepting connections after Stop")
+	}
+}
+
+func TestStopDeregisters(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	m.Stop()
+
+	var addrSet []net.Addr
+	client, err := rpc.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Call("RServer.GetNodes", m.PublicKey(), &addrSet); err != nil {
+		t.Fatal(err)
+	}
+	if len(addrSet) != 0 {
+		t.Error("Miner still registered after Stop:", addrSet)
+	}
+}
+
+func TestCloseCanvasEndsSession(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	defer m.Stop()
+	rpc := &ArtNodeMinerRPC{m}
+
+	msg := []byte("Hello")
+	r, s, _ := ecdsa.Sign(rand.Reader, m.minerPrivateKey, msg)
+	var opened shared.OpenCanvasReply
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &opened); err != nil || opened.SessionID == "" {
+		t.Fatal("Expected a session to be opened", err)
+	}
+
+	var ink shared.InkReply
+	if err := rpc.GetInkRPC(&shared.Args{SessionID: opened.SessionID}, &ink); err != nil {
+		t.Error("GetInk failed on an open session:", err)
+	}
+	if err := rpc.CloseCanvasRPC(&shared.Args{SessionID: opened.SessionID}, &ink); err != nil {
+		t.Error("CloseCanvas failed on an open session:", err)
+	}
+	if err := rpc.GetInkRPC(&shared.Args{SessionID: opened.SessionID}, &ink); err == nil {
+		t.Error("Expected GetInk to fail on a closed session")
+	}
+	if err := rpc.CloseCanvasRPC(&shared.Args{SessionID: opened.SessionID}, &ink); err == nil {
+		t.Error("Expected a second CloseCanvas to fail")
+	}
+}
+
+func TestArtNodeRefusals(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	defer m.Stop()
+	rpc := &ArtNodeMinerRPC{m}
+
+	msg := []byte("Hello")
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	r, s, _ := ecdsa.Sign(rand.Reader, other, msg)
+	var refused shared.OpenCanvasReply
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &refused); err != nil || refused.Error.Code != shared.InvalidKeyPair || refused.Error.Version != shared.ErrorCodeVersion {
+		t.Error("Expected InvalidKeyPair for another key, got", err, refused.Error)
+	}
+	var opened shared.OpenCanvasReply
+	r, s, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, msg)
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &opened); err != nil || opened.Error.Code != shared.NoError {
+		t.Fatal("Expected a session to be opened", err, opened.Error)
+	}
+	session := opened.SessionID
+
+	for d, want := range map[string]shared.ErrorCode{
+		"M 0 0 L 2000 0":             shared.OutOfBounds,
+		"M 0 0 Q 5 5":                shared.InvalidShapeSvgString,
+		strings.Repeat("M 0 0 ", 30): shared.ShapeSvgStringTooLong,
+	} {
+		var added shared.AddShapeReply
+		op := shared.Operation{DAttribute: d, Fill: "transparent", Stroke: "red", ShapeHash: "invalid"}
+		if err := rpc.AddShapeRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &added); err != nil || added.Error.Code != want {
+			t.Error("Expected", want, "for", d, "got", err, added.Error)
+		}
+	}
+
+	// Claims no ink, but covers most of the canvas
+	var added shared.AddShapeReply
+	op := shared.Operation{DAttribute: "M 0 0 L 1000 0 L 1000 1000 L 0 1000 Z", Fill: "red", Stroke: "transparent", ShapeHash: "too-big"}
+	if err := rpc.AddShapeRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &added); err != nil || added.Error.Code != shared.InvalidKeyPair {
+		t.Error("Expected InvalidKeyPair for an unsigned shape, got", err, added.Error)
+	}
+	op.R, op.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, op.SignedBytes())
+	if err := rpc.AddShapeRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &added); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blockartlib.ErrorFromReply(added.Error).(blockartlib.InsufficientInkError); !ok || added.Error.InkRemaining != m.inkRemaining() {
+		t.Error("Expected InsufficientInk with the ink remaining, got", added.Error)
+	}
+
+	foreign := shared.Operation{DAttribute: "M 50 50 L 60 60", ShapeHash: "foreign", ArtNodeKey: wireKey(other.PublicKey)}
+	m.blockChainThread.Lock()
+	m.allShapes[foreign.ShapeHash] = foreign
+	m.blockChainThread.Unlock()
+
+	for hash, want := range map[string]shared.ErrorCode{"unknown": shared.InvalidShapeHash, "foreign": shared.ShapeOwner} {
+		var deleted shared.InkReply
+		op := shared.Operation{ShapeHash: hash, IsDelete: true}
+		op.R, op.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, op.SignedBytes())
+		if err := rpc.DeleteShapeRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &deleted); err != nil || deleted.Error.Code != want || deleted.Error.Subject != hash {
+			t.Error("Expected", want, "deleting", hash, "got", err, deleted.Error)
+		}
+	}
+
+	// A peer's op that its key did not sign never reaches the pool
+	forged := shared.Operation{DAttribute: "M 70 70 L 80 80", Fill: "transparent", Stroke: "red", ArtNodeKey: m.PublicKey(), R: big.NewInt(1), S: big.NewInt(1)}
+	m.FloodOperation(forged)
+	m.opsNotInBlockThread.Lock()
+	pooled := len(m.opsNotInBlockThread.operations)
+	m.opsNotInBlockThread.Unlock()
+	if pooled != 0 {
+		t.Error("Expected an op with a forged signature to be dropped, got", pooled, "ops in the pool")
+	}
+
+	var svg shared.GetSvgStringReply
+	if err := rpc.GetSvgStringRPC(&shared.Args{SessionID: session, ShapeHash: "unknown"}, &svg); err != nil || svg.Error.Code != shared.InvalidShapeHash {
+		t.Error("Expected InvalidShapeHash, got", err, svg.Error)
+	}
+	var shapes shared.GetShapesReply
+	if err := rpc.GetShapesRPC(&shared.Args{SessionID: session, BlockHash: "unknown"}, &shapes); err != nil || shapes.Error.Code != shared.InvalidBlockHash {
+		t.Error("Expected InvalidBlockHash, got", err, shapes.Error)
+	}
+	var children shared.GetChildrenReply
+	if err := rpc.GetChildrenRPC(&shared.Args{SessionID: session, BlockHash: "unknown"}, &children); err != nil || children.Error.Code != shared.InvalidBlockHash {
+		t.Error("Expected InvalidBlockHash, got", err, children.Error)
+	}
+
+	future := shared.ReplyError{Version: shared.ErrorCodeVersion + 1, Code: 1000}
+	if err := blockartlib.ErrorFromReply(future); err == nil || !strings.Contains(err.Error(), "error-code-1000") {
+		t.Error("Expected an unknown code to be reported as is, got", err)
+	}
+}
+
+func TestTransferInk(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	defer m.Stop()
+	rpc := &ArtNodeMinerRPC{m}
+
+	msg := []byte("Hello")
+	var opened shared.OpenCanvasReply
+	r, s, _ := ecdsa.Sign(rand.Reader, m.minerPrivateKey, msg)
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &opened); err != nil || opened.Error.Code != shared.NoError {
+		t.Fatal("Expected a session to be opened", err, opened.Error)
+	}
+	session := opened.SessionID
+
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	transfer := func(op shared.Operation, key *ecdsa.PrivateKey) shared.InkReply {
+		op.IsTransfer = true
+		op.NumBlockValidate = 1
+		op.R, op.S, _ = ecdsa.Sign(rand.Reader, key, op.SignedBytes())
+		var reply shared.InkReply
+		if err := rpc.TransferInkRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	for name, c := range map[string]struct {
+		op   shared.Operation
+		key  *ecdsa.PrivateKey
+		want shared.ErrorCode
+	}{
+		"nothing":      {shared.Operation{TransferTo: other.PublicKey}, m.minerPrivateKey, shared.InvalidTransfer},
+		"to itself":    {shared.Operation{InkCost: 1, TransferTo: m.minerPrivateKey.PublicKey}, m.minerPrivateKey, shared.InvalidTransfer},
+		"too much":     {shared.Operation{InkCost: 1 << 30, TransferTo: other.PublicKey}, m.minerPrivateKey, shared.InsufficientInk},
+		"another sign": {shared.Operation{InkCost: 1, TransferTo: other.PublicKey}, other, shared.InvalidKeyPair},
+	} {
+		if reply := transfer(c.op, c.key); reply.Error.Code != c.want {
+			t.Error("Expected", c.want, "for", name, "got", reply.Error)
+		}
+	}
+
+	for m.inkRemaining() < 30 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply := transfer(shared.Operation{InkCost: 30, TransferTo: other.PublicKey}, m.minerPrivateKey); reply.Error.Code != shared.NoError {
+		t.Fatal("Cannot transfer ink:", reply.Error)
+	}
+	m.blockChainThread.RLock()
+	received := m.inkBalanceLocked(other.PublicKey)
+	m.blockChainThread.RUnlock()
+	if received != 30 {
+		t.Error("Expected the other key to have received 30 ink, got", received)
+	}
+}
+
+func TestChangeOwners(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	defer m.Stop()
+	rpc := &ArtNodeMinerRPC{m}
+
+	msg := []byte("Hello")
+	var opened shared.OpenCanvasReply
+	r, s, _ := ecdsa.Sign(rand.Reader, m.minerPrivateKey, msg)
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &opened); err != nil || opened.Error.Code != shared.NoError {
+		t.Fatal("Expected a session to be opened", err, opened.Error)
+	}
+	session := opened.SessionID
+
+	const d = "M 0 0 L 10 10"
+	shape, _ := verification.CheckShape(shared.Operation{DAttribute: d, Fill: "transparent", Stroke: "red", ArtNodeKey: m.PublicKey()}, m.minerNetSettings.CanvasSettings)
+	shape.R, shape.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, shape.SignedBytes())
+	owned := shape.ContentHash()
+	for m.inkRemaining() < shape.InkCost {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if blockHash, refused := m.AddOperationHelper(shape); blockHash == "" {
+		t.Fatal("AddOperationHelper failed:", refused)
+	}
+
+	friend, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	var nonce uint64
+	change := func(op shared.Operation) shared.ReplyError {
+		nonce++
+		op.Nonce = nonce
+		op.R, op.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, op.SignedBytes())
+		var reply shared.ChangeOwnersReply
+		if err := rpc.ChangeOwnersRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Error
+	}
+	owners := func() shared.Operation {
+		m.blockChainThread.RLock()
+		defer m.blockChainThread.RUnlock()
+		return m.allShapes[owned]
+	}
+
+	if refused := change(shared.Operation{IsShare: true, ShapeHash: "unknown", TransferTo: friend.PublicKey}); refused.Code != shared.InvalidShapeHash {
+		t.Error("Expected InvalidShapeHash, got", refused)
+	}
+	if refused := change(shared.Operation{IsShare: true, ShapeHash: owned, TransferTo: m.PublicKey()}); refused.Code != shared.InvalidOwner {
+		t.Error("Expected InvalidOwner sharing with the owner, got", refused)
+	}
+	if refused := change(shared.Operation{IsShare: true, ShapeHash: owned, TransferTo: friend.PublicKey}); refused.Code != shared.NoError {
+		t.Fatal("Cannot share the shape:", refused)
+	}
+	if shape := owners(); !shape.OwnedBy(friend.PublicKey) || !shape.OwnedBy(m.PublicKey()) {
+		t.Error("Expected the shape to have two owners, got", shape.CoOwners)
+	}
+
+	if refused := change(shared.Operation{IsGive: true, ShapeHash: owned, TransferTo: friend.PublicKey}); refused.Code != shared.NoError {
+		t.Fatal("Cannot give the shape:", refused)
+	}
+	if shape := owners(); !shape.OwnedBy(friend.PublicKey) || shape.OwnedBy(m.PublicKey()) {
+		t.Error("Expected the shape to be owned by the friend alone")
+	}
+	if refused := change(shared.Operation{IsShare: true, ShapeHash: owned, TransferTo: m.PublicKey()}); refused.Code != shared.ShapeOwner {
+		t.Error("Expected ShapeOwner sharing a shape given away, got", refused)
+	}
+	var deleted shared.InkReply
+	deletion := shared.Operation{ShapeHash: owned, IsDelete: true}
+	deletion.R, deletion.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, deletion.SignedBytes())
+	if err := rpc.DeleteShapeRPC(&shared.OperationArgs{SessionID: session, Operation: deletion}, &deleted); err != nil || deleted.Error.Code != shared.ShapeOwner {
+		t.Error("Expected ShapeOwner deleting a shape given away, got", err, deleted.Error)
+	}
+}
+
+func TestModifyShape(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	defer m.Stop()
+	rpc := &ArtNodeMinerRPC{m}
+
+	msg := []byte("Hello")
+	var opened shared.OpenCanvasReply
+	r, s, _ := ecdsa.Sign(rand.Reader, m.minerPrivateKey, msg)
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &opened); err != nil || opened.Error.Code != shared.NoError {
+		t.Fatal("Expected a session to be opened", err, opened.Error)
+	}
+	session := opened.SessionID
+
+	const d = "M 0 0 L 10 0"
+	shape, _ := verification.CheckShape(shared.Operation{DAttribute: d, Fill: "transparent", Stroke: "red", ArtNodeKey: m.PublicKey()}, m.minerNetSettings.CanvasSettings)
+	shape.R, shape.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, shape.SignedBytes())
+	modified := shape.ContentHash()
+	for m.inkRemaining() < 50 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if blockHash, refused := m.AddOperationHelper(shape); blockHash == "" {
+		t.Fatal("AddOperationHelper failed:", refused)
+	}
+
+	var nonce uint64
+	modify := func(hash string, d string) shared.AddShapeReply {
+		nonce++
+		op := shared.Operation{IsModify: true, ShapeHash: hash, DAttribute: d, Fill: "transparent", Stroke: "blue", Nonce: nonce}
+		op.R, op.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, op.SignedBytes())
+		var reply shared.AddShapeReply
+		if err := rpc.ModifyShapeRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	// Overlaps the version it replaces, and costs 20 ink more
+	if reply := modify(modified, "M 0 0 L 30 0"); reply.Error.Code != shared.NoError {
+		t.Fatal("Cannot modify the shape:", reply.Error)
+	}
+	m.blockChainThread.RLock()
+	current := m.allShapes[modified]
+	m.blockChainThread.RUnlock()
+	if current.Version != 1 || current.AppShapeOp != `<path d="M 0 0 L 30 0" stroke="blue" fill="transparent"/>` {
+		t.Error("Expected version 1 of the shape under the same hash, got", current.Version, current.AppShapeOp)
+	}
+	if reply := modify(modified, "M 0 0 L 5 0"); reply.Error.Code != shared.NoError {
+		t.Fatal("Cannot modify the shape again:", reply.Error)
+	}
+	var history []uint32
+	var spent []int64
+	m.blockChainThread.RLock()
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		for _, op := range current.Block.Operations {
+			if op.ShapeHash == modified && op.IsModify {
+				history = append(history, op.Version)
+				spent = append(spent, op.InkSpent())
+			}
+		}
+	}
+	m.blockChainThread.RUnlock()
+	if len(history) != 2 || history[0] != 2 || history[1] != 1 {
+		t.Fatal("Expected versions 1 and 2 on the chain, got", history)
+	}
+	if spent[1] != 20 || spent[0] != -25 {
+		t.Error("Expected the modifies to cost 20 ink and refund 25, got", spent)
+	}
+
+	if reply := modify("unknown", "M 0 0 L 5 0"); reply.Error.Code != shared.InvalidShapeHash {
+		t.Error("Expected InvalidShapeHash, got", reply.Error)
+	}
+	if reply := modify(modified, "M 0 0 L 5000 0"); reply.Error.Code != shared.OutOfBounds {
+		t.Error("Expected OutOfBounds, got", reply.Error)
+	}
+}
+
+func TestClaimRegion(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m := startTestMiner(t, serverAddr)
+	defer m.Stop()
+	rpc := &ArtNodeMinerRPC{m}
+
+	msg := []byte("Hello")
+	var opened shared.OpenCanvasReply
+	r, s, _ := ecdsa.Sign(rand.Reader, m.minerPrivateKey, msg)
+	if err := rpc.OpenCanvasRPC(&shared.Args{R: r, S: s, Message: msg}, &opened); err != nil || opened.Error.Code != shared.NoError {
+		t.Fatal("Expected a session to be opened", err, opened.Error)
+	}
+	session := opened.SessionID
+
+	claim := func(layer string, region shared.Region) shared.AddShapeReply {
+		op := shared.Operation{IsClaim: true, Layer: layer, Region: region, ClaimBlocks: 1000}
+		op.R, op.S, _ = ecdsa.Sign(rand.Reader, m.minerPrivateKey, op.SignedBytes())
+		var reply shared.AddShapeReply
+		if err := rpc.ClaimRegionRPC(&shared.OperationArgs{SessionID: session, Operation: op}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	for m.inkRemaining() < 100 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	corner := claim("top", shared.Region{MinX: 0, MinY: 0, MaxX: 10, MaxY: 10})
+	if corner.Error.Code != shared.NoError || corner.ShapeHash == "" {
+		t.Fatal("Cannot claim a region:", corner.Error)
+	}
+	var cost uint32
+	m.blockChainThread.RLock()
+	for current := &m.blockChain; current != nil; current = current.Prev {
+		for _, op := range current.Block.Operations {
+			if op.IsClaim && op.ShapeHash == corner.ShapeHash {
+				cost = op.InkCost
+			}
+		}
+	}
+	m.blockChainThread.RUnlock()
+	if cost != 100 {
+		t.Error("Expected the claim to cost the area of its region, got", cost)
+	}
+
+	// Other keys cannot draw in the region, on its layer only
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	shape := shared.Operation{DAttribute: "M 5 5 L 20 20", Fill: "transparent", Stroke: "red", Layer: "top", ArtNodeKey: other.PublicKey}
+	m.blockChainThread.RLock()
+	claimID, claimed := m.claimInTheWayLocked(shape)
+	shape.Layer = ""
+	_, claimedBelow := m.claimInTheWayLocked(shape)
+	shape.ArtNodeKey = m.PublicKey()
+	shape.Layer = "top"
+	_, claimedByOwner := m.claimInTheWayLocked(shape)
+	m.blockChainThread.RUnlock()
+	if !claimed || claimID != corner.ShapeHash {
+		t.Error("Expected the claim to keep another key out of the region")
+	}
+	if claimedBelow || claimedByOwner {
+		t.Error("Expected the claim to hold only its layer against other keys")
+	}
+
+	if reply := claim("middle", shared.Region{MaxX: 10, MaxY: 10}); reply.Error.Code != shared.InvalidLayer {
+		t.Error("Expected InvalidLayer, got", reply.Error)
+	}
+	if reply := claim("", shared.Region{MaxX: 2000, MaxY: 10}); reply.Error.Code != shared.OutOfBounds {
+		t.Error("Expected OutOfBounds, got", reply.Error)
+	}
+	if reply := claim("", shared.Region{MinX: 10, MaxX: 10, MaxY: 10}); reply.Error.Code != shared.InvalidRegion {
+		t.Error("Expected InvalidRegion, got", reply.Error)
+	}
+}
+
+func TestStartRefusesTamperedSettings(t *testing.T) {
+	settings := genesis.New(testSettings)
+	settings.InkPerNoOpBlock = 1000
+	serverAddr, stopServer := startTestServerWithSettings(t, settings)
+	defer stopServer()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	m, err := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", PrivateKey: priv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err == nil {
+		m.Stop()
+		t.Error("Miner started with settings that do not match the genesis block hash")
+	}
+}
+
+func TestMinersOnDifferentChainsDoNotPeer(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+	otherSettings := testSettings
+	otherSettings.ChainName = "other-test"
+	otherServerAddr, stopOtherServer := startTestServerWithSettings(t, genesis.New(otherSettings))
+	defer stopOtherServer()
+
+	m1 := startTestMiner(t, serverAddr)
+	defer m1.Stop()
+	m2 := startTestMiner(t, otherServerAddr)
+	defer m2.Stop()
+
+	if m2.addPeer(m1.Addr()) || m1.addPeer(m2.Addr()) {
+		t.Error("Miners on different chains peered")
+	}
+	if Contains(m1.getPeerList(), m2.Addr()) || Contains(m2.getPeerList(), m1.Addr()) {
+		t.Error("Miners on different chains peered")
+	}
+}
+
+func TestMinersOnDifferentCurves(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	m1 := startTestMinerOnCurve(t, serverAddr, elliptic.P256())
+	m2 := startTestMinerOnCurve(t, serverAddr, elliptic.P521())
+
+	// P-521 signatures are slow, so the miners get a while to mine
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if m1.inkRemaining() > 0 && m2.inkRemaining() > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	m1.Stop()
+	m2.Stop()
+
+	if m1.inkRemaining() == 0 || m2.inkRemaining() == 0 {
+		t.Error("Expected both miners to mine no-op blocks")
+	}
+
+	// Blocks mined on either curve were verified and accepted by the other
+	// miner. m1 stopped first, so all of its blocks reached m2.
+	for hash, block := range m1.existingBlockHashes {
+		if _, ok := m2.existingBlockHashes[hash]; !ok && block.MinerKey.X != nil {
+			t.Error("Block mined by miner 1 missing from miner 2:", hash)
+		}
+	}
+	// m2 kept mining after m1 stopped, so only some of its blocks reached m1
+	fromM2 := 0
+	for _, block := range m1.existingBlockHashes {
+		if verification.EqualPublicKey(block.MinerKey, m2.PublicKey()) {
+			fromM2++
+		}
+	}
+	if fromM2 == 0 {
+		t.Error("No block mined by miner 2 reached miner 1")
+	}
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	m, err := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", AdvertiseAddr: "127.0.0.2", PrivateKey: priv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if m.Addr().IP.String() != "127.0.0.2" || m.Addr().Port != m.listener.Addr().(*net.TCPAddr).Port {
+		t.Error("Expected 127.0.0.2 with the listening port, got", m.Addr())
+	}
+
+	m2, _ := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", AdvertiseAddr: "0.0.0.0", PrivateKey: priv})
+	if err := m2.Start(context.Background()); err == nil {
+		m2.Stop()
+		t.Error("Expected an unspecified advertised address to fail")
+	}
+}
+
+func TestDataDirKeepsBlocks(t *testing.T) {
+	dataDir := t.TempDir()
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	config := Config{ListenAddr: "127.0.0.1:0", PrivateKey: priv, DataDir: dataDir, MiningThreads: 2}
+
+	serverAddr, stopServer := startTestServer(t)
+	config.ServerAddr = serverAddr
+	m, _ := New(config)
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	m.Stop()
+	stopServer()
+	tip := m.Chain()[len(m.Chain())-1].Hash
+
+	// A block whose hash was made up, added to the saved blocks by hand
+	path := filepath.Join(dataDir, blocksFile)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved savedBlocks
+	err = gob.NewDecoder(file).Decode(&saved)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := shared.Block{PreviousBlockHash: tip, IsNoopBlock: true, MinerKey: wireKey(priv.PublicKey), Hash: "fake000000", Timestamp: saved.Blocks[tip].Timestamp}
+	saved.Blocks[forged.Hash] = forged
+	saved.Tip = forged.Hash
+	file, err = os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(file).Encode(saved)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new network in which the restarted miner has no peers
+	serverAddr, stopServer = startTestServer(t)
+	defer stopServer()
+	config.ServerAddr = serverAddr
+	restarted, _ := New(config)
+	if err := restarted.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+
+	restarted.blockChainThread.RLock()
+	_, ok := restarted.existingBlockHashes[tip]
+	_, kept := restarted.existingBlockHashes[forged.Hash]
+	restarted.blockChainThread.RUnlock()
+	if !ok {
+		t.Error("Restarted miner lost the saved tip", tip)
+	}
+	if kept {
+		t.Error("Restarted miner kept a saved block with a forged hash")
+	}
+}
+
+func TestFindSecretParallel(t *testing.T) {
+	_, hash, ok := FindSecretParallel(context.Background(), "block", 3, 4)
+	if !ok || !strings.HasSuffix(hash, "000") {
+		t.Error("Expected a hash ending in 000, got", hash, ok)
+	}
+}
+
+// Scrapes the miner's metrics endpoint into a map from metric, with its
+// labels, to value.
+func scrapeMetrics(t *testing.T, m *Miner) map[string]float64 {
+	resp, err := http.Get("http://" + m.MetricsAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatal("Bad metrics line:", line)
+		}
+		values[line[:i]] = value
+	}
+	return values
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	m, err := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", PrivateKey: priv, MetricsAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	// A block whose hash does not match its contents
+	client, err := rpc.Dial("tcp", m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	bad := shared.Block{PreviousBlockHash: m.minerNetSettings.GenesisBlockHash, MinerKey: m.PublicKey(), Hash: "bad", IsNoopBlock: true}
+	var verified bool
+	if err := client.Call("MinerRPC.FloodBlock", bad, &verified); err != nil || verified {
+		t.Fatal("Expected the bad block to be rejected", err)
+	}
+
+	values := scrapeMetrics(t, m)
+	for _, name := range []string{"blockart_hashes_total", `blockart_blocks_mined_total{kind="noop"}`, "blockart_chain_height", "blockart_ink"} {
+		if values[name] <= 0 {
+			t.Error("Expected", name, "to be positive, got", values[name])
+		}
+	}
+	if values[`blockart_blocks_rejected_total{check="VerifyProofOfWork"}`] != 1 {
+		t.Error("Expected one block rejected by VerifyProofOfWork, got", values)
+	}
+	for _, name := range []string{"blockart_hash_rate", `blockart_blocks_mined_total{kind="op"}`, "blockart_blocks_received_total", "blockart_forks_total", "blockart_reorgs_total", "blockart_op_pool_size", "blockart_peers"} {
+		if _, ok := values[name]; !ok {
+			t.Error("Missing metric", name)
+		}
+	}
+}
+
+// Fetches path from the miner's block explorer.
+func getExplorerPage(t *testing.T, m *Miner, path string) (int, string) {
+	resp, err := http.Get("http://" + m.ExplorerAddr().String() + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestExplorer(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	m, err := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", PrivateKey: priv, ExplorerAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	const d = "M 0 0 L 10 10"
+	op := shared.Operation{
+		AppShapeOp:       "<path d=\"" + d + "\" stroke=\"red\" fill=\"transparent\"/>",
+		Fill:             "transparent",
+		Stroke:           "red",
+		DAttribute:       d,
+		NumBlockValidate: 1,
+		InkCost:          blockartlib.CalculateInkUsed(blockartlib.PATH, d, "transparent", "red"),
+		ArtNodeKey:       m.PublicKey(),
+		TraceID:          "explorer-trace",
+	}
+	op.R, op.S, _ = ecdsa.Sign(rand.Reader, priv, op.SignedBytes())
+	shapeHash := op.ContentHash()
+	for m.inkRemaining() < op.InkCost {
+		time.Sleep(10 * time.Millisecond)
+	}
+	blockHash, refused := m.AddOperationHelper(op)
+	if blockHash == "" {
+		t.Fatal("AddOperationHelper failed:", refused)
+	}
+
+	status, body := getExplorerPage(t, m, "/")
+	if status != http.StatusOK || !strings.Contains(body, "/block/"+blockHash) || !strings.Contains(body, logging.KeyPrefix(priv.PublicKey)) {
+		t.Error("Block tree does not link the op block or show the miner's ink:", status)
+	}
+
+	status, body = getExplorerPage(t, m, "/block/"+blockHash)
+	for _, want := range []string{"/shape/" + shapeHash, `<path d="M 0 0 L 10 10" fill="transparent" stroke="red"/>`, "explorer-trace", verification.EncodePublicKey(priv.PublicKey)} {
+		if status != http.StatusOK || !strings.Contains(body, want) {
+			t.Error("Block page is missing", want)
+		}
+	}
+
+	status, body = getExplorerPage(t, m, "/shape/"+shapeHash)
+	if status != http.StatusOK || !strings.Contains(body, "On the canvas at the tip") || !strings.Contains(body, "/block/"+blockHash) {
+		t.Error("Shape page does not show the shape's history")
+	}
+
+	status, body = getExplorerPage(t, m, "/canvas.svg")
+	if status != http.StatusOK || !strings.Contains(body, `d="M 0 0 L 10 10"`) {
+		t.Error("Canvas is missing the shape:", body)
+	}
+
+	if status, _ := getExplorerPage(t, m, "/block/unknown"); status != http.StatusNotFound {
+		t.Error("Expected 404 for an unknown block, got", status)
+	}
+}
+
+// Posts request to the gateway and decodes its JSON reply.
+func postGateway(t *testing.T, m *Miner, path string, request map[string]interface{}) (int, map[string]interface{}) {
+	body, _ := json.Marshal(request)
+	resp, err := http.Post("http://"+m.GatewayAddr().String()+path, "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(path, err)
+	}
+	return resp.StatusCode, reply
+}
+
+// Returns the error code of a gateway reply, or "".
+func gatewayCode(reply map[string]interface{}) string {
+	e, _ := reply["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+func signHex(t *testing.T, priv *ecdsa.PrivateKey, message []byte) string {
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(sig)
+}
+
+func TestGateway(t *testing.T) {
+	serverAddr, stopServer := startTestServer(t)
+	defer stopServer()
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	m, err := New(Config{ServerAddr: serverAddr, ListenAddr: "127.0.0.1:0", PrivateKey: priv, GatewayAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	_, reply := postGateway(t, m, "/v1/challenge", nil)
+	challenge, _ := hex.DecodeString(reply["challenge"].(string))
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	status, reply := postGateway(t, m, "/v1/open", map[string]interface{}{"challenge": hex.EncodeToString(challenge), "signature": signHex(t, other, challenge)})
+	if status != http.StatusUnauthorized || gatewayCode(reply) != "invalid-key-pair" {
+		t.Error("Expected invalid-key-pair for another key, got", status, reply)
+	}
+	status, reply = postGateway(t, m, "/v1/open", map[string]interface{}{"challenge": hex.EncodeToString(challenge), "signature": signHex(t, priv, challenge)})
+	if gatewayCode(reply) != "unknown-challenge" {
+		t.Error("Expected a challenge to be single-use, got", status, reply)
+	}
+
+	_, reply = postGateway(t, m, "/v1/challenge", map[string]interface{}{})
+	challenge, _ = hex.DecodeString(reply["challenge"].(string))
+	status, reply = postGateway(t, m, "/v1/open", map[string]interface{}{"challenge": hex.EncodeToString(challenge), "signature": signHex(t, priv, challenge)})
+	if status != http.StatusOK {
+		t.Fatal("Cannot open a canvas:", reply)
+	}
+	session := reply["session"].(string)
+
+	if status, reply := postGateway(t, m, "/v1/ink", map[string]interface{}{"session": "unknown"}); status != http.StatusUnauthorized || gatewayCode(reply) != "invalid-session" {
+		t.Error("Expected invalid-session, got", status, reply)
+	}
+	if status, reply := postGateway(t, m, "/v1/ink", map[string]interface{}{"sesion": session}); status != http.StatusBadRequest || gatewayCode(reply) != "bad-request" {
+		t.Error("Expected bad-request for an unknown field, got", status, reply)
+	}
+
+	const d = "M 0 0 L 10 10"
+	inkCost := blockartlib.CalculateInkUsed(blockartlib.PATH, d, "transparent", "red")
+	for m.inkRemaining() < inkCost {
+		time.Sleep(10 * time.Millisecond)
+	}
+	shape := map[string]interface{}{"session": session, "validate-num": 1, "d": d, "fill": "transparent", "stroke": "red", "signature": signHex(t, priv, []byte("M 0 0 L 5 5"))}
+	if status, reply := postGateway(t, m, "/v1/add-shape", shape); status != http.StatusBadRequest || gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature, got", status, reply)
+	}
+	shape["d"] = "M 0 0 Q 10 10"
+	if _, reply := postGateway(t, m, "/v1/add-shape", shape); gatewayCode(reply) != "invalid-shape-svg-string" {
+		t.Error("Expected invalid-shape-svg-string, got", reply)
+	}
+
+	shape["d"] = d
+	shape["signature"] = signHex(t, priv, []byte(d))
+	if status, reply := postGateway(t, m, "/v1/add-shape", shape); status != http.StatusBadRequest || gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature for a shape signing only its d, got", status, reply)
+	}
+	shape["signature"] = signHex(t, priv, shared.Operation{DAttribute: d, Fill: "transparent", Stroke: "red", ShapeType: int(blockartlib.PATH)}.SignedBytes())
+	shape["fill"] = "red"
+	if status, reply := postGateway(t, m, "/v1/add-shape", shape); status != http.StatusBadRequest || gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature for a shape restyled after it was signed, got", status, reply)
+	}
+	shape["fill"] = "transparent"
+	status, reply = postGateway(t, m, "/v1/add-shape", shape)
+	if status != http.StatusOK {
+		t.Fatal("Cannot add a shape:", reply)
+	}
+	shapeHash, blockHash := reply["shape-hash"].(string), reply["block-hash"].(string)
+
+	_, reply = postGateway(t, m, "/v1/svg-string", map[string]interface{}{"session": session, "shape-hash": shapeHash})
+	if reply["svg-string"] != `<path d="M 0 0 L 10 10" stroke="red" fill="transparent"/>` {
+		t.Error("Unexpected svg string:", reply)
+	}
+	_, reply = postGateway(t, m, "/v1/shapes", map[string]interface{}{"session": session, "block-hash": blockHash})
+	if hashes, _ := reply["shape-hashes"].([]interface{}); len(hashes) != 1 || hashes[0] != shapeHash {
+		t.Error("Block does not hold the shape:", reply)
+	}
+	if status, reply := postGateway(t, m, "/v1/children", map[string]interface{}{"session": session, "block-hash": "unknown"}); status != http.StatusNotFound || gatewayCode(reply) != "invalid-block-hash" {
+		t.Error("Expected invalid-block-hash, got", status, reply)
+	}
+	_, reply = postGateway(t, m, "/v1/genesis-block", map[string]interface{}{"session": session})
+	if reply["block-hash"] != m.minerNetSettings.GenesisBlockHash {
+		t.Error("Unexpected genesis block:", reply)
+	}
+
+	deletion := map[string]interface{}{"session": session, "validate-num": 1, "shape-hash": shapeHash, "signature": signHex(t, priv, []byte(d))}
+	if status, reply := postGateway(t, m, "/v1/delete-shape", deletion); status != http.StatusBadRequest || gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature for a delete signing the shape's d, got", status, reply)
+	}
+	deletion["signature"] = signHex(t, priv, shared.Operation{IsDelete: true, ShapeHash: shapeHash}.SignedBytes())
+	status, reply = postGateway(t, m, "/v1/delete-shape", deletion)
+	if status != http.StatusOK {
+		t.Error("Cannot delete the shape:", reply)
+	}
+	if _, reply := postGateway(t, m, "/v1/delete-shape", map[string]interface{}{"session": session, "shape-hash": "unknown", "signature": signHex(t, priv, []byte(d))}); gatewayCode(reply) != "invalid-shape-hash" {
+		t.Error("Expected invalid-shape-hash, got", reply)
+	}
+
+	gift := shared.Operation{IsTransfer: true, InkCost: 0, TransferTo: other.PublicKey}
+	transfer := map[string]interface{}{"session": session, "to": EncodePublicKey(other.PublicKey), "amount": gift.InkCost, "signature": signHex(t, priv, gift.SignedBytes())}
+	if status, reply := postGateway(t, m, "/v1/transfer-ink", transfer); status != http.StatusBadRequest || gatewayCode(reply) != "invalid-transfer" {
+		t.Error("Expected invalid-transfer for no ink, got", status, reply)
+	}
+	gift.InkCost = 1
+	transfer["amount"] = gift.InkCost
+	if _, reply := postGateway(t, m, "/v1/transfer-ink", transfer); gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature for a changed amount, got", reply)
+	}
+	transfer["signature"] = signHex(t, priv, gift.SignedBytes())
+	if status, reply := postGateway(t, m, "/v1/transfer-ink", transfer); status != http.StatusOK {
+		t.Error("Cannot transfer ink:", reply)
+	}
+
+	give := shared.Operation{IsGive: true, ShapeHash: shapeHash, TransferTo: other.PublicKey}
+	owners := map[string]interface{}{"session": session, "shape-hash": give.ShapeHash, "to": EncodePublicKey(other.PublicKey), "signature": signHex(t, priv, give.SignedBytes())}
+	if status, reply := postGateway(t, m, "/v1/give-shape", owners); status != http.StatusNotFound || gatewayCode(reply) != "invalid-shape-hash" {
+		t.Error("Expected invalid-shape-hash giving a deleted shape, got", status, reply)
+	}
+	if _, reply := postGateway(t, m, "/v1/share-shape", owners); gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature sharing with a give's signature, got", reply)
+	}
+
+	claim := shared.Operation{IsClaim: true, Layer: "middle", Region: shared.Region{MaxX: 10, MaxY: 10}, ClaimBlocks: 5}
+	region := map[string]interface{}{"min-x": 0, "min-y": 0, "max-x": 10, "max-y": 10}
+	claimRequest := map[string]interface{}{"session": session, "layer": claim.Layer, "region": region, "blocks": claim.ClaimBlocks, "signature": signHex(t, priv, claim.SignedBytes())}
+	if status, reply := postGateway(t, m, "/v1/claim-region", claimRequest); status != http.StatusBadRequest || gatewayCode(reply) != "invalid-layer" {
+		t.Error("Expected invalid-layer for a layer the canvas does not have, got", status, reply)
+	}
+	claimRequest["blocks"] = 6
+	if _, reply := postGateway(t, m, "/v1/claim-region", claimRequest); gatewayCode(reply) != "invalid-signature" {
+		t.Error("Expected invalid-signature for a changed duration, got", reply)
+	}
+
+	if status, reply := postGateway(t, m, "/v1/close", map[string]interface{}{"session": session}); status != http.StatusOK {
+		t.Error("Cannot close the canvas:", reply)
+	}
+	if _, reply := postGateway(t, m, "/v1/ink", map[string]interface{}{"session": session}); gatewayCode(reply) != "invalid-session" {
+		t.Error("Expected invalid-session after close, got", reply)
+	}
+}
@@ -0,0 +1,286 @@
+package miner
+
+import (
+	"../shared"
+	"../verification"
+
+	"net"
+)
+
+// RPC service used between miners.
+type MinerRPC struct {
+	m *Miner
+}
+
+func (t *MinerRPC) Ping(message string, messageBack *string) error {
+	t.m.log.Debug("MinerRPC.Ping")
+	*messageBack = message
+	return nil
+}
+
+// Peers with a miner on the same chain spec. Miners with a different
+// genesis block hash are refused.
+func (t *MinerRPC) Connect(args shared.ConnectArgs, result *shared.ConnectReply) error {
+	t.m.log.Debug("MinerRPC.Connect", "peer", args.Addr)
+	if args.GenesisBlockHash != t.m.minerNetSettings.GenesisBlockHash {
+		return WrongChainError(args.GenesisBlockHash)
+	}
+	*result = shared.ConnectReply{Key: t.m.minerInfo.Key, GenesisBlockHash: t.m.minerNetSettings.GenesisBlockHash}
+	return nil
+}
+
+func (t *MinerRPC) ConnectToMe(addr *net.TCPAddr, result *bool) error {
+	t.m.peersLock.RLock()
+	_, ok := t.m.peers[addr.String()]
+	t.m.peersLock.RUnlock()
+
+	if !ok {
+		t.m.log.Debug("MinerRPC.ConnectToMe", "peer", addr)
+		t.m.addPeer(addr)
+	}
+
+	*result = true
+	return nil
+}
+
+// Returns the current Canvas, along with a map of current shapes in the blockchain
+// (shapeHash to Operation)
+func (t *MinerRPC) GetCurrentCanvas(requestStruct shared.CanvasRequestStruct, replyStruct *shared.CanvasRequestReplyStruct) (err error) {
+	t.m.blockChainThread.RLock()
+	defer t.m.blockChainThread.RUnlock()
+
+	blockChain := t.m.blockChain
+	replyStruct.Canvas = &blockChain
+	replyStruct.ShapeMap = copyShapes(t.m.allShapes)
+	return nil
+}
+
+func (t *MinerRPC) FloodOperation(op shared.Operation, result *bool) error {
+	op.ArtNodeKey = fixKeyCurve(op.ArtNodeKey)
+	op.PaidBy = fixKeyCurve(op.PaidBy)
+
+	// An op whose signature does not verify could never go in a block
+	if !verification.VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{op}}) {
+		t.m.log.Info("dropping operation with an invalid signature", "trace", op.TraceID, "shape", op.ShapeHash)
+		*result = true
+		return nil
+	}
+
+	// An invalid shape, transfer or claim is neither kept nor passed on, and
+	// a valid shape is charged what it costs and shapes, transfers and
+	// claims are hashed as ContentHash does whatever the sender claimed
+	if op.IsTransfer {
+		op.TransferTo = fixKeyCurve(op.TransferTo)
+		op.ShapeHash = op.ContentHash()
+		if refused := verification.CheckTransfer(op); refused.Code != shared.NoError {
+			t.m.log.Info("dropping invalid operation", "trace", op.TraceID, "transfer", op.ShapeHash, "reason", refused)
+			*result = true
+			return nil
+		}
+	} else if op.IsOwnerChange() {
+		// Whether the key owns the shape depends on the chain, and is
+		// checked when the op is put in a block
+		op.TransferTo = fixKeyCurve(op.TransferTo)
+	} else if op.IsClaim {
+		// So do the claims in the way
+		op.ShapeHash = op.ContentHash()
+		checked, refused := verification.CheckClaim(op, nil, t.m.minerNetSettings.CanvasSettings)
+		if refused.Code != shared.NoError {
+			t.m.log.Info("dropping invalid operation", "trace", op.TraceID, "claim", op.ShapeHash, "reason", refused)
+			*result = true
+			return nil
+		}
+		op = checked
+	} else if !op.IsDelete {
+		checked, refused := verification.CheckShape(op, t.m.minerNetSettings.CanvasSettings)
+		if refused.Code != shared.NoError {
+			t.m.log.Info("dropping invalid operation", "trace", op.TraceID, "shape", op.ShapeHash, "reason", refused)
+			*result = true
+			return nil
+		}
+		op = checked
+		if op.IsAdd() {
+			op.ShapeHash = op.ContentHash()
+		}
+	}
+
+	t.m.opsNotInBlockThread.Lock()
+	_, ok := t.m.opsNotInBlockThread.operations[opKey(op)]
+	if !ok {
+		t.m.opsNotInBlockThread.operations[opKey(op)] = op
+	}
+	t.m.opsNotInBlockThread.Unlock()
+
+	if !ok {
+		t.m.log.Debug("MinerRPC.FloodOperation", "trace", op.TraceID, "shape", op.ShapeHash)
+		for _, k := range t.m.getPeerList() {
+			// Flood neighnbours here
+			client, err := t.m.dial(k.String())
+			if err != nil {
+				t.m.log.Error("cannot connect to miner", "peer", k, "trace", op.TraceID)
+				continue
+			}
+
+			var res bool
+			err = client.Call("MinerRPC.FloodOperation", op, &res)
+			client.Close()
+			if err != nil {
+				t.m.log.Error("MinerRPC.FloodOperation failed", "peer", k, "trace", op.TraceID, "err", err)
+			}
+		}
+	}
+	*result = true
+	return nil
+}
+
+// Floods block between network and waits for a positive verification from each
+// peer before returning. The block is verified against the chain it extends,
+// which need not be the longest one.
+func (t *MinerRPC) FloodBlock(block shared.Block, result *bool) error {
+	fixBlockKeys(&block)
+
+	t.m.blockChainThread.RLock()
+	_, known := t.m.existingBlockHashes[block.Hash]
+	_, ok := t.m.blocksNotInChain.Blocks[block.Hash]
+	t.m.blockChainThread.RUnlock()
+	if known || ok {
+		*result = true
+		return nil
+	}
+
+	verified := t.m.fetchMissingAncestors(block)
+	if verified {
+		t.m.blockChainThread.Lock()
+		verified = t.m.verifyBlockLocked(block)
+		if verified {
+			t.m.blocksNotInChain.Blocks[block.Hash] = block
+		}
+		t.m.blockChainThread.Unlock()
+	}
+
+	if !verified {
+		t.m.log.Error("block failed verification", "block", block.Hash, "traces", traceIDs(block))
+		*result = false
+		return nil
+	}
+
+	for _, k := range t.m.getPeerList() {
+		client, err := t.m.dial(k.String())
+		if err != nil {
+			continue
+		}
+
+		var res bool
+		err = client.Call("MinerRPC.FloodBlock", block, &res)
+		client.Close()
+		if err != nil {
+			t.m.log.Error("MinerRPC.FloodBlock failed", "peer", k, "block", block.Hash, "err", err)
+		}
+	}
+	*result = true
+	return nil
+}
+
+// Floods a verified block through the network, adding it to the
+// blockchain of each miner it reaches
+func (t *MinerRPC) AddBlockFlood(block shared.Block, result *bool) error {
+	fixBlockKeys(&block)
+
+	t.m.blockChainThread.Lock()
+	_, ok := t.m.existingBlockHashes[block.Hash]
+	_, verified := t.m.blocksNotInChain.Blocks[block.Hash]
+	if !ok && verified {
+		t.m.addBlockLocked(block)
+	}
+	t.m.blockChainThread.Unlock()
+
+	if !ok {
+		// Blocks that missed the verification round, e.g. because this miner
+		// connected later, are verified now
+		if !verified && !t.m.receiveBlock(block) {
+			*result = false
+			return nil
+		}
+
+		for _, k := range t.m.getPeerList() {
+			client, err := t.m.dial(k.String())
+			if err != nil {
+				continue
+			}
+
+			var res bool
+			err = client.Call("MinerRPC.AddBlockFlood", block, &res)
+			client.Close()
+			if err != nil {
+				t.m.log.Error("MinerRPC.AddBlockFlood failed", "peer", k, "block", block.Hash, "err", err)
+			}
+		}
+	}
+	*result = true
+	return nil
+}
+
+// Returns a single block from the block tree, used to fill in the ancestors
+// of a block mined on a fork this miner has not seen.
+func (t *MinerRPC) GetBlock(hash string, result *shared.Block) error {
+	t.m.blockChainThread.RLock()
+	defer t.m.blockChainThread.RUnlock()
+
+	block, ok := t.m.existingBlockHashes[hash]
+	if !ok {
+		return NotFoundError(hash)
+	}
+	*result = block
+	return nil
+}
+
+func (t *MinerRPC) GetBlockChain(addr *net.TCPAddr, result *shared.BlockChainInit) error {
+	t.m.blockChainThread.RLock()
+	if t.m.haveChain {
+		*result = shared.BlockChainInit{
+			BlockChain:     t.m.blockChain,
+			PreviousHash:   t.m.prevHash,
+			AllShapes:      copyShapes(t.m.allShapes),
+			ExistingBlocks: copyBlocks(t.m.existingBlockHashes),
+		}
+		t.m.blockChainThread.RUnlock()
+		t.m.log.Debug("MinerRPC.GetBlockChain", "peer", addr)
+		return nil
+	}
+	t.m.blockChainThread.RUnlock()
+
+	for _, k := range t.m.getPeerList() {
+		if addr.String() != k.String() {
+			client, err := t.m.dial(k.String())
+			if err != nil {
+				t.m.log.Error("cannot connect to miner", "peer", k)
+				continue
+			}
+
+			var res shared.BlockChainInit
+			err = client.Call("MinerRPC.GetBlockChain", t.m.myAddr, &res)
+			client.Close()
+			if err == nil {
+				*result = res
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func copyShapes(shapes map[string]shared.Operation) map[string]shared.Operation {
+	result := make(map[string]shared.Operation, len(shapes))
+	for k, v := range shapes {
+		result[k] = v
+	}
+	return result
+}
+
+func copyBlocks(blocks map[string]shared.Block) map[string]shared.Block {
+	result := make(map[string]shared.Block, len(blocks))
+	for k, v := range blocks {
+		result[k] = v
+	}
+	return result
+}
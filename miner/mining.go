@@ -0,0 +1,545 @@
+package miner
+
+import (
+	"../collision"
+	"../shared"
+	"../verification"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"encoding/hex"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Function to flood the operation
+func (m *Miner) FloodOperation(op shared.Operation) bool {
+	var reply bool
+	(&MinerRPC{m}).FloodOperation(op, &reply)
+	return reply
+}
+
+// Function to flood the block
+func (m *Miner) FloodBlock(block shared.Block) (success bool) {
+	rpc := &MinerRPC{m}
+
+	var reply bool
+	rpc.FloodBlock(block, &reply)
+	if !reply {
+		return false
+	}
+
+	// Send out flooding notification to add to chain
+	var addBlock bool
+	rpc.AddBlockFlood(block, &addBlock)
+	return addBlock
+}
+
+// Returns the MD5 hash as a hex string for the (nonce + secret) value.
+func ComputeNonceSecretHash(nonce string, secret string) string {
+	h := md5.New()
+	h.Write([]byte(nonce + secret))
+	str := hex.EncodeToString(h.Sum(nil))
+	return str
+}
+
+// Once we have a transaction, we can't carry it out.
+// Gives up and returns ok == false once ctx is cancelled.
+func FindSecret(ctx context.Context, nonce string, n uint8) (nonce_val uint32, hash string, ok bool) {
+	return findSecretFrom(ctx, nonce, n, 0, 1, nil)
+}
+
+// Same as FindSecret, with threads goroutines each trying every threads-th
+// secret. Returns the first secret found by any of them.
+func FindSecretParallel(ctx context.Context, nonce string, n uint8, threads int) (nonce_val uint32, hash string, ok bool) {
+	return findSecretParallel(ctx, nonce, n, threads, nil)
+}
+
+// Searches for a secret on behalf of the miner, counting the hashes tried.
+func (m *Miner) findSecret(nonce string, n uint8) (nonce_val uint32, hash string, ok bool) {
+	return findSecretParallel(m.ctx, nonce, n, m.config.MiningThreads, &m.metrics.hashes)
+}
+
+// Same as FindSecretParallel, adding the number of hashes tried to hashes
+// unless it is nil.
+func findSecretParallel(ctx context.Context, nonce string, n uint8, threads int, hashes *atomic.Uint64) (nonce_val uint32, hash string, ok bool) {
+	if threads <= 1 {
+		return findSecretFrom(ctx, nonce, n, 0, 1, hashes)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		nonce uint32
+		hash  string
+		ok    bool
+	}
+	results := make(chan result, threads)
+	for t := 0; t < threads; t++ {
+		go func(start int) {
+			nonce_val, hash, ok := findSecretFrom(ctx, nonce, n, start, threads, hashes)
+			results <- result{nonce_val, hash, ok}
+		}(t)
+	}
+
+	for t := 0; t < threads; t++ {
+		if r := <-results; r.ok {
+			return r.nonce, r.hash, true
+		}
+	}
+	return 0, "", false
+}
+
+func findSecretFrom(ctx context.Context, nonce string, n uint8, start, stride int, hashes *atomic.Uint64) (nonce_val uint32, hash string, ok bool) {
+	re := regexp.MustCompile("0{" + strconv.Itoa(int(n)) + "}")
+
+	// Hashes are counted in batches to keep the atomic add out of the
+	// inner loop
+	tried := uint64(0)
+	count := func() {
+		if hashes != nil {
+			hashes.Add(tried)
+		}
+		tried = 0
+	}
+	defer count()
+
+	for i := start; i < math.MaxInt64; i += stride {
+		if (i-start)%(1024*stride) == 0 {
+			count()
+			if ctx.Err() != nil {
+				return 0, "", false
+			}
+		}
+		tried++
+		i_to_string := strconv.Itoa(i)
+		nonce_secret := ComputeNonceSecretHash(nonce, i_to_string)
+		val := int(n)
+		last_string := nonce_secret[len(nonce_secret)-val:]
+		if re.MatchString(last_string) {
+			return uint32(i), nonce_secret, true
+		}
+	}
+
+	return 0, "", false
+}
+
+func EncodePublicKey(key ecdsa.PublicKey) string {
+	return verification.EncodePublicKey(key)
+}
+
+// Generates Noop Blocks on top of the current chain until the miner is
+// stopped. Generation pauses while an op block is being mined.
+func (m *Miner) GenerateNoopBlock() {
+	defer m.wg.Done()
+
+	for m.ctx.Err() == nil {
+		m.noopThread.RLock()
+		run := m.noopThread.runNoopGeneration
+		m.noopThread.RUnlock()
+		if !run {
+			select {
+			case <-m.ctx.Done():
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue
+		}
+
+		m.blockChainThread.RLock()
+		b := shared.Block{PreviousBlockHash: m.prevHash, IsNoopBlock: true, MinerKey: m.minerInfo.Key, Timestamp: verification.Timestamp()}
+		blockChain := m.blockChain
+		m.blockChainThread.RUnlock()
+
+		blockString := ConvertBlockToString(b)
+		difficulty := verification.ExpectedDifficulty(b, blockChain, m.minerNetSettings)
+		nonce, hash, ok := m.findSecret(blockString, difficulty)
+		if !ok {
+			return
+		}
+
+		b.Nonce = nonce
+		b.Hash = hash
+
+		m.blockChainThread.RLock()
+		stale := b.PreviousBlockHash != m.prevHash
+		m.blockChainThread.RUnlock()
+		if stale {
+			// Someone else extended the chain while we were mining
+			continue
+		}
+
+		if m.FloodBlock(b) {
+			m.metrics.noopBlocksMined.Add(1)
+		}
+	}
+}
+
+// Picks the operations in the pool that can go into a block on top of the
+// canvas shapes: this miner's own operations first, then everyone else's in
+// shape hash order. Operations whose signature does not verify or that are
+// already on the chain, deletes, gives and shares of shapes that are not
+// there or not owned by their key, operations whose owner is out of ink
+// once the operations picked before them are paid for, shapes and claims
+// in a region another key holds and shapes that overlap the canvas or an
+// operation picked before them are left out.
+func (m *Miner) getOperationsToArrayToAddBlock(blockChain shared.Node, shapes map[string]shared.Operation) []shared.Operation {
+	m.opsNotInBlockThread.Lock()
+	pool := make([]shared.Operation, 0, len(m.opsNotInBlockThread.operations))
+	for _, op := range m.opsNotInBlockThread.operations {
+		pool = append(pool, op)
+	}
+	m.opsNotInBlockThread.Unlock()
+
+	sort.Slice(pool, func(i, j int) bool {
+		iMine := verification.EqualPublicKey(pool[i].ArtNodeKey, m.minerInfo.Key)
+		jMine := verification.EqualPublicKey(pool[j].ArtNodeKey, m.minerInfo.Key)
+		if iMine != jMine {
+			return iMine
+		}
+		return opKey(pool[i]) < opKey(pool[j])
+	})
+
+	shapes = copyShapes(shapes)
+	result := make([]shared.Operation, 0)
+	for _, op := range pool {
+		_, onCanvas := shapes[op.ShapeHash]
+		if (op.IsDelete || op.IsOwnerChange() || op.IsModify) != onCanvas {
+			continue
+		}
+		block := shared.Block{Operations: append(result[:len(result):len(result)], op)}
+		if !verification.VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{op}}) {
+			continue
+		}
+		if !verification.VerifyOperationsNotReplayed(block, blockChain) {
+			continue
+		}
+		if !verification.VerifyOperationShapes(shared.Block{Operations: []shared.Operation{op}}, m.minerNetSettings, shapes) {
+			continue
+		}
+		if !verification.VerifyRegionClaims(block, blockChain, m.minerNetSettings.CanvasSettings) {
+			continue
+		}
+		if !verification.VerifySufficientInkForOperationsInBlock(block, blockChain, m.minerNetSettings) {
+			continue
+		}
+		if intersect, _ := HasIntersection(op, shapes); intersect && !op.IsDelete {
+			continue
+		}
+		result = append(result, op)
+		applyOperations(shapes, []shared.Operation{op})
+	}
+	return result
+}
+
+// Mines an op block with the operations waiting in the pool on top of the
+// current tip and floods it. The block is mined again if the tip moves
+// while mining. Returns false if there was nothing to put in a block.
+func (m *Miner) GenerateOpBlock() (hash string, b shared.Block, success bool) {
+	m.opBlockLock.Lock()
+	defer m.opBlockLock.Unlock()
+
+	m.pauseNoopGeneration()
+	defer m.resumeNoopGeneration()
+
+	for m.ctx.Err() == nil {
+		m.blockChainThread.RLock()
+		b = shared.Block{PreviousBlockHash: m.prevHash, MinerKey: m.minerInfo.Key, Timestamp: verification.Timestamp()}
+		blockChain := m.blockChain
+		shapes := copyShapes(m.allShapes)
+		m.blockChainThread.RUnlock()
+
+		b.Operations = m.getOperationsToArrayToAddBlock(blockChain, shapes)
+		if len(b.Operations) == 0 {
+			return "", shared.Block{}, false
+		}
+
+		m.log.Debug("mining op block", "parent", b.PreviousBlockHash, "traces", traceIDs(b))
+		blockString := ConvertBlockToString(b)
+		difficulty := verification.ExpectedDifficulty(b, blockChain, m.minerNetSettings)
+		nonce, hash, ok := m.findSecret(blockString, difficulty)
+		if !ok {
+			break
+		}
+		b.Nonce = nonce
+		b.Hash = hash
+
+		m.blockChainThread.RLock()
+		stale := b.PreviousBlockHash != m.prevHash
+		m.blockChainThread.RUnlock()
+		if stale {
+			continue
+		}
+
+		// Adding the new block to the block chain
+		success = m.FloodBlock(b)
+		if success {
+			m.metrics.opBlocksMined.Add(1)
+		}
+		return hash, b, success
+	}
+	return "", shared.Block{}, false
+}
+
+// Outcome of an operation submitted by an art node.
+type opStatus int
+
+const (
+	// Not in any known block yet
+	opUnmined opStatus = iota
+	// In a block, but not followed by enough blocks on the longest chain
+	opPending
+	// Followed by at least NumBlockValidate blocks on the longest chain
+	opValidated
+	// Only in blocks that a longer chain left behind
+	opLost
+)
+
+// Reports where op is in the block tree. Blocks in ignore are treated as
+// if they did not contain op.
+func (m *Miner) opStatusLocked(op shared.Operation, ignore map[string]bool) (status opStatus, blockHash string) {
+	blockHash, confirmations := m.confirmationsLocked(op)
+	if confirmations >= int(op.NumBlockValidate) {
+		return opValidated, blockHash
+	}
+	if confirmations >= 0 {
+		return opPending, blockHash
+	}
+
+	status = opUnmined
+	for hash, block := range m.existingBlockHashes {
+		if ignore[hash] || !blockHasOperation(block, op) {
+			continue
+		}
+		if m.heights[hash] >= m.heights[m.prevHash] {
+			return opPending, hash
+		}
+		status = opLost
+	}
+	return status, ""
+}
+
+func blockHasOperation(block shared.Block, op shared.Operation) bool {
+	for _, v := range block.Operations {
+		if opKey(v) == opKey(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// Floods op and waits until it is in a block followed by op.NumBlockValidate
+// blocks on the longest chain, mining op blocks as needed. If the block
+// holding op is left behind by a longer chain, op is put back in the pool
+// unless it no longer fits on the canvas. Returns the hash of the block
+// holding op, or why op was refused. Returns neither if the miner stopped
+// first.
+func (m *Miner) submitOperation(op shared.Operation) (blockHash string, refused shared.ReplyError) {
+	m.log.Debug("submitting operation", "trace", op.TraceID, "shape", op.ShapeHash, "delete", op.IsDelete)
+	m.FloodOperation(op)
+
+	ignore := make(map[string]bool)
+	for m.ctx.Err() == nil {
+		m.blockChainThread.RLock()
+		status, hash := m.opStatusLocked(op, ignore)
+		m.blockChainThread.RUnlock()
+
+		switch status {
+		case opValidated:
+			return hash, refused
+
+		case opLost, opUnmined:
+			m.blockChainThread.RLock()
+			shape, onCanvas := m.allShapes[op.ShapeHash]
+			intersected, shapeHashCollided := HasIntersection(op, m.allShapes)
+			claimID, claimed := m.claimInTheWayLocked(op)
+			for hash, block := range m.existingBlockHashes {
+				if blockHasOperation(block, op) {
+					ignore[hash] = true
+				}
+			}
+			m.blockChainThread.RUnlock()
+
+			if op.IsDelete && !onCanvas {
+				return "", shared.NewReplyError(shared.InvalidShapeHash, op.ShapeHash)
+			}
+			if op.IsOwnerChange() {
+				if refused := verification.CheckOwnerChange(op, shape, onCanvas); refused.Code != shared.NoError {
+					return "", refused
+				}
+			}
+			if op.IsModify {
+				// Made again on the shape as it is now, which a modify
+				// that got in first may have changed
+				checked, refused := verification.CheckModify(op, shape, onCanvas, m.minerNetSettings.CanvasSettings)
+				if refused.Code != shared.NoError {
+					return "", refused
+				}
+				op = checked
+			}
+			if claimed {
+				return "", shared.NewReplyError(shared.RegionClaimed, claimID)
+			}
+			if !op.IsDelete && intersected {
+				m.log.Debug("shape intersects", "shape", shapeHashCollided, "trace", op.TraceID)
+				return "", shared.NewReplyError(shared.ShapeOverlap, shapeHashCollided)
+			}
+
+			m.opsNotInBlockThread.Lock()
+			m.opsNotInBlockThread.operations[opKey(op)] = op
+			m.opsNotInBlockThread.Unlock()
+
+			if _, _, ok := m.GenerateOpBlock(); !ok && m.ctx.Err() == nil && m.opWaiting(op) {
+				// op could not go into a block: it overlaps a shape added
+				// while mining, or the art node is out of ink
+				m.opsNotInBlockThread.Lock()
+				delete(m.opsNotInBlockThread.operations, opKey(op))
+				m.opsNotInBlockThread.Unlock()
+
+				m.blockChainThread.RLock()
+				intersected, shapeHashCollided := HasIntersection(op, m.allShapes)
+				shape, onCanvas := m.allShapes[op.ShapeHash]
+				claimID, claimed := m.claimInTheWayLocked(op)
+				m.blockChainThread.RUnlock()
+				if op.IsOwnerChange() {
+					if refused := verification.CheckOwnerChange(op, shape, onCanvas); refused.Code != shared.NoError {
+						return "", refused
+					}
+					return "", shared.NewReplyError(shared.InvalidOwner, op.ShapeHash)
+				}
+				if op.IsModify {
+					if _, refused := verification.CheckModify(op, shape, onCanvas, m.minerNetSettings.CanvasSettings); refused.Code != shared.NoError {
+						return "", refused
+					}
+				}
+				if op.IsDelete {
+					return "", shared.NewReplyError(shared.InvalidShapeHash, op.ShapeHash)
+				}
+				if claimed {
+					return "", shared.NewReplyError(shared.RegionClaimed, claimID)
+				}
+				if intersected {
+					return "", shared.NewReplyError(shared.ShapeOverlap, shapeHashCollided)
+				}
+				return "", shared.NewReplyError(shared.InsufficientInk, "")
+			}
+		}
+
+		select {
+		case <-m.ctx.Done():
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return "", refused
+}
+
+// Whether op was submitted before: it is waiting in the pool or is in a
+// block, on the longest chain or not.
+func (m *Miner) operationKnown(op shared.Operation) bool {
+	if m.opWaiting(op) {
+		return true
+	}
+
+	m.blockChainThread.RLock()
+	defer m.blockChainThread.RUnlock()
+	for _, block := range m.existingBlockHashes {
+		if blockHasOperation(block, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether op is still in the pool of operations waiting for a block.
+func (m *Miner) opWaiting(op shared.Operation) bool {
+	m.opsNotInBlockThread.Lock()
+	defer m.opsNotInBlockThread.Unlock()
+	_, ok := m.opsNotInBlockThread.operations[opKey(op)]
+	return ok
+}
+
+// Converts the entire block into a string so that it can be used in hashing of computation of the nonce
+func ConvertBlockToString(b shared.Block) string {
+	eMKey := EncodePublicKey(b.MinerKey)
+	opString := ""
+	for i := 0; i < len(b.Operations); i++ {
+		opString = opString + b.Operations[i].AppShapeOp + b.Operations[i].R.String() + b.Operations[i].S.String()
+	}
+	return b.PreviousBlockHash + opString + eMKey + strconv.FormatInt(b.Timestamp, 10)
+}
+
+// Checks if there are any intersections with the shapes on the current canvas and the one to
+// be added onto the canvas
+func HasIntersection(op shared.Operation, shapes map[string]shared.Operation) (bool, string) {
+	return collision.CollideWithOtherShapes(op, shapes)
+}
+
+// Stops no-op generation while an op block is mined.
+func (m *Miner) pauseNoopGeneration() {
+	m.noopThread.Lock()
+	m.noopThread.runNoopGeneration = false
+	m.noopThread.Unlock()
+}
+
+func (m *Miner) resumeNoopGeneration() {
+	m.noopThread.Lock()
+	m.noopThread.runNoopGeneration = true
+	m.noopThread.Unlock()
+}
+
+// Attemps to add a new operation to the block - returns the block hash if
+// valid. Valid means that it was signed with the miner's key, does not
+// intersect with any other shapes, is not in a region another key holds
+// and that there is enough ink for the miner to draw the shape. Otherwise
+// returns why it was refused.
+// Returns once the operation has op.NumBlockValidate blocks after it.
+// An added shape gets the hash ContentHash derives, whatever op.ShapeHash
+// is.
+func (m *Miner) AddOperationHelper(op shared.Operation) (blockHash string, refused shared.ReplyError) {
+	if !verification.EqualPublicKey(op.ArtNodeKey, m.minerInfo.Key) {
+		// It was not signed with the correct key
+		return "", shared.NewReplyError(shared.InvalidKeyPair, "")
+	}
+	if op.IsAdd() {
+		op.ShapeHash = op.ContentHash()
+	}
+
+	// check intersections
+	m.blockChainThread.RLock()
+	intersected, shapeHashCollided := HasIntersection(op, m.allShapes)
+	claimID, claimed := m.claimInTheWayLocked(op)
+	m.blockChainThread.RUnlock()
+
+	if claimed {
+		return "", shared.NewReplyError(shared.RegionClaimed, claimID)
+	}
+	if intersected {
+		m.log.Debug("shape intersects", "shape", shapeHashCollided, "trace", op.TraceID)
+		return "", shared.NewReplyError(shared.ShapeOverlap, shapeHashCollided)
+	}
+
+	return m.submitOperation(op)
+}
+
+// Deletes the shape op.ShapeHash, which must be on the canvas and be owned
+// or co-owned by the miner's key. Returns the block hash, or why it was
+// refused.
+func (m *Miner) DeleteOperationHelper(op shared.Operation) (blockHash string, refused shared.ReplyError) {
+	if !m.operationKnown(op) {
+		m.blockChainThread.RLock()
+		shape, onCanvas := m.allShapes[op.ShapeHash]
+		m.blockChainThread.RUnlock()
+		if !onCanvas {
+			return "", shared.NewReplyError(shared.InvalidShapeHash, op.ShapeHash)
+		}
+		if !shape.OwnedBy(op.ArtNodeKey) {
+			return "", shared.NewReplyError(shared.ShapeOwner, op.ShapeHash)
+		}
+	}
+	return m.submitOperation(op)
+}
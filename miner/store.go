@@ -0,0 +1,93 @@
+package miner
+
+import (
+	"../shared"
+
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// File in Config.DataDir that the block tree is saved to.
+const blocksFile = "blocks.gob"
+
+// The block tree as saved in the data dir.
+type savedBlocks struct {
+	GenesisBlockHash string
+	Tip              string
+	Blocks           map[string]shared.Block
+}
+
+// Saves every known block to the data dir, if there is one, so that a
+// restarted miner does not start again from the genesis block when it has
+// no peers.
+func (m *Miner) saveBlocks() error {
+	if m.config.DataDir == "" {
+		return nil
+	}
+
+	m.blockChainThread.RLock()
+	if !m.haveChain {
+		m.blockChainThread.RUnlock()
+		return nil
+	}
+	saved := savedBlocks{
+		GenesisBlockHash: m.minerNetSettings.GenesisBlockHash,
+		Tip:              m.prevHash,
+		Blocks:           copyBlocks(m.existingBlockHashes),
+	}
+	m.blockChainThread.RUnlock()
+
+	if err := os.MkdirAll(m.config.DataDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(m.config.DataDir, blocksFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(saved); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Loads the blocks saved in the data dir. Returns false if there are none
+// for this miner's chain.
+func (m *Miner) loadBlocksLocked() (bool, error) {
+	if m.config.DataDir == "" {
+		return false, nil
+	}
+
+	file, err := os.Open(filepath.Join(m.config.DataDir, blocksFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var saved savedBlocks
+	if err := gob.NewDecoder(file).Decode(&saved); err != nil {
+		return false, fmt.Errorf("%s: %s", file.Name(), err)
+	}
+	if saved.GenesisBlockHash != m.minerNetSettings.GenesisBlockHash {
+		m.log.Info("ignoring blocks saved for another chain", "file", file.Name())
+		return false, nil
+	}
+	if _, ok := saved.Blocks[saved.GenesisBlockHash]; !ok {
+		return false, fmt.Errorf("%s: genesis block missing", file.Name())
+	}
+
+	// Checked again in case the file was edited, which also picks the tip
+	// again rather than trusting the saved one
+	if dropped := m.replayBlocksLocked(saved.Blocks); dropped > 0 {
+		m.log.Info("dropped saved blocks that fail verification", "file", file.Name(), "blocks", dropped)
+	}
+	return true, nil
+}
@@ -0,0 +1,187 @@
+package rserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A registered miner as shown to operators. Keys are the hex encoding of
+// the marshalled public key, the same as in the registry file.
+type MinerStatus struct {
+	Key           string    `json:"key"`
+	Address       string    `json:"address"`
+	LastHeartbeat time.Time `json:"last-heartbeat"`
+}
+
+// Admin RPC service for operators. It is served on its own listener so
+// that miners cannot reach it.
+type Admin struct {
+	s *RServer
+}
+
+// Serves the Admin RPCs on l until l is closed.
+func (s *RServer) ServeAdmin(l net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Admin", &Admin{s}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// Returns the registered miners, sorted by address.
+func (a *Admin) ListMiners(_ignored bool, reply *[]MinerStatus) error {
+	a.s.allMiners.RLock()
+	defer a.s.allMiners.RUnlock()
+
+	miners := make([]MinerStatus, 0, len(a.s.allMiners.all))
+	for k, miner := range a.s.allMiners.all {
+		miners = append(miners, MinerStatus{
+			Key:           hex.EncodeToString([]byte(k)),
+			Address:       miner.Address.String(),
+			LastHeartbeat: time.Unix(0, miner.RecentHeartbeat).UTC(),
+		})
+	}
+	sort.Slice(miners, func(i, j int) bool { return miners[i].Address < miners[j].Address })
+	*reply = miners
+	return nil
+}
+
+// Returns, for each miner key, the keys of the miners GetNodes returned
+// to it.
+func (a *Admin) PeerGraph(_ignored bool, reply *map[string][]string) error {
+	a.s.allMiners.RLock()
+	defer a.s.allMiners.RUnlock()
+
+	graph := make(map[string][]string, len(a.s.told))
+	for k, told := range a.s.told {
+		peers := make([]string, 0, len(told))
+		for peer := range told {
+			peers = append(peers, hex.EncodeToString([]byte(peer)))
+		}
+		sort.Strings(peers)
+		graph[hex.EncodeToString([]byte(k))] = peers
+	}
+	*reply = graph
+	return nil
+}
+
+// Removes the miner with the hex encoded key. Its next heartbeat fails,
+// and a miner that is still running registers again.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this key.
+func (a *Admin) Evict(key string, _ignored *bool) error {
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return unknownKeyError
+	}
+
+	a.s.allMiners.Lock()
+	defer a.s.allMiners.Unlock()
+
+	miner, ok := a.s.allMiners.all[string(k)]
+	if !ok {
+		return unknownKeyError
+	}
+	a.s.removeMinerLocked(string(k), Evicted)
+
+	a.s.log.Info("miner evicted", "addr", miner.Address)
+	return nil
+}
+
+// Changes the number of miners GetNodes returns.
+func (a *Admin) SetNumMinerToReturn(n uint8, _ignored *bool) error {
+	a.s.allMiners.Lock()
+	defer a.s.allMiners.Unlock()
+
+	a.s.config.NumMinerToReturn = n
+	a.s.log.Info("num-miner-to-return changed", "n", n)
+	return nil
+}
+
+// Returns the JSON HTTP version of the Admin service:
+//
+//	GET    /miners                  registered miners
+//	GET    /peers                   peer graph
+//	DELETE /miners/<key>            evict a miner
+//	PUT    /num-miner-to-return     {"num-miner-to-return": n}
+func (s *RServer) AdminHandler() http.Handler {
+	admin := &Admin{s}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/miners", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var miners []MinerStatus
+		admin.ListMiners(true, &miners)
+		writeJSON(w, miners)
+	})
+
+	mux.HandleFunc("/miners/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var ignored bool
+		if err := admin.Evict(strings.TrimPrefix(r.URL.Path, "/miners/"), &ignored); err != nil {
+			httpError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var graph map[string][]string
+		admin.PeerGraph(true, &graph)
+		writeJSON(w, graph)
+	})
+
+	mux.HandleFunc("/num-miner-to-return", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var body struct {
+			NumMinerToReturn *uint8 `json:"num-miner-to-return"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NumMinerToReturn == nil {
+			httpError(w, http.StatusBadRequest, "expected {\"num-miner-to-return\": n}")
+			return
+		}
+		var ignored bool
+		admin.SetNumMinerToReturn(*body.NumMinerToReturn, &ignored)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
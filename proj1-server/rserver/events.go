@@ -0,0 +1,54 @@
+package rserver
+
+// Reasons a miner leaves the server's set of miners.
+const (
+	TimedOut     = "timed-out"
+	Deregistered = "deregistered"
+	Evicted      = "evicted"
+)
+
+// Published when a miner leaves, e.g. so that the miners it was
+// connected to can be told that their neighbour died. Key is the hex
+// encoding of the marshalled public key.
+type ExpiryEvent struct {
+	Key     string `json:"key"`
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+}
+
+// Number of events a subscriber can fall behind before events are dropped
+// for it.
+const subscriberBuffer = 64
+
+// Returns a channel that receives an ExpiryEvent whenever a miner leaves,
+// and a function that ends the subscription and closes the channel.
+func (s *RServer) Subscribe() (<-chan ExpiryEvent, func()) {
+	events := make(chan ExpiryEvent, subscriberBuffer)
+
+	s.subscribersLock.Lock()
+	s.subscribers[events] = true
+	s.subscribersLock.Unlock()
+
+	cancel := func() {
+		s.subscribersLock.Lock()
+		defer s.subscribersLock.Unlock()
+		if s.subscribers[events] {
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+	return events, cancel
+}
+
+// Sends event to every subscriber without waiting for slow ones.
+func (s *RServer) publish(event ExpiryEvent) {
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+			s.log.Warn("dropped event: subscriber is behind", "reason", event.Reason, "addr", event.Address)
+		}
+	}
+}
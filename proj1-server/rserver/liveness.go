@@ -0,0 +1,142 @@
+package rserver
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// When a miner's next heartbeat is due, as an entry of expiryHeap.
+type expiry struct {
+	key      string
+	deadline time.Time
+	index    int
+}
+
+// Min-heap of expiries by deadline (container/heap).
+type expiryHeap []*expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Tracks when every miner's heartbeat is due. A single goroutine sleeps
+// until the earliest deadline and calls expire with the key of each miner
+// whose deadline passed.
+type liveness struct {
+	sync.Mutex
+	heap    expiryHeap
+	entries map[string]*expiry
+	expire  func(k string)
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLiveness(expire func(k string)) *liveness {
+	l := &liveness{
+		entries: make(map[string]*expiry),
+		expire:  expire,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Sets the deadline of the miner with key k, adding it if needed.
+func (l *liveness) set(k string, deadline time.Time) {
+	l.Lock()
+	if e, ok := l.entries[k]; ok {
+		e.deadline = deadline
+		heap.Fix(&l.heap, e.index)
+	} else {
+		e = &expiry{key: k, deadline: deadline}
+		l.entries[k] = e
+		heap.Push(&l.heap, e)
+	}
+	l.Unlock()
+	l.poke()
+}
+
+// Stops tracking the miner with key k.
+func (l *liveness) remove(k string) {
+	l.Lock()
+	if e, ok := l.entries[k]; ok {
+		heap.Remove(&l.heap, e.index)
+		delete(l.entries, k)
+	}
+	l.Unlock()
+	l.poke()
+}
+
+// Stops the goroutine. No more miners are expired.
+func (l *liveness) stop() {
+	l.once.Do(func() { close(l.done) })
+}
+
+// Makes run look at the earliest deadline again.
+func (l *liveness) poke() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *liveness) run() {
+	for {
+		l.Lock()
+		now := time.Now()
+		var expired []string
+		for len(l.heap) > 0 && !l.heap[0].deadline.After(now) {
+			e := heap.Pop(&l.heap).(*expiry)
+			delete(l.entries, e.key)
+			expired = append(expired, e.key)
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if len(l.heap) > 0 {
+			timer = time.NewTimer(l.heap[0].deadline.Sub(now))
+			timeout = timer.C
+		}
+		l.Unlock()
+
+		// Called without the lock, since expire may set deadlines
+		for _, k := range expired {
+			l.expire(k)
+		}
+
+		select {
+		case <-timeout:
+		case <-l.wake:
+		case <-l.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package rserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A registration as stored in the registry file.
+type registryRecord struct {
+	// Hex of the marshalled public key
+	Key           string `json:"key"`
+	Network       string `json:"network"`
+	Address       string `json:"address"`
+	LastHeartbeat int64  `json:"last-heartbeat"`
+}
+
+// Reads the registrations saved in the registry file. Every miner gets
+// another grace window to send a heartbeat, since none could reach the
+// server while it was down. A missing file means no registrations.
+func (s *RServer) loadRegistry() error {
+	buffer, err := ioutil.ReadFile(s.config.RegistryFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var records []registryRecord
+	if err := json.Unmarshal(buffer, &records); err != nil {
+		return err
+	}
+
+	graceUntil := time.Now().Add(s.gracePeriod()).UnixNano()
+	for _, record := range records {
+		key, err := hex.DecodeString(record.Key)
+		if err != nil {
+			return err
+		}
+		addr, err := net.ResolveTCPAddr(record.Network, record.Address)
+		if err != nil {
+			return err
+		}
+		s.allMiners.all[string(key)] = &Miner{
+			Address:         addr,
+			RecentHeartbeat: record.LastHeartbeat,
+			GraceUntil:      graceUntil,
+		}
+		s.log.Info("miner reloaded", "addr", record.Address)
+	}
+	return nil
+}
+
+// Writes the registrations to the registry file. The file is replaced
+// atomically so that a crash never leaves half a registry behind. Must be
+// called with allMiners locked.
+func (s *RServer) saveRegistryLocked() {
+	if s.config.RegistryFile == "" {
+		return
+	}
+
+	records := make([]registryRecord, 0, len(s.allMiners.all))
+	for k, miner := range s.allMiners.all {
+		records = append(records, registryRecord{
+			Key:           hex.EncodeToString([]byte(k)),
+			Network:       miner.Address.Network(),
+			Address:       miner.Address.String(),
+			LastHeartbeat: miner.RecentHeartbeat,
+		})
+	}
+
+	buffer, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		s.log.Error("cannot encode registry", "err", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.config.RegistryFile), ".registry")
+	if err != nil {
+		s.log.Error("cannot save registry", "err", err)
+		return
+	}
+	_, err = tmp.Write(buffer)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.config.RegistryFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.log.Error("cannot save registry", "err", err)
+		return
+	}
+	s.lastSave = time.Now()
+}
+
+// How long reloaded miners have to send their first heartbeat.
+func (s *RServer) gracePeriod() time.Duration {
+	if s.config.RegistryGracePeriod > 0 {
+		return time.Duration(s.config.RegistryGracePeriod) * time.Millisecond
+	}
+	return 10 * time.Duration(s.config.MinerSettings.HeartBeat) * time.Millisecond
+}
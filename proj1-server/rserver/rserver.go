@@ -0,0 +1,467 @@
+/*
+
+Package rserver implements the BlockArt server RPC service. The server
+takes in settings from a Config. GetNodes returns up to a fixed number of
+miners ("num-miner-to-return" in the json config file), chosen by the
+strategy named by "peer-strategy": uniform random, topology-aware or
+least-connected.
+
+The miner settings handed out by Register come from the config or from a
+chain spec file, whose genesis block hash commits to the other settings.
+The server does not start with a chain spec whose hash does not.
+
+If a registry file is configured, registrations are saved to it and
+reloaded when the server starts again, so that a restart does not make
+every miner's heartbeat fail.
+
+Miners that miss a heartbeat are expired by a single liveness tracker that
+sleeps until the earliest deadline. Every miner that leaves is published
+to the channels returned by Subscribe.
+
+*/
+
+package rserver
+
+import (
+	"../../genesis"
+	"../../shared"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errors that the server could return.
+type UnknownKeyError error
+
+type KeyAlreadyRegisteredError string
+
+func (e KeyAlreadyRegisteredError) Error() string {
+	return fmt.Sprintf("BlockArt server: key already registered [%s]", string(e))
+}
+
+type AddressAlreadyRegisteredError string
+
+func (e AddressAlreadyRegisteredError) Error() string {
+	return fmt.Sprintf("BlockArt server: address already registered [%s]", string(e))
+}
+
+// Settings for a canvas in BlockArt.
+type CanvasSettings struct {
+	// Canvas dimensions
+	CanvasXMax uint32 `json:"canvas-x-max"`
+	CanvasYMax uint32 `json:"canvas-y-max"`
+
+	// Names of the layers above the base layer, from the bottom up
+	Layers []string `json:"layers,omitempty"`
+}
+
+// Settings for an instance of the BlockArt project/network.
+type MinerNetSettings struct {
+	// Hash of the very first (empty) block in the chain.
+	GenesisBlockHash string `json:"genesis-block-hash"`
+
+	// Name of the network, so that networks with the same settings have
+	// different genesis blocks.
+	ChainName string `json:"chain-name"`
+
+	// The minimum number of ink miners that an ink miner should be
+	// connected to.
+	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
+
+	// Mining ink reward per op and no-op blocks (>= 1)
+	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
+	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
+
+	// Number of milliseconds between heartbeat messages to the server.
+	HeartBeat uint32 `json:"heartbeat"`
+
+	// Proof of work difficulty: number of zeroes in prefix (>=0)
+	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
+	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
+
+	// Every RetargetWindow blocks (0 never) both difficulties go up by one
+	// if the last window was mined more than 4 times faster than
+	// TargetBlockTime milliseconds per block, or down by one if it was
+	// more than 4 times slower.
+	RetargetWindow  uint32 `json:"retarget-window"`
+	TargetBlockTime uint32 `json:"target-block-time"`
+
+	// Canvas settings
+	CanvasSettings CanvasSettings `json:"canvas-settings"`
+}
+
+type Config struct {
+	MinerSettings    MinerNetSettings `json:"miner-settings"`
+	RpcIpPort        string           `json:"rpc-ip-port"`
+	NumMinerToReturn uint8            `json:"num-miner-to-return"`
+
+	// Chain spec made by chain-spec.go to read MinerSettings from
+	// (miner-settings)
+	ChainSpecFile string `json:"chain-spec-file"`
+
+	// File to keep registrations in across restarts (none)
+	RegistryFile string `json:"registry-file"`
+
+	// Milliseconds reloaded miners have to send a heartbeat (10 heartbeats)
+	RegistryGracePeriod uint32 `json:"registry-grace-period"`
+
+	// GetNodes strategy (uniform-random)
+	PeerStrategy string `json:"peer-strategy"`
+
+	// Number of connections the topology strategy aims for per miner
+	// (num-miner-to-return)
+	TargetDegree uint8 `json:"target-degree"`
+
+	// Addresses of the Admin RPC service and its JSON HTTP version (none)
+	AdminRpcIpPort  string `json:"admin-rpc-ip-port"`
+	AdminHttpIpPort string `json:"admin-http-ip-port"`
+
+	// debug, info, warn or error (info). Log lines go to stderr tagged
+	// with component=server.
+	LogLevel string `json:"log-level"`
+}
+
+type MinerInfo struct {
+	Address net.Addr
+	Key     ecdsa.PublicKey
+}
+
+type Miner struct {
+	Address         net.Addr
+	RecentHeartbeat int64
+
+	// A miner reloaded from the registry file is not timed out before
+	// this time
+	GraceUntil int64
+}
+
+type AllMiners struct {
+	sync.RWMutex
+	all map[string]*Miner
+}
+
+var (
+	unknownKeyError UnknownKeyError = errors.New("BlockArt server: unknown key")
+)
+
+func init() {
+	gob.Register(&net.TCPAddr{})
+	gob.Register(&elliptic.CurveParams{})
+}
+
+type RServer struct {
+	// config.NumMinerToReturn can be changed through Admin and is
+	// guarded by allMiners
+	config Config
+	log    *slog.Logger
+
+	// Miners in the system.
+	allMiners AllMiners
+
+	strategy PeerStrategy
+
+	// Guarded by allMiners: when the registry file was last written, the
+	// miners each miner was told about, and the randomness for GetNodes
+	lastSave time.Time
+	told     PeerGraph
+	rand     *rand.Rand
+
+	// Expires miners that stop sending heartbeats
+	liveness *liveness
+
+	subscribersLock sync.Mutex
+	subscribers     map[chan ExpiryEvent]bool
+}
+
+// Checks settings against their genesis block hash. They go through JSON
+// to become the shared.MinerNetSettings that miners hash.
+func verifySettings(settings MinerNetSettings) error {
+	buffer, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	var spec shared.MinerNetSettings
+	if err := json.Unmarshal(buffer, &spec); err != nil {
+		return err
+	}
+	return genesis.Verify(spec)
+}
+
+// Creates a server for the given config, with the miners registered in
+// config.RegistryFile if there is one.
+func New(config Config) (*RServer, error) {
+	if config.ChainSpecFile != "" {
+		buffer, err := ioutil.ReadFile(config.ChainSpecFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buffer, &config.MinerSettings); err != nil {
+			return nil, fmt.Errorf("chain spec %s: %s", config.ChainSpecFile, err)
+		}
+	}
+	// Miners refuse settings their genesis block hash does not commit to,
+	// so tampered settings are refused here instead, from either source
+	if err := verifySettings(config.MinerSettings); err != nil {
+		if config.ChainSpecFile != "" {
+			return nil, fmt.Errorf("chain spec %s: %s", config.ChainSpecFile, err)
+		}
+		return nil, fmt.Errorf("miner-settings: %s", err)
+	}
+
+	var level slog.Level
+	if config.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return nil, fmt.Errorf("log-level: %s", err)
+		}
+	}
+
+	targetDegree := int(config.TargetDegree)
+	if targetDegree == 0 {
+		targetDegree = int(config.NumMinerToReturn)
+	}
+	strategy, err := newPeerStrategy(config.PeerStrategy, targetDegree)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RServer{
+		config:      config,
+		log:         slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})).With("component", "server"),
+		allMiners:   AllMiners{all: make(map[string]*Miner)},
+		strategy:    strategy,
+		told:        make(PeerGraph),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		subscribers: make(map[chan ExpiryEvent]bool),
+	}
+	if config.RegistryFile != "" {
+		if err := s.loadRegistry(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.liveness = newLiveness(s.expire)
+	for k, miner := range s.allMiners.all {
+		s.liveness.set(k, s.deadline(miner))
+	}
+	return s, nil
+}
+
+// Stops expiring miners. Serve returns when its listener is closed.
+func (s *RServer) Close() {
+	s.liveness.stop()
+}
+
+func (s *RServer) heartBeatInterval() time.Duration {
+	return time.Duration(s.config.MinerSettings.HeartBeat) * time.Millisecond
+}
+
+// Serves RServer RPCs on l until l is closed.
+func (s *RServer) Serve(l net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("RServer", s); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// When the miner times out unless it sends another heartbeat.
+func (s *RServer) deadline(miner *Miner) time.Time {
+	deadline := time.Unix(0, miner.RecentHeartbeat).Add(s.heartBeatInterval())
+	if grace := time.Unix(0, miner.GraceUntil); grace.After(deadline) {
+		return grace
+	}
+	return deadline
+}
+
+// Deletes the miner with key k if it has not sent a heartbeat in time.
+// Called by liveness once the miner's deadline passed.
+func (s *RServer) expire(k string) {
+	s.allMiners.Lock()
+	defer s.allMiners.Unlock()
+
+	miner, ok := s.allMiners.all[k]
+	if !ok {
+		// Deregistered
+		return
+	}
+	if deadline := s.deadline(miner); deadline.After(time.Now()) {
+		// A heartbeat came in while the miner was being expired
+		s.liveness.set(k, deadline)
+		return
+	}
+
+	s.log.Info("miner timed out", "addr", miner.Address)
+	s.removeMinerLocked(k, TimedOut)
+}
+
+func pubKeyToString(key ecdsa.PublicKey) string {
+	return string(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// Registers a new miner with an address for other miner to use to
+// connect to it (returned in GetNodes call below), and a
+// public-key for this miner. Returns error, or if error is not set,
+// then setting for this canvas instance.
+//
+// Returns:
+// - AddressAlreadyRegisteredError if the server has already registered this address.
+// - KeyAlreadyRegisteredError if the server already has a registration record for publicKey.
+func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
+	s.allMiners.Lock()
+	defer s.allMiners.Unlock()
+
+	k := pubKeyToString(m.Key)
+	if miner, exists := s.allMiners.all[k]; exists {
+		return KeyAlreadyRegisteredError(miner.Address.String())
+	}
+
+	for _, miner := range s.allMiners.all {
+		if miner.Address.Network() == m.Address.Network() && miner.Address.String() == m.Address.String() {
+			return AddressAlreadyRegisteredError(m.Address.String())
+		}
+	}
+
+	miner := &Miner{
+		Address:         m.Address,
+		RecentHeartbeat: time.Now().UnixNano(),
+	}
+	s.allMiners.all[k] = miner
+	s.liveness.set(k, s.deadline(miner))
+	s.saveRegistryLocked()
+
+	*r = s.config.MinerSettings
+
+	s.log.Info("RServer.Register", "addr", m.Address)
+
+	return nil
+}
+
+// Returns addresses for a subset of miners in the system, chosen by the
+// configured PeerStrategy. The server remembers which miners it returned.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
+
+	// TODO: validate miner's GetNodes protocol? (could monitor state
+	// of network graph/connectivity and validate protocol FSM)
+	s.log.Debug("RServer.GetNodes")
+	s.allMiners.Lock()
+	defer s.allMiners.Unlock()
+
+	k := pubKeyToString(key)
+
+	if _, ok := s.allMiners.all[k]; !ok {
+		return unknownKeyError
+	}
+
+	candidates := make([]string, 0, len(s.allMiners.all)-1)
+	for pubKey := range s.allMiners.all {
+		if pubKey != k {
+			candidates = append(candidates, pubKey)
+		}
+	}
+	// Map order is random, so sort to make strategies depend only on
+	// s.rand
+	sort.Strings(candidates)
+
+	selected := s.strategy.SelectPeers(k, candidates, s.told, int(s.config.NumMinerToReturn), s.rand)
+	s.told.add(k, selected)
+
+	minerAddresses := make([]net.Addr, len(selected))
+	for i, pubKey := range selected {
+		minerAddresses[i] = s.allMiners.all[pubKey].Address
+	}
+	*addrSet = minerAddresses
+
+	return nil
+}
+
+// The server also listens for heartbeats from known miners. A miner must
+// send a heartbeat to the server every HeartBeat milliseconds
+// (specified in settings from server) after calling Register, otherwise
+// the server will stop returning this miner's address/key to other
+// miners.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) HeartBeat(key ecdsa.PublicKey, _ignored *bool) error {
+	s.log.Debug("RServer.HeartBeat")
+	s.allMiners.Lock()
+	defer s.allMiners.Unlock()
+
+	k := pubKeyToString(key)
+	miner, ok := s.allMiners.all[k]
+	if !ok {
+		return unknownKeyError
+	}
+
+	miner.RecentHeartbeat = time.Now().UnixNano()
+	s.liveness.set(k, s.deadline(miner))
+
+	// Heartbeats are saved about once per interval rather than on every
+	// call
+	if time.Since(s.lastSave) >= s.heartBeatInterval() {
+		s.saveRegistryLocked()
+	}
+
+	return nil
+}
+
+// Removes a miner that is shutting down, so that the server stops
+// returning its address to other miners right away instead of waiting for
+// its heartbeats to time out.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) Deregister(key ecdsa.PublicKey, _ignored *bool) error {
+	s.allMiners.Lock()
+	defer s.allMiners.Unlock()
+
+	k := pubKeyToString(key)
+	miner, ok := s.allMiners.all[k]
+	if !ok {
+		return unknownKeyError
+	}
+	s.removeMinerLocked(k, Deregistered)
+
+	s.log.Info("RServer.Deregister", "addr", miner.Address)
+	return nil
+}
+
+// Forgets the miner with key k and tells subscribers why it left. Must be
+// called with allMiners locked.
+func (s *RServer) removeMinerLocked(k string, reason string) {
+	miner := s.allMiners.all[k]
+	delete(s.allMiners.all, k)
+	s.liveness.remove(k)
+	s.told.remove(k)
+	s.saveRegistryLocked()
+
+	s.publish(ExpiryEvent{
+		Key:     hex.EncodeToString([]byte(k)),
+		Address: miner.Address.String(),
+		Reason:  reason,
+	})
+}
@@ -0,0 +1,364 @@
+package rserver
+
+import (
+	"../../genesis"
+	"../../shared"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, registryFile string) *RServer {
+	s, err := New(Config{
+		MinerSettings:       testSettings(),
+		NumMinerToReturn:    2,
+		RegistryFile:        registryFile,
+		RegistryGracePeriod: 500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Returns heartbeat 50 settings with the genesis block hash miners expect.
+func testSettings() MinerNetSettings {
+	spec := genesis.New(shared.MinerNetSettings{ChainName: "test", HeartBeat: 50})
+	return MinerNetSettings{GenesisBlockHash: spec.GenesisBlockHash, ChainName: spec.ChainName, HeartBeat: spec.HeartBeat}
+}
+
+func register(t *testing.T, s *RServer, port int) ecdsa.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	var settings MinerNetSettings
+	if err := s.Register(MinerInfo{Address: addr, Key: priv.PublicKey}, &settings); err != nil {
+		t.Fatal(err)
+	}
+	return priv.PublicKey
+}
+
+func TestRegistrationsSurviveRestart(t *testing.T) {
+	registryFile := filepath.Join(t.TempDir(), "registry.json")
+
+	s := newTestServer(t, registryFile)
+	key1 := register(t, s, 1001)
+	key2 := register(t, s, 1002)
+	register(t, s, 1003)
+	var ignored bool
+	if err := s.Deregister(key2, &ignored); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestServer(t, registryFile)
+	if err := restarted.HeartBeat(key1, &ignored); err != nil {
+		t.Error("HeartBeat failed after the restart:", err)
+	}
+	if err := restarted.HeartBeat(key2, &ignored); err == nil {
+		t.Error("Deregistered miner is known after the restart")
+	}
+
+	var addrs []net.Addr
+	if err := restarted.GetNodes(key1, &addrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "127.0.0.1:1003" {
+		t.Error("Expected the other reloaded miner, got", addrs)
+	}
+}
+
+func TestReloadedMinerTimesOutAfterGracePeriod(t *testing.T) {
+	registryFile := filepath.Join(t.TempDir(), "registry.json")
+
+	s := newTestServer(t, registryFile)
+	key := register(t, s, 1001)
+
+	restarted := newTestServer(t, registryFile)
+	var ignored bool
+	time.Sleep(200 * time.Millisecond)
+	if err := restarted.HeartBeat(key, &ignored); err != nil {
+		t.Fatal("Reloaded miner timed out within the grace period:", err)
+	}
+
+	// Without heartbeats the miner is dropped like any other
+	time.Sleep(500 * time.Millisecond)
+	if err := restarted.HeartBeat(key, &ignored); err == nil {
+		t.Error("Reloaded miner did not time out")
+	}
+}
+
+func TestMissingRegistryFile(t *testing.T) {
+	s := newTestServer(t, filepath.Join(t.TempDir(), "registry.json"))
+	if len(s.allMiners.all) != 0 {
+		t.Error("Expected no miners, got", s.allMiners.all)
+	}
+}
+
+func TestUniformRandomStrategy(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d"}
+	r := mrand.New(mrand.NewSource(1))
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		selected := uniformRandom{}.SelectPeers("self", candidates, PeerGraph{}, 2, r)
+		if len(selected) != 2 || selected[0] == selected[1] {
+			t.Fatal("Expected two different miners, got", selected)
+		}
+		for _, k := range selected {
+			counts[k]++
+		}
+	}
+	for _, k := range candidates {
+		if counts[k] < 100 {
+			t.Error("Miner", k, "was picked", counts[k], "times out of 400")
+		}
+	}
+}
+
+func TestLeastConnectedStrategy(t *testing.T) {
+	graph := PeerGraph{}
+	graph.add("a", []string{"b", "c"})
+	graph.add("d", []string{"b"})
+
+	selected := leastConnected{}.SelectPeers("self", []string{"a", "b", "c", "d"}, graph, 2, mrand.New(mrand.NewSource(1)))
+	if len(selected) != 2 || selected[0] != "c" && selected[0] != "d" || selected[1] != "c" && selected[1] != "d" {
+		t.Error("Expected the least connected miners c and d, got", selected)
+	}
+}
+
+func TestTopologyStrategyBridgesPartitions(t *testing.T) {
+	// Two parts of the overlay that do not know about each other
+	graph := PeerGraph{}
+	graph.add("a", []string{"b"})
+	graph.add("c", []string{"d"})
+
+	selected := topology{targetDegree: 2}.SelectPeers("a", []string{"b", "c", "d"}, graph, 1, mrand.New(mrand.NewSource(1)))
+	if len(selected) != 1 || selected[0] != "c" && selected[0] != "d" {
+		t.Error("Expected a miner from the other part, got", selected)
+	}
+
+	// Within one part, stop at the target degree
+	graph.add("a", []string{"c"})
+	selected = topology{targetDegree: 2}.SelectPeers("a", []string{"b", "c", "d"}, graph, 3, mrand.New(mrand.NewSource(1)))
+	if len(selected) != 1 {
+		t.Error("Expected one miner to keep the degree near the target, got", selected)
+	}
+}
+
+func TestServerTracksToldMiners(t *testing.T) {
+	s := newTestServer(t, "")
+	key1 := register(t, s, 1001)
+	key2 := register(t, s, 1002)
+
+	var addrs []net.Addr
+	if err := s.GetNodes(key1, &addrs); err != nil {
+		t.Fatal(err)
+	}
+	k1, k2 := pubKeyToString(key1), pubKeyToString(key2)
+	if !s.told[k1][k2] {
+		t.Error("Server did not record that miner 1 was told about miner 2")
+	}
+
+	var ignored bool
+	if err := s.Deregister(key2, &ignored); err != nil {
+		t.Fatal(err)
+	}
+	if s.told[k1][k2] {
+		t.Error("Deregistered miner is still in the peer graph")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	s := newTestServer(t, "")
+	key1 := register(t, s, 1001)
+	key2 := register(t, s, 1002)
+	register(t, s, 1003)
+	admin := &Admin{s}
+
+	var miners []MinerStatus
+	if err := admin.ListMiners(true, &miners); err != nil {
+		t.Fatal(err)
+	}
+	if len(miners) != 3 || miners[0].Address != "127.0.0.1:1001" || miners[0].LastHeartbeat.IsZero() {
+		t.Fatal("Unexpected miners:", miners)
+	}
+
+	var ignored bool
+	if err := admin.SetNumMinerToReturn(1, &ignored); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []net.Addr
+	if err := s.GetNodes(key1, &addrs); err != nil || len(addrs) != 1 {
+		t.Error("Expected one miner from GetNodes, got", addrs, err)
+	}
+
+	var graph map[string][]string
+	if err := admin.PeerGraph(true, &graph); err != nil {
+		t.Fatal(err)
+	}
+	if len(graph[miners[0].Key]) != 1 {
+		t.Error("Expected miner 1 to have been told about one miner, got", graph)
+	}
+
+	if err := admin.Evict(miners[1].Key, &ignored); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HeartBeat(key2, &ignored); err == nil {
+		t.Error("Evicted miner is still registered")
+	}
+	if err := admin.Evict(miners[1].Key, &ignored); err == nil {
+		t.Error("Expected evicting an unknown miner to fail")
+	}
+}
+
+func TestAdminHTTP(t *testing.T) {
+	s := newTestServer(t, "")
+	register(t, s, 1001)
+	register(t, s, 1002)
+	server := httptest.NewServer(s.AdminHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/miners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var miners []MinerStatus
+	err = json.NewDecoder(resp.Body).Decode(&miners)
+	resp.Body.Close()
+	if err != nil || len(miners) != 2 {
+		t.Fatal("Unexpected miners:", miners, err)
+	}
+
+	request := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := request(http.MethodDelete, "/miners/"+miners[0].Key, ""); status != http.StatusNoContent {
+		t.Error("Evict returned", status)
+	}
+	if status := request(http.MethodDelete, "/miners/"+miners[0].Key, ""); status != http.StatusNotFound {
+		t.Error("Evicting an unknown miner returned", status)
+	}
+	if status := request(http.MethodPut, "/num-miner-to-return", `{"num-miner-to-return": 5}`); status != http.StatusNoContent {
+		t.Error("Setting num-miner-to-return returned", status)
+	}
+	if status := request(http.MethodPut, "/num-miner-to-return", `{}`); status != http.StatusBadRequest {
+		t.Error("Setting num-miner-to-return without a value returned", status)
+	}
+	if s.config.NumMinerToReturn != 5 {
+		t.Error("num-miner-to-return is", s.config.NumMinerToReturn)
+	}
+}
+
+func TestExpiryIsPublished(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.Close()
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	register(t, s, 1001)
+	select {
+	case event := <-events:
+		if event.Reason != TimedOut || event.Address != "127.0.0.1:1001" {
+			t.Error("Unexpected event", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Miner did not time out")
+	}
+}
+
+func TestReregisterAfterExpiry(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := MinerInfo{
+		Address: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001},
+		Key:     priv.PublicKey,
+	}
+	var settings MinerNetSettings
+	if err := s.Register(info, &settings); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	var ignored bool
+	if err := s.HeartBeat(priv.PublicKey, &ignored); err == nil {
+		t.Fatal("Miner did not time out")
+	}
+	if err := s.Register(info, &settings); err != nil {
+		t.Fatal("Register after expiry failed:", err)
+	}
+	if err := s.HeartBeat(priv.PublicKey, &ignored); err != nil {
+		t.Error("HeartBeat after re-registering failed:", err)
+	}
+}
+
+func TestChainSpecFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain-spec.json")
+	tampered := `{"genesis-block-hash": "abc", "chain-name": "test", "heartbeat": 50, "canvas-settings": {"canvas-x-max": 800}}`
+	if err := ioutil.WriteFile(path, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{ChainSpecFile: path}); err == nil {
+		t.Error("Expected a chain spec that does not match its genesis block hash to be refused")
+	}
+
+	spec := genesis.New(shared.MinerNetSettings{ChainName: "test", HeartBeat: 50, CanvasSettings: shared.CanvasSettings{CanvasXMax: 800}})
+	if err := genesis.Save(path, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(Config{ChainSpecFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var settings MinerNetSettings
+	info := MinerInfo{Address: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}, Key: priv.PublicKey}
+	if err := s.Register(info, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings.GenesisBlockHash != spec.GenesisBlockHash || settings.ChainName != "test" || settings.CanvasSettings.CanvasXMax != 800 {
+		t.Error("Expected the settings from the chain spec, got", settings)
+	}
+}
+
+func TestInlineMinerSettings(t *testing.T) {
+	settings := testSettings()
+	settings.InkPerOpBlock = 1000
+	if _, err := New(Config{MinerSettings: settings}); err == nil {
+		t.Error("Expected miner-settings that do not match their genesis block hash to be refused")
+	}
+
+	s, err := New(Config{MinerSettings: testSettings()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -0,0 +1,188 @@
+package rserver
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Names of the GetNodes strategies ("peer-strategy" in the json config
+// file).
+const (
+	UniformRandomStrategy  = "uniform-random"
+	TopologyStrategy       = "topology"
+	LeastConnectedStrategy = "least-connected"
+)
+
+// Chooses the miners GetNodes returns to a miner.
+type PeerStrategy interface {
+	// Returns up to n of candidates, the keys of every other registered
+	// miner, for the miner with key k. graph holds the miners each miner
+	// was told about so far.
+	SelectPeers(k string, candidates []string, graph PeerGraph, n int, r *rand.Rand) []string
+}
+
+// For each miner key, the keys of the miners GetNodes returned to it.
+type PeerGraph map[string]map[string]bool
+
+// Records that the miner with key k was told about peers.
+func (g PeerGraph) add(k string, peers []string) {
+	if g[k] == nil {
+		g[k] = make(map[string]bool)
+	}
+	for _, peer := range peers {
+		g[k][peer] = true
+	}
+}
+
+// Forgets the miner with key k.
+func (g PeerGraph) remove(k string) {
+	delete(g, k)
+	for _, told := range g {
+		delete(told, k)
+	}
+}
+
+// Miners connected to the one with key k in either direction. A miner
+// connects to the miners it is told about, so connections go both ways.
+func (g PeerGraph) neighbours(k string) map[string]bool {
+	neighbours := make(map[string]bool)
+	for peer := range g[k] {
+		neighbours[peer] = true
+	}
+	for other, told := range g {
+		if told[k] {
+			neighbours[other] = true
+		}
+	}
+	return neighbours
+}
+
+func (g PeerGraph) degree(k string) int {
+	return len(g.neighbours(k))
+}
+
+// Miners reachable from the one with key k.
+func (g PeerGraph) component(k string) map[string]bool {
+	seen := map[string]bool{k: true}
+	queue := []string{k}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for peer := range g.neighbours(next) {
+			if !seen[peer] {
+				seen[peer] = true
+				queue = append(queue, peer)
+			}
+		}
+	}
+	return seen
+}
+
+// Returns the strategy called name, the uniform random one by default.
+func newPeerStrategy(name string, targetDegree int) (PeerStrategy, error) {
+	switch name {
+	case "", UniformRandomStrategy:
+		return uniformRandom{}, nil
+	case TopologyStrategy:
+		return topology{targetDegree}, nil
+	case LeastConnectedStrategy:
+		return leastConnected{}, nil
+	}
+	return nil, fmt.Errorf("BlockArt server: unknown peer strategy [%s]", name)
+}
+
+// Returns n miners picked uniformly at random.
+type uniformRandom struct{}
+
+func (uniformRandom) SelectPeers(k string, candidates []string, graph PeerGraph, n int, r *rand.Rand) []string {
+	shuffled := shuffle(candidates, r)
+	if n < len(shuffled) {
+		shuffled = shuffled[:n]
+	}
+	return shuffled
+}
+
+// Returns the n miners with the fewest connections, breaking ties at
+// random.
+type leastConnected struct{}
+
+func (leastConnected) SelectPeers(k string, candidates []string, graph PeerGraph, n int, r *rand.Rand) []string {
+	sorted := byDegree(shuffle(candidates, r), graph)
+	if n < len(sorted) {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// Keeps the overlay connected and every miner near targetDegree
+// connections. A miner is first told about one miner in each part of the
+// overlay it cannot reach, then about the least connected miners until it
+// has targetDegree connections.
+type topology struct {
+	targetDegree int
+}
+
+func (s topology) SelectPeers(k string, candidates []string, graph PeerGraph, n int, r *rand.Rand) []string {
+	sorted := byDegree(shuffle(candidates, r), graph)
+	neighbours := graph.neighbours(k)
+	reachable := graph.component(k)
+
+	var selected []string
+	chosen := make(map[string]bool)
+	choose := func(peer string) {
+		selected = append(selected, peer)
+		chosen[peer] = true
+	}
+
+	// Bridge the parts of the overlay this miner cannot reach
+	for _, peer := range sorted {
+		if len(selected) == n {
+			return selected
+		}
+		if !reachable[peer] {
+			choose(peer)
+			for other := range graph.component(peer) {
+				reachable[other] = true
+			}
+		}
+	}
+
+	// Then aim for the target degree, keeping miners it is already
+	// connected to, which it may have lost
+	degree := len(neighbours) + len(selected)
+	for _, peer := range sorted {
+		if len(selected) == n || (degree >= s.targetDegree && len(selected) > 0) {
+			break
+		}
+		if chosen[peer] {
+			continue
+		}
+		choose(peer)
+		if !neighbours[peer] {
+			degree++
+		}
+	}
+	return selected
+}
+
+func shuffle(keys []string, r *rand.Rand) []string {
+	shuffled := append([]string(nil), keys...)
+	r.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// Sorts keys by the number of connections in graph, keeping the order of
+// keys with the same number.
+func byDegree(keys []string, graph PeerGraph) []string {
+	degrees := make(map[string]int, len(keys))
+	for _, k := range keys {
+		degrees[k] = graph.degree(k)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return degrees[keys[i]] < degrees[keys[j]]
+	})
+	return keys
+}
@@ -0,0 +1,81 @@
+package shared
+
+import "fmt"
+
+// Version of the error codes below, sent in every ReplyError. It goes up
+// when codes are added; a code never changes meaning and is never reused.
+const ErrorCodeVersion = 4
+
+// Why a miner refused an art node's call. Each code stands for one of the
+// errors blockartlib documents for the Canvas API.
+type ErrorCode int
+
+const (
+	NoError               ErrorCode = 0
+	InsufficientInk       ErrorCode = 1 // InkRemaining is the ink left
+	ShapeOverlap          ErrorCode = 2 // Subject is the shape overlapped
+	ShapeOwner            ErrorCode = 3 // Subject is the shape hash
+	InvalidShapeHash      ErrorCode = 4 // Subject is the shape hash
+	InvalidBlockHash      ErrorCode = 5 // Subject is the block hash
+	InvalidShapeSvgString ErrorCode = 6 // Subject is the svg string
+	ShapeSvgStringTooLong ErrorCode = 7 // Subject is the svg string
+	OutOfBounds           ErrorCode = 8
+	InvalidKeyPair        ErrorCode = 9
+	InvalidTransfer       ErrorCode = 10 // Subject is the transfer ID
+	InvalidOwner          ErrorCode = 11 // Subject is the shape hash
+	InvalidLayer          ErrorCode = 12 // Subject is the layer
+	InvalidRegion         ErrorCode = 13 // Subject is the claim ID
+	RegionClaimed         ErrorCode = 14 // Subject is the claim ID of the claim in the way
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	NoError:               "no-error",
+	InsufficientInk:       "insufficient-ink",
+	ShapeOverlap:          "shape-overlap",
+	ShapeOwner:            "shape-owner",
+	InvalidShapeHash:      "invalid-shape-hash",
+	InvalidBlockHash:      "invalid-block-hash",
+	InvalidShapeSvgString: "invalid-shape-svg-string",
+	ShapeSvgStringTooLong: "shape-svg-string-too-long",
+	OutOfBounds:           "out-of-bounds",
+	InvalidKeyPair:        "invalid-key-pair",
+	InvalidTransfer:       "invalid-transfer",
+	InvalidOwner:          "invalid-owner",
+	InvalidLayer:          "invalid-layer",
+	InvalidRegion:         "invalid-region",
+	RegionClaimed:         "region-claimed",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error-code-%d", int(c))
+}
+
+// Carried in every ArtNodeMinerRPC reply. Code is NoError, and Version
+// may be 0, when the call succeeded. Errors the art node cannot act on,
+// such as an unknown session or a stopped miner, are returned as RPC
+// errors instead.
+type ReplyError struct {
+	Version int
+	Code    ErrorCode
+
+	// Shape hash, block hash or svg string the error is about
+	Subject string
+
+	// Ink the art node has left, with InsufficientInk
+	InkRemaining uint32
+}
+
+// Returns a ReplyError with the current version.
+func NewReplyError(code ErrorCode, subject string) ReplyError {
+	return ReplyError{Version: ErrorCodeVersion, Code: code, Subject: subject}
+}
+
+func (e ReplyError) String() string {
+	if e.Subject == "" {
+		return e.Code.String()
+	}
+	return fmt.Sprintf("%s [%s]", e.Code, e.Subject)
+}
@@ -7,6 +7,9 @@ package shared
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"math/big"
 	"net"
 	"net/rpc"
@@ -29,6 +32,10 @@ type Block struct {
 	// Nonce computed for the block
 	Nonce uint32
 
+	// When the block was mined, in milliseconds since the Unix epoch, as
+	// claimed by its miner. Used to retarget the difficulty.
+	Timestamp int64
+
 	// TODO: add the ink miner info here for validation
 	// TODO: add the sercret string here for easy validation?
 	Hash string
@@ -39,6 +46,34 @@ type CanvasSettings struct {
 	// Canvas dimensions
 	CanvasXMax uint32 `json:"canvas-x-max"`
 	CanvasYMax uint32 `json:"canvas-y-max"`
+
+	// Names of the layers above the base layer, from the bottom up. The
+	// base layer has no name and is where shapes go unless they name
+	// another. Shapes only overlap shapes on their own layer.
+	Layers []string `json:"layers,omitempty"`
+}
+
+// Returns where layer is in the stack of layers, the base layer being 0,
+// or false if the canvas has no such layer.
+func (s CanvasSettings) LayerIndex(layer string) (index int, ok bool) {
+	if layer == "" {
+		return 0, true
+	}
+	for i, name := range s.Layers {
+		if name == layer {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// A rectangle of the canvas, from (MinX, MinY) up to but not including
+// (MaxX, MaxY).
+type Region struct {
+	MinX uint32 `json:"min-x"`
+	MinY uint32 `json:"min-y"`
+	MaxX uint32 `json:"max-x"`
+	MaxY uint32 `json:"max-y"`
 }
 
 type MinerInfo struct {
@@ -58,6 +93,10 @@ type MinerNetSettings struct {
 	// Hash of the very first (empty) block in the chain.
 	GenesisBlockHash string `json:"genesis-block-hash"`
 
+	// Name of the network, so that networks with the same settings have
+	// different genesis blocks.
+	ChainName string `json:"chain-name"`
+
 	// The minimum number of ink miners that an ink miner should be
 	// connected to.
 	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
@@ -73,6 +112,13 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 
+	// Every RetargetWindow blocks (0 never) both difficulties go up by one
+	// if the last window was mined more than 4 times faster than
+	// TargetBlockTime milliseconds per block, or down by one if it was
+	// more than 4 times slower.
+	RetargetWindow  uint32 `json:"retarget-window"`
+	TargetBlockTime uint32 `json:"target-block-time"`
+
 	// Canvas settings
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
 }
@@ -81,6 +127,10 @@ type MinerSettings struct {
 	// Hash of the very first (empty) block in the chain.
 	GenesisBlockHash string `json:"genesis-block-hash"`
 
+	// Name of the network, so that networks with the same settings have
+	// different genesis blocks.
+	ChainName string `json:"chain-name"`
+
 	// The minimum number of ink miners that an ink miner should be
 	// connected to.
 	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
@@ -95,6 +145,25 @@ type MinerSettings struct {
 	// Proof of work difficulty: number of zeroes in prefix (>=0)
 	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
+
+	// Every RetargetWindow blocks (0 never) both difficulties go up by one
+	// if the last window was mined more than 4 times faster than
+	// TargetBlockTime milliseconds per block, or down by one if it was
+	// more than 4 times slower.
+	RetargetWindow  uint32 `json:"retarget-window"`
+	TargetBlockTime uint32 `json:"target-block-time"`
+}
+
+// Sent by a miner that wants to peer, with the genesis block hash of its
+// chain spec
+type ConnectArgs struct {
+	Addr             *net.TCPAddr
+	GenesisBlockHash string
+}
+
+type ConnectReply struct {
+	Key              ecdsa.PublicKey
+	GenesisBlockHash string
 }
 
 type PeerInfo struct {
@@ -111,9 +180,57 @@ type Operation struct {
 	ShapeType  int    // 0 is PATH, 1 is CIRCLE
 	IsDelete   bool   // true is delete, false is add operation
 
+	// A TRANSFER moves InkCost ink from ArtNodeKey to TransferTo instead of
+	// drawing; its ShapeHash is a unique ID and it has no shape fields
+	IsTransfer bool
+	TransferTo ecdsa.PublicKey
+
+	// A GIVE makes TransferTo the only owner of the shape ShapeHash, and a
+	// SHARE makes it one more owner. Either is made by an owner, costs no
+	// ink and has no shape fields
+	IsGive  bool
+	IsShare bool
+
+	// Keys that own a shape on the canvas besides ArtNodeKey, from the
+	// SHAREs since it was added or last given. Kept in chain state only
+	CoOwners []ecdsa.PublicKey
+
+	// A MODIFY replaces the shape ShapeHash with the shape fields it
+	// carries, by one of its owners. It makes version Version of the shape
+	// (an add is version 0) and is charged InkCost less ReplacedInkCost,
+	// what the version it replaces cost
+	IsModify        bool
+	Version         uint32
+	ReplacedInkCost uint32
+
+	// Layer a shape is on, "" for the base layer. A modify keeps the layer
+	// of the shape it replaces
+	Layer string
+
+	// A CLAIM reserves Region of Layer for ArtNodeKey for the ClaimBlocks
+	// blocks after the one it is in: no other key may draw there until
+	// then. Its ShapeHash is a unique ID, it has no shape fields and it
+	// costs InkCost, the area of the region
+	IsClaim     bool
+	Region      Region
+	ClaimBlocks uint32
+
+	// Picked at random by the art node for a modify, give, share or
+	// transfer and signed with it, so that asking for the same change
+	// twice makes two different operations. A key may only use a nonce
+	// once, so none of them can be carried out again by copying it
+	Nonce uint64
+
 	// A public key of the art node that generated the op (used to validate op/op-sig)
 	ArtNodeKey ecdsa.PublicKey
 
+	// In chain state, the key that paid for the version of a shape on the
+	// canvas, if not ArtNodeKey: the key that added or last modified it.
+	// On a delete or modify, the key that paid for the version it takes
+	// off the canvas, which gets that ink back. Set by miners from the
+	// chain, so not signed
+	PaidBy ecdsa.PublicKey
+
 	NumBlockValidate uint8
 	InkCost          uint32
 	ShapeHash        string
@@ -121,6 +238,122 @@ type Operation struct {
 	// A signature of the operation (op-sig)
 	R *big.Int
 	S *big.Int
+
+	// Set by blockartlib and logged by every miner the op passes through.
+	// Not signed or hashed, so it is only good for debugging.
+	TraceID string
+}
+
+// Returns the bytes the op-sig signs: the SHA-256 digest of a description
+// of the op. For an add it is the shape's type, svg path, fill, stroke and
+// layer, for a delete the shape, for a transfer its amount and recipient,
+// for a give or share the shape and the new owner, for a modify the shape
+// and its new fields and for a claim its layer, region and duration. Ops
+// that UsesNonce add their Nonce. ECDSA only signs as many leading bytes
+// as the curve has, which the descriptions are longer than.
+func (op Operation) SignedBytes() []byte {
+	var description string
+	switch {
+	case op.IsTransfer:
+		description = fmt.Sprintf("transfer %d ink to %x,%x nonce %d", op.InkCost, op.TransferTo.X, op.TransferTo.Y, op.Nonce)
+	case op.IsGive:
+		description = fmt.Sprintf("give %s to %x,%x nonce %d", op.ShapeHash, op.TransferTo.X, op.TransferTo.Y, op.Nonce)
+	case op.IsShare:
+		description = fmt.Sprintf("share %s with %x,%x nonce %d", op.ShapeHash, op.TransferTo.X, op.TransferTo.Y, op.Nonce)
+	case op.IsModify:
+		description = fmt.Sprintf("modify %s: %s fill %s stroke %s nonce %d", op.ShapeHash, op.DAttribute, op.Fill, op.Stroke, op.Nonce)
+	case op.IsClaim:
+		description = fmt.Sprintf("claim %d,%d to %d,%d on layer %q for %d blocks",
+			op.Region.MinX, op.Region.MinY, op.Region.MaxX, op.Region.MaxY, op.Layer, op.ClaimBlocks)
+	case op.IsDelete:
+		description = fmt.Sprintf("delete %s", op.ShapeHash)
+	default:
+		description = fmt.Sprintf("add type %d: %s fill %s stroke %s on layer %q", op.ShapeType, op.DAttribute, op.Fill, op.Stroke, op.Layer)
+	}
+	digest := sha256.Sum256([]byte(description))
+	return digest[:]
+}
+
+// Returns the hash of the shape op adds, or the ID of the transfer or
+// claim op makes: the hex SHA-256 digest of ArtNodeKey, SignedBytes and
+// the signature, which between them cover every field of the shape,
+// transfer or claim. Miners derive it from the signed op whatever
+// hash it came with, so it is the same on every miner and every fork, and
+// no two signed ops share one.
+func (op Operation) ContentHash() string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%x,%x:%x:%x,%x", op.ArtNodeKey.X, op.ArtNodeKey.Y, op.SignedBytes(), op.R, op.S)))
+	return hex.EncodeToString(digest[:])
+}
+
+// Ink op takes from ArtNodeKey, or gives back to it when negative. Ink
+// given back to another key is InkRefunded instead.
+func (op Operation) InkSpent() int64 {
+	_, refund := op.InkRefunded()
+	switch {
+	case op.IsDelete:
+		return -int64(op.InkCost) + refund
+	case op.IsModify:
+		return int64(op.InkCost) - int64(op.ReplacedInkCost) + refund
+	}
+	return int64(op.InkCost)
+}
+
+// Ink a delete or modify gives back to PaidBy when that is not
+// ArtNodeKey, and PaidBy.
+func (op Operation) InkRefunded() (key ecdsa.PublicKey, ink int64) {
+	if op.PaidBy.X == nil || sameKey(op.PaidBy, op.ArtNodeKey) {
+		return key, 0
+	}
+	switch {
+	case op.IsDelete:
+		return op.PaidBy, int64(op.InkCost)
+	case op.IsModify:
+		return op.PaidBy, int64(op.ReplacedInkCost)
+	}
+	return key, 0
+}
+
+// Key that paid for the shape op holds in chain state.
+func (op Operation) Payer() ecdsa.PublicKey {
+	if op.PaidBy.X != nil {
+		return op.PaidBy
+	}
+	return op.ArtNodeKey
+}
+
+// Whether op puts a shape on the canvas: it is not a delete, transfer,
+// give, share, modify or claim.
+func (op Operation) IsAdd() bool {
+	return !op.IsDelete && !op.IsTransfer && !op.IsOwnerChange() && !op.IsModify && !op.IsClaim
+}
+
+// Whether op is a modify, give, share or transfer, which sign a Nonce.
+func (op Operation) UsesNonce() bool {
+	return op.IsModify || op.IsOwnerChange() || op.IsTransfer
+}
+
+// Whether op is a give or a share, which change who owns a shape.
+func (op Operation) IsOwnerChange() bool {
+	return op.IsGive || op.IsShare
+}
+
+// Whether key owns the shape op adds: it is ArtNodeKey or one of the
+// CoOwners.
+func (op Operation) OwnedBy(key ecdsa.PublicKey) bool {
+	if sameKey(op.ArtNodeKey, key) {
+		return true
+	}
+	for _, owner := range op.CoOwners {
+		if sameKey(owner, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a and b are the same point. Empty keys are never the same.
+func sameKey(a, b ecdsa.PublicKey) bool {
+	return a.X != nil && b.X != nil && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
 }
 
 type BlockNotChain struct {
@@ -131,6 +364,9 @@ type BlockNotChain struct {
 // These types and structs are for artminer
 
 type Args struct {
+	// Session returned by OpenCanvasRPC
+	SessionID string
+
 	BlockHash string
 	ShapeHash string
 	// validateNum, operation, its hash, inkRequired and publicKey to miner (AddShape)
@@ -143,31 +379,60 @@ type Args struct {
 	Message         []byte
 }
 
+// Every reply below carries a ReplyError saying why the miner refused the
+// call, if it did.
+
 type OpenCanvasReply struct {
-	KeyMatched       bool
 	MyCanvasSettings CanvasSettings
+	SessionID        string
+	Error            ReplyError
+}
+
+// An add or delete operation sent by an art node in its session
+type OperationArgs struct {
+	SessionID string
+	Operation Operation
 }
 
 type AddShapeReply struct {
-	BlockHash           string
-	InkRemaining        uint32
-	ErrorCode           int
-	OverlappedShapeHash string
+	// Hash the miner derived for an added shape or ID for a claim, see
+	// ContentHash
+	ShapeHash    string
+	BlockHash    string
+	InkRemaining uint32
+	Error        ReplyError
+}
+
+// Reply of the calls that only return the art node's ink
+type InkReply struct {
+	InkRemaining uint32
+	Error        ReplyError
 }
 
 type GetChildrenReply struct {
 	Data  []string
-	Found bool
+	Error ReplyError
 }
 
 type GetShapesReply struct {
 	Data  []string
-	Found bool
+	Error ReplyError
 }
 
 type GetSvgStringReply struct {
 	Data  string
-	Found bool
+	Error ReplyError
+}
+
+// Reply of the calls that give or share a shape
+type ChangeOwnersReply struct {
+	BlockHash string
+	Error     ReplyError
+}
+
+type GetGenesisBlockReply struct {
+	BlockHash string
+	Error     ReplyError
 }
 
 // TODO: This is Block struct
@@ -0,0 +1,508 @@
+package sim
+
+import (
+	"../blockartlib"
+	"../logging"
+	"../shared"
+	"../verification"
+
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Costs 10 ink with these fill and stroke
+const (
+	line        = "M 0 10 L 10 10"
+	crossedLine = "M 5 5 L 5 15"
+	otherLine   = "M 100 100 L 110 100"
+)
+
+func startNetwork(t *testing.T, numMiners int) *Network {
+	n, err := Start(Config{NumMiners: numMiners, Difficulty: 4, InkPerNoOpBlock: 50, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func openCanvas(t *testing.T, n *Network, i int) blockartlib.Canvas {
+	canvas, _, err := n.OpenCanvas(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return canvas
+}
+
+// Waits until the art node on canvas has ink. Tests wait for several
+// blocks worth of ink so that a short fork cannot take it away again.
+func waitForInk(t *testing.T, canvas blockartlib.Canvas, ink uint32) {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if remaining, err := canvas.GetInk(); err == nil && remaining >= ink {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Miner did not mine enough ink")
+}
+
+// Waits until every running miner has the same block at height and
+// returns its hash.
+func waitForAgreement(t *testing.T, n *Network, miners []int, height int) string {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		agreed := ""
+		for _, i := range miners {
+			chain := n.Miner(i).Chain()
+			if len(chain) <= height {
+				agreed = ""
+				break
+			}
+			if agreed == "" {
+				agreed = chain[height].Hash
+			} else if agreed != chain[height].Hash {
+				agreed = ""
+				break
+			}
+		}
+		if agreed != "" {
+			return agreed
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Miners did not agree on a block at height", height)
+	return ""
+}
+
+// Ink for key worked out from the chain: block rewards, minus shapes
+// added, plus shapes deleted.
+func inkFromChain(chain []shared.Block, key ecdsa.PublicKey, settings Config) uint32 {
+	var ink uint32
+	for _, block := range chain {
+		if verification.EqualPublicKey(block.MinerKey, key) {
+			if block.IsNoopBlock {
+				ink += settings.InkPerNoOpBlock
+			} else {
+				ink += settings.InkPerOpBlock
+			}
+		}
+		for _, op := range block.Operations {
+			if verification.EqualPublicKey(op.ArtNodeKey, key) {
+				if op.IsDelete {
+					ink += op.InkCost
+				} else {
+					ink -= op.InkCost
+				}
+			}
+		}
+	}
+	return ink
+}
+
+func checkInk(t *testing.T, n *Network, i int) {
+	m := n.Miner(i)
+	for j := 0; j < n.NumMiners(); j++ {
+		key := n.Key(j).PublicKey
+		if m.InkBalance(key) != inkFromChain(m.Chain(), key, n.config) {
+			t.Error("Miner", i, "has the wrong ink balance for miner", j)
+		}
+	}
+}
+
+func TestConcurrentOverlappingAddShape(t *testing.T) {
+	n := startNetwork(t, 3)
+	defer n.Close()
+
+	canvases := []blockartlib.Canvas{openCanvas(t, n, 0), openCanvas(t, n, 1)}
+	for _, canvas := range canvases {
+		waitForInk(t, canvas, 100)
+	}
+
+	type result struct {
+		shapeHash string
+		err       error
+	}
+	results := make(chan result, 2)
+	for i, svg := range []string{line, crossedLine} {
+		go func(canvas blockartlib.Canvas, svg string) {
+			shapeHash, _, _, err := canvas.AddShape(2, blockartlib.PATH, svg, "transparent", "red")
+			results <- result{shapeHash, err}
+		}(canvases[i], svg)
+	}
+
+	var winner string
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err == nil {
+			if winner != "" {
+				t.Fatal("Both overlapping shapes were added")
+			}
+			winner = r.shapeHash
+		} else if _, ok := r.err.(blockartlib.ShapeOverlapError); !ok {
+			t.Fatal("Expected a ShapeOverlapError, got", r.err)
+		}
+	}
+	if winner == "" {
+		t.Fatal("Neither shape was added")
+	}
+
+	for i := 0; i < n.NumMiners(); i++ {
+		waitForAgreement(t, n, []int{0, 1, 2}, len(n.Miner(0).Chain())-1)
+		shapes := n.Miner(i).Shapes()
+		if _, ok := shapes[winner]; !ok || len(shapes) != 1 {
+			t.Error("Miner", i, "does not have exactly the winning shape:", shapes)
+		}
+		checkInk(t, n, i)
+	}
+}
+
+func TestForkHealsAfterPartition(t *testing.T) {
+	n := startNetwork(t, 4)
+	defer n.Close()
+
+	n.Partition([]int{0, 1}, []int{2, 3})
+	time.Sleep(300 * time.Millisecond)
+
+	height := len(n.Miner(0).Chain())
+	if other := len(n.Miner(2).Chain()); other > height {
+		height = other
+	}
+	forked := waitForAgreement(t, n, []int{0, 1}, height-1) != waitForAgreement(t, n, []int{2, 3}, height-1)
+
+	n.Heal()
+	hash := waitForAgreement(t, n, []int{0, 1, 2, 3}, height)
+	if !forked {
+		t.Log("Both sides of the partition happened to agree")
+	}
+
+	for i := 0; i < n.NumMiners(); i++ {
+		chain := n.Miner(i).Chain()
+		if chain[height].Hash != hash {
+			t.Error("Miner", i, "is on a different chain")
+		}
+		checkInk(t, n, i)
+	}
+}
+
+func TestCrashedMinerDoesNotStopNetwork(t *testing.T) {
+	n := startNetwork(t, 3)
+	defer n.Close()
+
+	n.SetLatency(time.Millisecond)
+	n.SetDropRate(0.1)
+	n.Crash(2)
+
+	canvas := openCanvas(t, n, 0)
+	waitForInk(t, canvas, 100)
+
+	n.SetDropRate(0)
+	shapeHash, _, _, err := canvas.AddShape(2, blockartlib.PATH, otherLine, "transparent", "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForAgreement(t, n, []int{0, 1}, len(n.Miner(0).Chain())-1)
+	if _, ok := n.Miner(1).Shapes()[shapeHash]; !ok {
+		t.Error("Shape added through miner 0 missing from miner 1")
+	}
+}
+
+func TestValidateNumWaits(t *testing.T) {
+	n := startNetwork(t, 2)
+	defer n.Close()
+
+	canvas := openCanvas(t, n, 0)
+	waitForInk(t, canvas, 100)
+	shapeHash, blockHash, inkRemaining, err := canvas.AddShape(3, blockartlib.PATH, line, "transparent", "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := n.Miner(0).Chain()
+	confirmations := -1
+	for i, block := range chain {
+		if block.Hash == blockHash {
+			confirmations = len(chain) - 1 - i
+		}
+	}
+	if confirmations < 3 {
+		t.Error("AddShape returned with", confirmations, "blocks after the shape's block")
+	}
+
+	shapeHashes, err := canvas.GetShapes(blockHash)
+	if err != nil || !reflect.DeepEqual(shapeHashes, []string{shapeHash}) {
+		t.Error("Block returned by AddShape does not hold the shape:", shapeHashes, err)
+	}
+
+	if inkRemaining > inkFromChain(chain, n.Key(0).PublicKey, n.config) {
+		t.Error("AddShape returned more ink than the chain credits")
+	}
+}
+
+func TestClosedCanvasIsDisconnected(t *testing.T) {
+	n := startNetwork(t, 1)
+	defer n.Close()
+
+	canvas := openCanvas(t, n, 0)
+	if _, err := canvas.CloseCanvas(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := canvas.GetInk(); err == nil {
+		t.Error("Expected GetInk on a closed canvas to fail")
+	} else if _, ok := err.(blockartlib.DisconnectedError); !ok {
+		t.Error("Expected a DisconnectedError, got", err)
+	}
+	if _, err := canvas.CloseCanvas(); err == nil {
+		t.Error("Expected a second CloseCanvas to fail")
+	}
+
+	// Other art nodes are not affected
+	other := openCanvas(t, n, 0)
+	if _, err := other.GetInk(); err != nil {
+		t.Error("New canvas failed after another was closed:", err)
+	}
+}
+
+func TestCanvasReconnectsAfterMinerRestart(t *testing.T) {
+	n := startNetwork(t, 2)
+	defer n.Close()
+
+	canvas := openCanvas(t, n, 0)
+	addr := n.Miner(0).Addr().String()
+	n.Crash(0)
+	if _, err := n.StartMiner(n.Key(0), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := canvas.GetInk(); err != nil {
+		t.Error("GetInk failed after the miner restarted:", err)
+	}
+}
+
+func TestCanvasFailsOverToBackupMiner(t *testing.T) {
+	n := startNetwork(t, 2)
+	defer n.Close()
+
+	// Reserve an address for the backup miner
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := l.Addr().String()
+	l.Close()
+
+	canvas, _, err := n.OpenCanvasWithOptions(0, blockartlib.Options{
+		BackupMiners: []string{backup},
+		Retries:      2,
+		Backoff:      10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server only accepts one miner per key, so the backup starts once
+	// the first miner is gone
+	n.Crash(0)
+	if _, err := n.StartMiner(n.Key(0), backup); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForInk(t, canvas, 100)
+	if _, _, _, err := canvas.AddShape(1, blockartlib.PATH, line, "transparent", "red"); err != nil {
+		t.Error("AddShape failed on the backup miner:", err)
+	}
+}
+
+func TestResentOperationAddedOnce(t *testing.T) {
+	n := startNetwork(t, 2)
+	defer n.Close()
+
+	waitForInk(t, openCanvas(t, n, 0), 100)
+
+	client, err := rpc.Dial("tcp", n.Miner(0).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	key := n.Key(0)
+	msg := []byte("Hello")
+	r, s, _ := ecdsa.Sign(rand.Reader, key, msg)
+	var session shared.OpenCanvasReply
+	if err := client.Call("ArtNodeMinerRPC.OpenCanvasRPC", &shared.Args{R: r, S: s, Message: msg}, &session); err != nil {
+		t.Fatal(err)
+	}
+
+	args := shared.OperationArgs{SessionID: session.SessionID, Operation: shared.Operation{
+		AppShapeOp:       "<path d=\"" + line + "\" stroke=\"red\" fill=\"transparent\"/>",
+		Fill:             "transparent",
+		Stroke:           "red",
+		DAttribute:       line,
+		NumBlockValidate: 1,
+		InkCost:          blockartlib.CalculateInkUsed(blockartlib.PATH, line, "transparent", "red"),
+	}}
+	args.Operation.R, args.Operation.S, _ = ecdsa.Sign(rand.Reader, key, args.Operation.SignedBytes())
+
+	var first, second shared.AddShapeReply
+	if err := client.Call("ArtNodeMinerRPC.AddShapeRPC", &args, &first); err != nil || first.Error.Code != shared.NoError {
+		t.Fatal("AddShapeRPC failed:", err, first.Error)
+	}
+	if err := client.Call("ArtNodeMinerRPC.AddShapeRPC", &args, &second); err != nil || second.Error.Code != shared.NoError {
+		t.Fatal("Resent AddShapeRPC failed:", err, second.Error)
+	}
+	if first.BlockHash != second.BlockHash || first.ShapeHash != second.ShapeHash {
+		t.Error("Resent operation returned another block or shape:", first.BlockHash, second.BlockHash, first.ShapeHash, second.ShapeHash)
+	}
+
+	count := 0
+	for _, block := range n.Miner(0).Chain() {
+		for _, op := range block.Operations {
+			if op.ShapeHash == first.ShapeHash {
+				count++
+			}
+		}
+	}
+	if count != 1 {
+		t.Error("Operation is", count, "times on the chain")
+	}
+	checkInk(t, n, 0)
+}
+
+func TestCanvasesAreIndependent(t *testing.T) {
+	n := startNetwork(t, 2)
+	defer n.Close()
+
+	canvases := []blockartlib.Canvas{openCanvas(t, n, 0), openCanvas(t, n, 1)}
+	for _, canvas := range canvases {
+		waitForInk(t, canvas, 100)
+	}
+
+	// Each canvas is used from several goroutines at once
+	shapeHashes := make([]string, len(canvases))
+	errs := make(chan error, 10*len(canvases))
+	done := make(chan bool)
+	for i, svg := range []string{line, otherLine} {
+		go func(i int, svg string) {
+			shapeHash, _, _, err := canvases[i].AddShape(1, blockartlib.PATH, svg, "transparent", "red")
+			shapeHashes[i] = shapeHash
+			errs <- err
+			done <- true
+		}(i, svg)
+		for j := 0; j < 4; j++ {
+			go func(i int) {
+				_, err := canvases[i].GetInk()
+				errs <- err
+				done <- true
+			}(i)
+		}
+	}
+	for i := 0; i < 5*len(canvases); i++ {
+		<-done
+	}
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A canvas only deletes the shapes it added
+	if _, err := canvases[0].DeleteShape(1, shapeHashes[1]); err == nil {
+		t.Error("Deleted a shape added through another canvas")
+	} else if _, ok := err.(blockartlib.ShapeOwnerError); !ok {
+		t.Error("Expected a ShapeOwnerError, got", err)
+	}
+	if _, err := canvases[1].CloseCanvas(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := canvases[0].DeleteShape(1, shapeHashes[0]); err != nil {
+		t.Error("DeleteShape failed after another canvas was closed:", err)
+	}
+}
+
+// Log output shared by the miners and the canvas.
+type logBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+func TestTraceIDFollowsOperation(t *testing.T) {
+	logs := &logBuffer{}
+	n, err := Start(Config{NumMiners: 2, Difficulty: 4, InkPerNoOpBlock: 50, Seed: 1,
+		Logger: logging.New(logs, slog.LevelDebug, "miner")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	canvas, _, err := n.OpenCanvasWithOptions(0, blockartlib.Options{Logger: logging.New(logs, slog.LevelDebug, "blockartlib")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForInk(t, canvas, 100)
+
+	shapeHash, blockHash, _, err := canvas.AddShape(1, blockartlib.PATH, line, "transparent", "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := ""
+	for _, block := range n.Miner(0).Chain() {
+		for _, op := range block.Operations {
+			if op.ShapeHash == shapeHash {
+				trace = op.TraceID
+			}
+		}
+	}
+	if trace == "" {
+		t.Fatal("Operation in the block has no trace ID")
+	}
+
+	// The canvas and both miners logged the operation under its trace ID
+	want := [][]string{
+		{"msg=\"adding shape\"", "component=blockartlib", "key=" + logging.KeyPrefix(n.Key(0).PublicKey), "trace=" + trace},
+		{"msg=\"operation in block\"", "component=miner", "key=" + logging.KeyPrefix(n.Key(0).PublicKey), "trace=" + trace, "block=" + blockHash},
+		{"msg=\"operation in block\"", "component=miner", "key=" + logging.KeyPrefix(n.Key(1).PublicKey), "trace=" + trace, "block=" + blockHash},
+	}
+	for _, parts := range want {
+		if !logged(logs.String(), parts) {
+			t.Error("Missing log line with", parts)
+		}
+	}
+}
+
+// Whether one of the lines in logs contains all of parts.
+func logged(logs string, parts []string) bool {
+	for _, line := range strings.Split(logs, "\n") {
+		found := true
+		for _, part := range parts {
+			found = found && strings.Contains(line, part)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
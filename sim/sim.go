@@ -0,0 +1,220 @@
+/*
+
+Package sim runs a whole BlockArt network, the server and a number of ink
+miners, inside one process so that multi-miner scenarios can be tested
+without starting processes by hand. Miners talk over loopback through a
+transport that can add latency, drop connections and partition the
+network.
+
+*/
+
+package sim
+
+import (
+	"../blockartlib"
+	"../genesis"
+	"../miner"
+	"../proj1-server/rserver"
+	"../shared"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Settings for a simulated network. Zero values are replaced by the
+// defaults noted on each field.
+type Config struct {
+	// Number of miners to start (1)
+	NumMiners int
+
+	// Proof of work difficulty of both op and no-op blocks. Kept low so
+	// that blocks are found in milliseconds.
+	Difficulty uint8
+
+	// Mining ink reward per op (100) and no-op (20) blocks
+	InkPerOpBlock   uint32
+	InkPerNoOpBlock uint32
+
+	// Number of milliseconds between heartbeat messages to the server (1000)
+	HeartBeat uint32
+
+	// Seed for the connections that are dropped
+	Seed int64
+
+	// Logger every miner logs to (info and above on stdout)
+	Logger *slog.Logger
+}
+
+// A running simulated network.
+type Network struct {
+	config    Config
+	listener  net.Listener
+	server    *rserver.RServer
+	transport *transport
+	keys      []*ecdsa.PrivateKey
+	miners    []*miner.Miner
+}
+
+// Starts the server and config.NumMiners miners, one after the other so
+// that each miner peers with the ones started before it.
+func Start(config Config) (*Network, error) {
+	if config.NumMiners <= 0 {
+		config.NumMiners = 1
+	}
+	if config.InkPerOpBlock == 0 {
+		config.InkPerOpBlock = 100
+	}
+	if config.InkPerNoOpBlock == 0 {
+		config.InkPerNoOpBlock = 20
+	}
+	if config.HeartBeat == 0 {
+		config.HeartBeat = 1000
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	settings := genesis.New(shared.MinerNetSettings{
+		ChainName:              "sim",
+		MinNumMinerConnections: 1,
+		InkPerOpBlock:          config.InkPerOpBlock,
+		InkPerNoOpBlock:        config.InkPerNoOpBlock,
+		HeartBeat:              config.HeartBeat,
+		PoWDifficultyOpBlock:   config.Difficulty,
+		PoWDifficultyNoOpBlock: config.Difficulty,
+		CanvasSettings:         shared.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+	})
+
+	server, err := rserver.New(rserver.Config{
+		MinerSettings: rserver.MinerNetSettings{
+			GenesisBlockHash:       settings.GenesisBlockHash,
+			ChainName:              settings.ChainName,
+			MinNumMinerConnections: settings.MinNumMinerConnections,
+			InkPerOpBlock:          settings.InkPerOpBlock,
+			InkPerNoOpBlock:        settings.InkPerNoOpBlock,
+			HeartBeat:              settings.HeartBeat,
+			PoWDifficultyOpBlock:   settings.PoWDifficultyOpBlock,
+			PoWDifficultyNoOpBlock: settings.PoWDifficultyNoOpBlock,
+			CanvasSettings:         rserver.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+		},
+		RpcIpPort:        l.Addr().String(),
+		NumMinerToReturn: uint8(config.NumMiners),
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	go server.Serve(l)
+
+	n := &Network{
+		config:    config,
+		listener:  l,
+		server:    server,
+		transport: newTransport(l.Addr().String(), config.Seed),
+	}
+
+	for i := 0; i < config.NumMiners; i++ {
+		priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err == nil {
+			_, err = n.StartMiner(priv, "127.0.0.1:0")
+		}
+		if err != nil {
+			n.Close()
+			return nil, fmt.Errorf("starting miner %d: %s", i, err)
+		}
+	}
+	return n, nil
+}
+
+// Starts one more miner that mines on behalf of key and listens on
+// listenAddr ("127.0.0.1:0" for any port), e.g. to replace a crashed miner.
+// Returns the index of the new miner.
+func (n *Network) StartMiner(key *ecdsa.PrivateKey, listenAddr string) (int, error) {
+	i := len(n.miners)
+	m, err := miner.New(miner.Config{
+		ServerAddr: n.listener.Addr().String(),
+		ListenAddr: listenAddr,
+		PrivateKey: key,
+		Dial:       n.transport.dialer(i),
+		Logger:     n.config.Logger,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := m.Start(context.Background()); err != nil {
+		return 0, err
+	}
+
+	n.transport.addMiner(i, m.Addr().String())
+	n.keys = append(n.keys, key)
+	n.miners = append(n.miners, m)
+	return i, nil
+}
+
+// Number of miners in the network, including crashed ones.
+func (n *Network) NumMiners() int {
+	return len(n.miners)
+}
+
+// Returns miner i.
+func (n *Network) Miner(i int) *miner.Miner {
+	return n.miners[i]
+}
+
+// Returns the key pair miner i mines on behalf of.
+func (n *Network) Key(i int) *ecdsa.PrivateKey {
+	return n.keys[i]
+}
+
+// Opens a canvas on miner i as the art node that owns the miner's key pair.
+func (n *Network) OpenCanvas(i int) (blockartlib.Canvas, blockartlib.CanvasSettings, error) {
+	return blockartlib.OpenCanvas(n.miners[i].Addr().String(), *n.keys[i])
+}
+
+// Same as OpenCanvas, with blockartlib options such as backup miners.
+func (n *Network) OpenCanvasWithOptions(i int, opts blockartlib.Options) (blockartlib.Canvas, blockartlib.CanvasSettings, error) {
+	return blockartlib.OpenCanvasWithOptions(n.miners[i].Addr().String(), *n.keys[i], opts)
+}
+
+// Splits the miners into groups that cannot reach each other. Miners not
+// in any group form one more group.
+func (n *Network) Partition(groups ...[]int) {
+	n.transport.partition(groups)
+}
+
+// Removes the partition.
+func (n *Network) Heal() {
+	n.transport.partition(nil)
+}
+
+// Delays every new connection between miners by latency.
+func (n *Network) SetLatency(latency time.Duration) {
+	n.transport.setLatency(latency)
+}
+
+// Drops new connections between miners with probability rate.
+func (n *Network) SetDropRate(rate float64) {
+	n.transport.setDropRate(rate)
+}
+
+// Stops miner i as if its process had died.
+func (n *Network) Crash(i int) {
+	n.miners[i].Stop()
+}
+
+// Stops every miner and the server.
+func (n *Network) Close() {
+	for _, m := range n.miners {
+		m.Stop()
+	}
+	n.listener.Close()
+	n.server.Close()
+}
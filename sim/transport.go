@@ -0,0 +1,103 @@
+package sim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errPartitioned = errors.New("sim: miners are partitioned")
+	errDropped     = errors.New("sim: connection dropped")
+)
+
+// Loopback transport between the miners of a Network. Every connection a
+// miner opens to another miner can be delayed, dropped at random, or
+// refused because the two miners are on different sides of a partition.
+// Connections to the server are never affected, so heartbeats keep
+// flowing.
+type transport struct {
+	sync.Mutex
+
+	serverAddr string
+
+	// Miner listen address to miner index
+	addrs map[string]int
+
+	// Miner index to partition group; miners not listed are in group 0
+	groups map[int]int
+
+	latency  time.Duration
+	dropRate float64
+	rand     *rand.Rand
+}
+
+func newTransport(serverAddr string, seed int64) *transport {
+	return &transport{
+		serverAddr: serverAddr,
+		addrs:      make(map[string]int),
+		groups:     make(map[int]int),
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Returns the dial function for the miner with index from.
+func (t *transport) dialer(from int) func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		if err := t.fault(from, addr); err != nil {
+			return nil, err
+		}
+		return net.Dial("tcp", addr)
+	}
+}
+
+func (t *transport) fault(from int, addr string) error {
+	t.Lock()
+	if addr == t.serverAddr {
+		t.Unlock()
+		return nil
+	}
+
+	var err error
+	if to, ok := t.addrs[addr]; ok && t.groups[from] != t.groups[to] {
+		err = errPartitioned
+	} else if t.dropRate > 0 && t.rand.Float64() < t.dropRate {
+		err = errDropped
+	}
+	latency := t.latency
+	t.Unlock()
+
+	time.Sleep(latency)
+	return err
+}
+
+func (t *transport) addMiner(i int, addr string) {
+	t.Lock()
+	defer t.Unlock()
+	t.addrs[addr] = i
+}
+
+func (t *transport) partition(groups [][]int) {
+	t.Lock()
+	defer t.Unlock()
+	t.groups = make(map[int]int)
+	for g, miners := range groups {
+		for _, i := range miners {
+			t.groups[i] = g + 1
+		}
+	}
+}
+
+func (t *transport) setLatency(latency time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.latency = latency
+}
+
+func (t *transport) setDropRate(rate float64) {
+	t.Lock()
+	defer t.Unlock()
+	t.dropRate = rate
+}
@@ -0,0 +1,94 @@
+package verification
+
+import (
+	"time"
+
+	"../shared"
+)
+
+// Most zeroes an MD5 hex hash can end in.
+const MaxDifficulty = 32
+
+// How far in the future a block's timestamp may be, to allow for clocks
+// that are a little ahead.
+const MaxClockDrift = 2 * time.Minute
+
+// Returns the current time as a block timestamp.
+func Timestamp() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Returns the difficulty a block extending blockChain must be mined at.
+func ExpectedDifficulty(block shared.Block, blockChain shared.Node, minerNetSettings shared.MinerNetSettings) uint8 {
+	op, noop := Difficulties(blockChain, minerNetSettings)
+	if block.IsNoopBlock {
+		return noop
+	}
+	return op
+}
+
+// Returns the op and no-op block difficulties for the next block on top of
+// blockChain. Starting from the configured difficulties, both are
+// retargeted at every RetargetWindow blocks by comparing the time the
+// previous window took with RetargetWindow * TargetBlockTime. A difficulty
+// step makes mining 16 times harder, so the difficulty only moves when the
+// window was more than 4 times off, which is as close as it can get.
+func Difficulties(blockChain shared.Node, minerNetSettings shared.MinerNetSettings) (op, noop uint8) {
+	op = minerNetSettings.PoWDifficultyOpBlock
+	noop = minerNetSettings.PoWDifficultyNoOpBlock
+
+	window := int(minerNetSettings.RetargetWindow)
+	if window == 0 {
+		return op, noop
+	}
+
+	// Timestamps from the genesis block (height 0) to the tip
+	var timestamps []int64
+	for current := &blockChain; current != nil; current = current.Prev {
+		timestamps = append(timestamps, current.Block.Timestamp)
+	}
+	for i, j := 0, len(timestamps)-1; i < j; i, j = i+1, j-1 {
+		timestamps[i], timestamps[j] = timestamps[j], timestamps[i]
+	}
+
+	expected := int64(window) * int64(minerNetSettings.TargetBlockTime)
+	for height := window; height <= len(timestamps); height += window {
+		// The genesis block has no timestamp, so the first window is
+		// skipped
+		first := height - 1 - window
+		if first < 1 {
+			continue
+		}
+
+		took := timestamps[height-1] - timestamps[first]
+		switch {
+		case took*4 < expected:
+			op = stepDifficulty(op, 1)
+			noop = stepDifficulty(noop, 1)
+		case took > expected*4:
+			op = stepDifficulty(op, -1)
+			noop = stepDifficulty(noop, -1)
+		}
+	}
+	return op, noop
+}
+
+func stepDifficulty(difficulty uint8, step int) uint8 {
+	d := int(difficulty) + step
+	if d < 0 {
+		return 0
+	}
+	if d > MaxDifficulty {
+		return MaxDifficulty
+	}
+	return uint8(d)
+}
+
+// Verifies that the block was not mined before the block it extends, nor
+// more than MaxClockDrift in the future.
+func VerifyTimestamp(block shared.Block, blockChain shared.Node) (valid bool) {
+	if block.Timestamp < blockChain.Block.Timestamp {
+		return false
+	}
+	return block.Timestamp <= Timestamp()+int64(MaxClockDrift/time.Millisecond)
+}
@@ -0,0 +1,83 @@
+package verification
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+// Builds a chain of n blocks after the genesis block, mined interval
+// milliseconds apart.
+func chainWithInterval(n int, interval int64) shared.Node {
+	node := &shared.Node{Block: shared.Block{Hash: "genesis"}}
+	for i := 1; i <= n; i++ {
+		node = &shared.Node{Block: shared.Block{Timestamp: 1000000 + int64(i)*interval}, Prev: node}
+	}
+	return *node
+}
+
+var retargetSettings = shared.MinerNetSettings{
+	PoWDifficultyOpBlock:   4,
+	PoWDifficultyNoOpBlock: 3,
+	RetargetWindow:         10,
+	TargetBlockTime:        1000,
+}
+
+func TestDifficultiesWithoutRetargeting(t *testing.T) {
+	settings := retargetSettings
+	settings.RetargetWindow = 0
+
+	op, noop := Difficulties(chainWithInterval(50, 1), settings)
+	if op != 4 || noop != 3 {
+		t.Error("Expected the configured difficulties, got", op, noop)
+	}
+}
+
+func TestDifficultiesOnTarget(t *testing.T) {
+	op, noop := Difficulties(chainWithInterval(50, 1000), retargetSettings)
+	if op != 4 || noop != 3 {
+		t.Error("Expected the configured difficulties, got", op, noop)
+	}
+}
+
+func TestDifficultiesGoUpWhenTooFast(t *testing.T) {
+	// Retargets after the windows ending at heights 20, 30 and 40. The one
+	// ending at 10 has the genesis block in it.
+	op, noop := Difficulties(chainWithInterval(45, 100), retargetSettings)
+	if op != 7 || noop != 6 {
+		t.Error("Expected 3 steps up, got", op, noop)
+	}
+}
+
+func TestDifficultiesGoDownWhenTooSlow(t *testing.T) {
+	op, noop := Difficulties(chainWithInterval(45, 10000), retargetSettings)
+	if op != 1 || noop != 0 {
+		t.Error("Expected 3 steps down, stopping at 0, got", op, noop)
+	}
+}
+
+func TestVerifyHashDifficultyAtHeight(t *testing.T) {
+	chain := chainWithInterval(20, 100)
+	block := shared.Block{Hash: "DSKJFSDFKJEWRJEWR0000"}
+	if VerifyHashDifficulty(block, chain, retargetSettings) {
+		t.Error("Block with 4 zeroes passed after the difficulty went up to 5")
+	}
+
+	block.Hash = "DSKJFSDFKJEWRJEWR00000"
+	if !VerifyHashDifficulty(block, chain, retargetSettings) {
+		t.Error("Block with 5 zeroes failed after the difficulty went up to 5")
+	}
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	chain := chainWithInterval(1, 0)
+	if VerifyTimestamp(shared.Block{Timestamp: chain.Block.Timestamp - 1}, chain) {
+		t.Error("Block mined before its parent passed")
+	}
+	if !VerifyTimestamp(shared.Block{Timestamp: Timestamp()}, chain) {
+		t.Error("Block mined now failed")
+	}
+	if VerifyTimestamp(shared.Block{Timestamp: Timestamp() + 3600000}, chain) {
+		t.Error("Block mined an hour from now passed")
+	}
+}
@@ -0,0 +1,86 @@
+package verification
+
+import (
+	"fmt"
+
+	"../shared"
+)
+
+// Checks a give or share against the shape it is about, as it is on the
+// canvas (onCanvas is false if it is not there): the shape must be on the
+// canvas, op must be made by one of its owners and must hand the shape to
+// a usable key that does not own it already. A give may also take the
+// shape back from its co-owners.
+func CheckOwnerChange(op shared.Operation, shape shared.Operation, onCanvas bool) (refused shared.ReplyError) {
+	if op.IsGive == op.IsShare || op.IsDelete || op.IsTransfer || op.InkCost != 0 {
+		return shared.NewReplyError(shared.InvalidOwner, op.ShapeHash)
+	}
+	if op.DAttribute != "" || op.AppShapeOp != "" || op.Fill != "" || op.Stroke != "" {
+		return shared.NewReplyError(shared.InvalidOwner, op.ShapeHash)
+	}
+	if !onCanvas {
+		return shared.NewReplyError(shared.InvalidShapeHash, op.ShapeHash)
+	}
+	if !shape.OwnedBy(op.ArtNodeKey) {
+		return shared.NewReplyError(shared.ShapeOwner, op.ShapeHash)
+	}
+	if !VerifyPublicKey(op.TransferTo) {
+		return shared.NewReplyError(shared.InvalidOwner, op.ShapeHash)
+	}
+	if op.IsShare && shape.OwnedBy(op.TransferTo) {
+		return shared.NewReplyError(shared.InvalidOwner, op.ShapeHash)
+	}
+	if op.IsGive && EqualPublicKey(shape.ArtNodeKey, op.TransferTo) && len(shape.CoOwners) == 0 {
+		return shared.NewReplyError(shared.InvalidOwner, op.ShapeHash)
+	}
+	return refused
+}
+
+// Returns shape with its owners changed by the give or share op, which
+// must have passed CheckOwnerChange.
+func ChangeOwners(shape shared.Operation, op shared.Operation) shared.Operation {
+	if op.IsGive {
+		shape.PaidBy = shape.Payer()
+		shape.ArtNodeKey = op.TransferTo
+		shape.CoOwners = nil
+	} else {
+		shape.CoOwners = append(shape.CoOwners[:len(shape.CoOwners):len(shape.CoOwners)], op.TransferTo)
+	}
+	return shape
+}
+
+// Verifies that no operation in block is signed with a signature that is
+// already on blockChain or earlier in block, so that a give, share or
+// transfer cannot be carried out again by copying it into a later block.
+// Signatures are told apart by their key and R alone: anyone can turn S
+// into N-S and still have a valid signature. Nonces may not be used twice
+// by a key either.
+func VerifyOperationsNotReplayed(block shared.Block, blockChain shared.Node) (valid bool) {
+	used := make(map[string]bool)
+	for current := &blockChain; current != nil; current = current.Prev {
+		for _, op := range current.Block.Operations {
+			for _, id := range replayIDs(op) {
+				used[id] = true
+			}
+		}
+	}
+	for _, op := range block.Operations {
+		for _, id := range replayIDs(op) {
+			if used[id] {
+				return false
+			}
+			used[id] = true
+		}
+	}
+	return true
+}
+
+// Returns what no other operation may share with op: its key and the R of
+// its signature, and its key and nonce if it UsesNonce.
+func replayIDs(op shared.Operation) []string {
+	ids := []string{fmt.Sprintf("signature %x,%x:%x", op.ArtNodeKey.X, op.ArtNodeKey.Y, op.R)}
+	if op.UsesNonce() {
+		ids = append(ids, fmt.Sprintf("nonce %x,%x:%d", op.ArtNodeKey.X, op.ArtNodeKey.Y, op.Nonce))
+	}
+	return ids
+}
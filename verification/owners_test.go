@@ -0,0 +1,168 @@
+package verification
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"../shared"
+)
+
+func TestCheckOwnerChange(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	friend, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	stranger, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	shape := shared.Operation{ShapeHash: "line", DAttribute: "M 0 0 L 10 0", ArtNodeKey: owner.PublicKey}
+
+	share := shared.Operation{IsShare: true, ShapeHash: "line", ArtNodeKey: owner.PublicKey, TransferTo: friend.PublicKey}
+	if refused := CheckOwnerChange(share, shape, true); refused.Code != shared.NoError {
+		t.Fatal("Expected the owner to be able to share, got", refused)
+	}
+	coOwned := ChangeOwners(shape, share)
+	if !coOwned.OwnedBy(friend.PublicKey) || !coOwned.OwnedBy(owner.PublicKey) || shape.OwnedBy(friend.PublicKey) {
+		t.Error("Expected a share to add a co-owner to a copy of the shape")
+	}
+
+	give := share
+	give.IsShare, give.IsGive = false, true
+	give.ArtNodeKey, give.TransferTo = friend.PublicKey, stranger.PublicKey
+	if refused := CheckOwnerChange(give, coOwned, true); refused.Code != shared.NoError {
+		t.Fatal("Expected a co-owner to be able to give, got", refused)
+	}
+	given := ChangeOwners(coOwned, give)
+	if !given.OwnedBy(stranger.PublicKey) || given.OwnedBy(owner.PublicKey) || given.OwnedBy(friend.PublicKey) {
+		t.Error("Expected a give to leave the new owner alone")
+	}
+
+	again := share
+	again.TransferTo = owner.PublicKey
+	both := share
+	both.IsGive = true
+	for name, c := range map[string]struct {
+		op       shared.Operation
+		onCanvas bool
+		want     shared.ErrorCode
+	}{
+		"missing shape":  {share, false, shared.InvalidShapeHash},
+		"not the owner":  {give, true, shared.ShapeOwner},
+		"already owner":  {again, true, shared.InvalidOwner},
+		"give and share": {both, true, shared.InvalidOwner},
+	} {
+		if refused := CheckOwnerChange(c.op, shape, c.onCanvas); refused.Code != c.want {
+			t.Errorf("Expected %s for %s, got %s", c.want, name, refused)
+		}
+	}
+}
+
+func TestVerifyOperationShapesFollowsOwners(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	friend, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	shape, _ := CheckShape(shared.Operation{DAttribute: "M 0 0 L 10 0", Fill: "transparent", Stroke: "red", ShapeHash: "line", ArtNodeKey: owner.PublicKey}, shapeSettings.CanvasSettings)
+	shapes := map[string]shared.Operation{"line": shape}
+
+	give := shared.Operation{IsGive: true, ShapeHash: "line", ArtNodeKey: owner.PublicKey, TransferTo: friend.PublicKey}
+	deletion := shared.Operation{ShapeHash: "line", IsDelete: true, InkCost: shape.InkCost, ArtNodeKey: friend.PublicKey, PaidBy: owner.PublicKey}
+	if !VerifyOperationShapes(shared.Block{Operations: []shared.Operation{give, deletion}}, shapeSettings, shapes) {
+		t.Error("Expected the new owner to be able to delete the shape after it was given")
+	}
+	if VerifyOperationShapes(shared.Block{Operations: []shared.Operation{deletion}}, shapeSettings, shapes) {
+		t.Error("Expected a delete by a key that does not own the shape to be rejected")
+	}
+	deletion.ArtNodeKey = owner.PublicKey
+	if VerifyOperationShapes(shared.Block{Operations: []shared.Operation{give, deletion}}, shapeSettings, shapes) {
+		t.Error("Expected the old owner not to be able to delete the shape after giving it")
+	}
+}
+
+func TestVerifyOperationsNotReplayed(t *testing.T) {
+	give := shared.Operation{IsGive: true, ShapeHash: "line", Nonce: 1, R: big.NewInt(1), S: big.NewInt(2)}
+	other := shared.Operation{IsGive: true, ShapeHash: "line", Nonce: 2, R: big.NewInt(3), S: big.NewInt(4)}
+	chain := shared.Node{Block: shared.Block{Operations: []shared.Operation{give}}}
+
+	if !VerifyOperationsNotReplayed(shared.Block{Operations: []shared.Operation{other}}, chain) {
+		t.Error("Expected a new operation to pass")
+	}
+	if VerifyOperationsNotReplayed(shared.Block{Operations: []shared.Operation{give}}, chain) {
+		t.Error("Expected an operation already on the chain to be rejected")
+	}
+	if VerifyOperationsNotReplayed(shared.Block{Operations: []shared.Operation{other, other}}, shared.Node{}) {
+		t.Error("Expected an operation twice in one block to be rejected")
+	}
+}
+
+func TestMalleatedSignatureIsReplay(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	friend, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	transfer := shared.Operation{IsTransfer: true, InkCost: 5, Nonce: 7, ArtNodeKey: owner.PublicKey, TransferTo: friend.PublicKey}
+	transfer.R, transfer.S, _ = ecdsa.Sign(rand.Reader, owner, transfer.SignedBytes())
+	chain := shared.Node{Block: shared.Block{Operations: []shared.Operation{transfer}}}
+
+	malleated := transfer
+	malleated.S = new(big.Int).Sub(owner.Curve.Params().N, transfer.S)
+	if !VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{malleated}}) {
+		t.Fatal("Expected N-S to be a valid signature too")
+	}
+	if VerifyOperationsNotReplayed(shared.Block{Operations: []shared.Operation{malleated}}, chain) {
+		t.Error("Expected a copy with S changed to N-S to be rejected")
+	}
+
+	resigned := transfer
+	resigned.R, resigned.S, _ = ecdsa.Sign(rand.Reader, owner, resigned.SignedBytes())
+	if VerifyOperationsNotReplayed(shared.Block{Operations: []shared.Operation{resigned}}, chain) {
+		t.Error("Expected a transfer reusing a nonce to be rejected")
+	}
+	resigned.Nonce = 8
+	resigned.R, resigned.S, _ = ecdsa.Sign(rand.Reader, owner, resigned.SignedBytes())
+	if !VerifyOperationsNotReplayed(shared.Block{Operations: []shared.Operation{resigned}}, chain) {
+		t.Error("Expected the same transfer with a new nonce to pass")
+	}
+}
+
+func TestDeleteSignatureCoversShape(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	deletion := shared.Operation{IsDelete: true, ShapeHash: "given", ArtNodeKey: owner.PublicKey}
+	deletion.R, deletion.S, _ = ecdsa.Sign(rand.Reader, owner, deletion.SignedBytes())
+	if !VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{deletion}}) {
+		t.Fatal("Expected a signed delete to pass")
+	}
+	deletion.ShapeHash = "other"
+	if VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{deletion}}) {
+		t.Error("Expected a delete's signature not to carry over to another shape")
+	}
+}
+
+func TestCoOwnerRefundsPayer(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	friend, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	shape, _ := CheckShape(shared.Operation{DAttribute: "M 0 0 L 10 0", Fill: "transparent", Stroke: "red", ShapeHash: "line", ArtNodeKey: owner.PublicKey}, shapeSettings.CanvasSettings)
+	share := shared.Operation{IsShare: true, ShapeHash: "line", ArtNodeKey: owner.PublicKey, TransferTo: friend.PublicKey}
+	coOwned := ChangeOwners(shape, share)
+	mined := shared.Node{Block: shared.Block{MinerKey: owner.PublicKey}}
+	drawn := shared.Node{Block: shared.Block{MinerKey: friend.PublicKey, Operations: []shared.Operation{shape, share}}, Prev: &mined}
+
+	modify, refused := CheckModify(shared.Operation{IsModify: true, DAttribute: "M 0 0 L 30 0", Fill: "transparent", Stroke: "blue", ShapeHash: "line", ArtNodeKey: friend.PublicKey}, coOwned, true, shapeSettings.CanvasSettings)
+	if refused.Code != shared.NoError || !EqualPublicKey(modify.PaidBy, owner.PublicKey) {
+		t.Fatal("Expected the modify to refund the owner, got", refused)
+	}
+	modified := shared.Node{Block: shared.Block{Operations: []shared.Operation{modify}}, Prev: &drawn}
+	if !CheckPublicKeyHasSufficientInk(50, owner.PublicKey, modified, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the owner to get back the 10 ink the shape cost")
+	}
+	if CheckPublicKeyHasSufficientInk(21, friend.PublicKey, modified, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the co-owner to pay all 30 ink of the new version")
+	}
+
+	deletion := shared.Operation{ShapeHash: "line", IsDelete: true, InkCost: modify.InkCost, ArtNodeKey: owner.PublicKey, PaidBy: ApplyModify(coOwned, modify).Payer()}
+	if !VerifyOperationShapes(shared.Block{Operations: []shared.Operation{modify, deletion}}, shapeSettings, map[string]shared.Operation{"line": coOwned}) {
+		t.Fatal("Expected the owner to be able to delete the co-owner's version")
+	}
+	deleted := shared.Node{Block: shared.Block{Operations: []shared.Operation{deletion}}, Prev: &modified}
+	if CheckPublicKeyHasSufficientInk(51, owner.PublicKey, deleted, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the owner not to be refunded the co-owner's ink")
+	}
+	if !CheckPublicKeyHasSufficientInk(50, friend.PublicKey, deleted, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the co-owner to get back the 30 ink it paid")
+	}
+}
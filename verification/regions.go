@@ -0,0 +1,129 @@
+package verification
+
+import (
+	"math"
+
+	"../blockartlib"
+	"../shared"
+)
+
+// Checks a claim against the claims that hold where it is made: its region
+// must be a rectangle of the canvas on one of its layers, it must last at
+// least one block, carry no shape and not overlap a region another key
+// holds on the same layer. Returns op with its ink cost set to the area of
+// its region, or why the claim is refused.
+func CheckClaim(op shared.Operation, claims []shared.Operation, canvasSettings shared.CanvasSettings) (checked shared.Operation, refused shared.ReplyError) {
+	if !op.IsClaim || op.IsDelete || op.IsTransfer || op.IsOwnerChange() || op.IsModify || op.ShapeHash == "" {
+		return op, shared.NewReplyError(shared.InvalidRegion, op.ShapeHash)
+	}
+	if op.DAttribute != "" || op.AppShapeOp != "" || op.Fill != "" || op.Stroke != "" {
+		return op, shared.NewReplyError(shared.InvalidRegion, op.ShapeHash)
+	}
+	region := op.Region
+	if op.ClaimBlocks == 0 || region.MinX >= region.MaxX || region.MinY >= region.MaxY {
+		return op, shared.NewReplyError(shared.InvalidRegion, op.ShapeHash)
+	}
+	if region.MaxX > canvasSettings.CanvasXMax || region.MaxY > canvasSettings.CanvasYMax {
+		return op, shared.NewReplyError(shared.OutOfBounds, op.ShapeHash)
+	}
+	if _, ok := canvasSettings.LayerIndex(op.Layer); !ok {
+		return op, shared.NewReplyError(shared.InvalidLayer, op.Layer)
+	}
+	if claim, inTheWay := ClaimInTheWay(op, claims); inTheWay {
+		return op, shared.NewReplyError(shared.RegionClaimed, claim.ShapeHash)
+	}
+
+	area := uint64(region.MaxX-region.MinX) * uint64(region.MaxY-region.MinY)
+	if area > math.MaxUint32 {
+		return op, shared.NewReplyError(shared.InvalidRegion, op.ShapeHash)
+	}
+	op.InkCost = uint32(area)
+	return op, refused
+}
+
+// Returns the claims on blockChain that still hold for a block added after
+// it.
+func ActiveClaims(blockChain shared.Node) []shared.Operation {
+	var claims []shared.Operation
+	blocksAfter := uint32(1)
+	for current := &blockChain; current != nil; current = current.Prev {
+		for _, op := range current.Block.Operations {
+			if op.IsClaim && op.ClaimBlocks >= blocksAfter {
+				claims = append(claims, op)
+			}
+		}
+		blocksAfter++
+	}
+	return claims
+}
+
+// Returns a claim in claims that keeps op's key from drawing the shape or
+// claiming the region of op: one by another key, on op's layer, whose
+// region overlaps the bounding box of op's shape or op's region. Returns
+// false if there is none.
+func ClaimInTheWay(op shared.Operation, claims []shared.Operation) (claim shared.Operation, inTheWay bool) {
+	if !op.IsClaim && !op.IsModify && !op.IsAdd() {
+		return claim, false
+	}
+	bounds := op.Region
+	if !op.IsClaim {
+		bounds = shapeBounds(op.DAttribute)
+	}
+	for _, c := range claims {
+		if c.Layer != op.Layer || EqualPublicKey(c.ArtNodeKey, op.ArtNodeKey) {
+			continue
+		}
+		if overlaps(c.Region, bounds) {
+			return c, true
+		}
+	}
+	return claim, false
+}
+
+// Verifies that every claim in block passes CheckClaim with the ink cost
+// it computes under the ID ContentHash derives, and that no shape is added
+// or modified in a region another key holds. Claims hold from the op after
+// them in block.
+func VerifyRegionClaims(block shared.Block, blockChain shared.Node, canvasSettings shared.CanvasSettings) (valid bool) {
+	claims := ActiveClaims(blockChain)
+	for _, op := range block.Operations {
+		if op.IsClaim {
+			checked, refused := CheckClaim(op, claims, canvasSettings)
+			if refused.Code != shared.NoError || checked.InkCost != op.InkCost || op.ShapeHash != op.ContentHash() {
+				return false
+			}
+			claims = append(claims, op)
+			continue
+		}
+		if _, inTheWay := ClaimInTheWay(op, claims); inTheWay {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the smallest region that holds every point of the svg path d.
+func shapeBounds(d string) (bounds shared.Region) {
+	xs, ys := blockartlib.SvgToPoints(d)
+	for i := range xs {
+		x, y := uint32(xs[i]), uint32(ys[i])
+		if i == 0 || x < bounds.MinX {
+			bounds.MinX = x
+		}
+		if i == 0 || y < bounds.MinY {
+			bounds.MinY = y
+		}
+		if i == 0 || x+1 > bounds.MaxX {
+			bounds.MaxX = x + 1
+		}
+		if i == 0 || y+1 > bounds.MaxY {
+			bounds.MaxY = y + 1
+		}
+	}
+	return bounds
+}
+
+// Whether regions a and b have a point in common.
+func overlaps(a, b shared.Region) bool {
+	return a.MinX < b.MaxX && b.MinX < a.MaxX && a.MinY < b.MaxY && b.MinY < a.MaxY
+}
@@ -0,0 +1,129 @@
+package verification
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"../collision"
+	"../shared"
+)
+
+var layerSettings = shared.CanvasSettings{CanvasXMax: 100, CanvasYMax: 100, Layers: []string{"top"}}
+
+func TestCheckClaim(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	claim := shared.Operation{IsClaim: true, ShapeHash: "corner", Layer: "top", Region: shared.Region{MaxX: 10, MaxY: 20}, ClaimBlocks: 3, ArtNodeKey: owner.PublicKey}
+	checked, refused := CheckClaim(claim, nil, layerSettings)
+	if refused.Code != shared.NoError || checked.InkCost != 200 {
+		t.Fatal("Expected a valid claim costing 200 ink, got", refused, checked.InkCost)
+	}
+
+	overlapping := claim
+	overlapping.ShapeHash = "overlapping"
+	overlapping.Region = shared.Region{MinX: 5, MinY: 5, MaxX: 15, MaxY: 15}
+	overlapping.ArtNodeKey = other.PublicKey
+	below := overlapping
+	below.Layer = ""
+	if _, refused := CheckClaim(below, []shared.Operation{checked}, layerSettings); refused.Code != shared.NoError {
+		t.Error("Expected a claim on another layer to pass, got", refused)
+	}
+	if _, refused := CheckClaim(overlapping, []shared.Operation{checked}, layerSettings); refused.Code != shared.RegionClaimed || refused.Subject != "corner" {
+		t.Error("Expected a claim overlapping another key's claim to be refused, got", refused)
+	}
+
+	empty := claim
+	empty.Region.MaxX = 0
+	forever := claim
+	forever.ClaimBlocks = 0
+	drawn := claim
+	drawn.DAttribute = "M 0 0 L 10 0"
+	outside := claim
+	outside.Region.MaxY = 101
+	nowhere := claim
+	nowhere.Layer = "middle"
+	for name, c := range map[string]struct {
+		op   shared.Operation
+		want shared.ErrorCode
+	}{
+		"empty":   {empty, shared.InvalidRegion},
+		"forever": {forever, shared.InvalidRegion},
+		"drawn":   {drawn, shared.InvalidRegion},
+		"outside": {outside, shared.OutOfBounds},
+		"nowhere": {nowhere, shared.InvalidLayer},
+	} {
+		if _, refused := CheckClaim(c.op, nil, layerSettings); refused.Code != c.want {
+			t.Errorf("Expected %s for the %s claim, got %s", c.want, name, refused)
+		}
+	}
+}
+
+func TestVerifyRegionClaims(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	claim := shared.Operation{IsClaim: true, Region: shared.Region{MaxX: 10, MaxY: 10}, ClaimBlocks: 2, InkCost: 100, ArtNodeKey: owner.PublicKey}
+	claim.R, claim.S, _ = ecdsa.Sign(rand.Reader, owner, claim.SignedBytes())
+	claim.ShapeHash = claim.ContentHash()
+	inside := shared.Operation{DAttribute: "M 5 5 L 20 20", Fill: "transparent", Stroke: "red", ArtNodeKey: other.PublicKey}
+	outside := inside
+	outside.DAttribute = "M 10 10 L 20 20"
+
+	if VerifyRegionClaims(shared.Block{Operations: []shared.Operation{claim, inside}}, shared.Node{}, layerSettings) {
+		t.Error("Expected a shape in a region claimed earlier in the block to be rejected")
+	}
+	if !VerifyRegionClaims(shared.Block{Operations: []shared.Operation{claim, outside}}, shared.Node{}, layerSettings) {
+		t.Error("Expected a shape next to the claimed region to pass")
+	}
+	cheap := claim
+	cheap.InkCost = 1
+	if VerifyRegionClaims(shared.Block{Operations: []shared.Operation{cheap}}, shared.Node{}, layerSettings) {
+		t.Error("Expected a claim that does not pay for its area to be rejected")
+	}
+	picked := claim
+	picked.ShapeHash = "corner"
+	if VerifyRegionClaims(shared.Block{Operations: []shared.Operation{picked}}, shared.Node{}, layerSettings) {
+		t.Error("Expected a claim with an ID its key picked to be rejected")
+	}
+
+	// The claim holds for the two blocks after its own
+	claimed := shared.Node{Block: shared.Block{Operations: []shared.Operation{claim}}}
+	next := shared.Node{Prev: &claimed}
+	after := shared.Node{Prev: &next}
+	block := shared.Block{Operations: []shared.Operation{inside}}
+	if VerifyRegionClaims(block, claimed, layerSettings) || VerifyRegionClaims(block, next, layerSettings) {
+		t.Error("Expected the claim to hold for two blocks")
+	}
+	if !VerifyRegionClaims(block, after, layerSettings) {
+		t.Error("Expected the claim to have run out")
+	}
+	mine := inside
+	mine.ArtNodeKey = owner.PublicKey
+	if !VerifyRegionClaims(shared.Block{Operations: []shared.Operation{mine}}, claimed, layerSettings) {
+		t.Error("Expected the key holding the claim to draw in its region")
+	}
+}
+
+func TestShapesOnlyOverlapOnTheirLayer(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	below, _ := CheckShape(shared.Operation{DAttribute: "M 0 0 L 10 10", Fill: "transparent", Stroke: "red", ShapeHash: "below", ArtNodeKey: owner.PublicKey}, layerSettings)
+	above, refused := CheckShape(shared.Operation{DAttribute: "M 0 10 L 10 0", Fill: "transparent", Stroke: "red", Layer: "top", ArtNodeKey: other.PublicKey}, layerSettings)
+	if refused.Code != shared.NoError {
+		t.Fatal("Expected a shape on the top layer to pass, got", refused)
+	}
+	shapes := map[string]shared.Operation{"below": below}
+
+	if collides, _ := collision.CollideWithOtherShapes(above, shapes); collides {
+		t.Error("Expected a shape not to overlap a shape on another layer")
+	}
+	above.Layer = ""
+	if collides, _ := collision.CollideWithOtherShapes(above, shapes); !collides {
+		t.Error("Expected a shape to overlap a shape on its own layer")
+	}
+	above.Layer = "middle"
+	if _, refused := CheckShape(above, layerSettings); refused.Code != shared.InvalidLayer {
+		t.Error("Expected InvalidLayer for a layer the canvas does not have, got", refused)
+	}
+}
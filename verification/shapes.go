@@ -0,0 +1,158 @@
+package verification
+
+import (
+	"regexp"
+
+	"../blockartlib"
+	"../shared"
+)
+
+// Colours a shape may be filled or stroked with: names, #hex, rgb(...) and
+// the like, but nothing that could end the svg attribute it goes in.
+var colourPattern = regexp.MustCompile(`^[#A-Za-z0-9(),.% -]{1,32}$`)
+
+// Checks the shape of an add operation the way blockartlib does before
+// sending it, without trusting anything it computed: the svg path must be
+// a valid path of at most 128 characters that fits on the canvas and uses
+// some ink, with a fill and a stroke, on one of the canvas's layers.
+// Returns op with its ink cost and svg string rebuilt from the checked
+// parts, or why the shape is invalid.
+func CheckShape(op shared.Operation, canvasSettings shared.CanvasSettings) (checked shared.Operation, refused shared.ReplyError) {
+	if blockartlib.ShapeType(op.ShapeType) != blockartlib.PATH {
+		return op, shared.NewReplyError(shared.InvalidShapeSvgString, op.DAttribute)
+	}
+	err, _ := blockartlib.IsValidSvgShape(blockartlib.CanvasSettings(canvasSettings), blockartlib.PATH, op.DAttribute, op.Fill, op.Stroke)
+	switch err.(type) {
+	case nil:
+	case blockartlib.ShapeSvgStringTooLongError:
+		return op, shared.NewReplyError(shared.ShapeSvgStringTooLong, op.DAttribute)
+	case *blockartlib.OutOfBoundsError, blockartlib.OutOfBoundsError:
+		return op, shared.NewReplyError(shared.OutOfBounds, op.DAttribute)
+	default:
+		return op, shared.NewReplyError(shared.InvalidShapeSvgString, op.DAttribute)
+	}
+	if !colourPattern.MatchString(op.Fill) || !colourPattern.MatchString(op.Stroke) {
+		return op, shared.NewReplyError(shared.InvalidShapeSvgString, op.DAttribute)
+	}
+	if _, ok := canvasSettings.LayerIndex(op.Layer); !ok {
+		return op, shared.NewReplyError(shared.InvalidLayer, op.Layer)
+	}
+
+	op.AppShapeOp = "<path d=\"" + op.DAttribute + "\" stroke=\"" + op.Stroke + "\" fill=\"" + op.Fill + "\"/>"
+	op.InkCost = blockartlib.CalculateInkUsed(blockartlib.PATH, op.DAttribute, op.Fill, op.Stroke)
+	if op.InkCost == 0 {
+		// Nothing would be drawn, and a free shape would still take up
+		// its hash and count against collisions
+		return op, shared.NewReplyError(shared.InvalidShapeSvgString, op.DAttribute)
+	}
+	return op, refused
+}
+
+// Checks a modify against the shape it replaces, as it is on the canvas
+// (onCanvas is false if it is not there): the shape must be on the canvas
+// and owned by op's key, and op's new shape must pass CheckShape. Returns
+// op with its ink cost and svg string rebuilt as CheckShape does, and the
+// version, replaced ink cost, payer to refund and layer the shape on the
+// canvas calls for, or why the modify is refused.
+func CheckModify(op shared.Operation, shape shared.Operation, onCanvas bool, canvasSettings shared.CanvasSettings) (checked shared.Operation, refused shared.ReplyError) {
+	if !onCanvas {
+		return op, shared.NewReplyError(shared.InvalidShapeHash, op.ShapeHash)
+	}
+	if !shape.OwnedBy(op.ArtNodeKey) {
+		return op, shared.NewReplyError(shared.ShapeOwner, op.ShapeHash)
+	}
+	op.Layer = shape.Layer
+	if checked, refused = CheckShape(op, canvasSettings); refused.Code != shared.NoError {
+		return op, refused
+	}
+	checked.Version = shape.Version + 1
+	checked.ReplacedInkCost = shape.InkCost
+	checked.PaidBy = shape.Payer()
+	return checked, refused
+}
+
+// Returns shape replaced by the modify op, which must have passed
+// CheckModify. The shape keeps its hash, owners and layer.
+func ApplyModify(shape shared.Operation, op shared.Operation) shared.Operation {
+	shape.AppShapeOp = op.AppShapeOp
+	shape.Fill = op.Fill
+	shape.Stroke = op.Stroke
+	shape.DAttribute = op.DAttribute
+	shape.ShapeType = op.ShapeType
+	shape.InkCost = op.InkCost
+	shape.Version = op.Version
+	shape.PaidBy = op.ArtNodeKey
+	return shape
+}
+
+// Verifies that every add operation in block holds a shape that passes
+// CheckShape with the ink cost and svg string CheckShape computes, under
+// the hash ContentHash derives, which no shape on the canvas or earlier in
+// block has. Verifies that every give and share passes CheckOwnerChange,
+// that every modify passes CheckModify in the same way, and that every
+// delete is by one of the shape's owners and refunds what the shape cost
+// to the key that paid it.
+// Shapes are those of allShapes after the ops before them in block.
+// A shape deleted earlier in block is gone: it cannot be deleted, modified,
+// given or shared again in block. Other deletes of shapes not in allShapes
+// are left to ShapeExistsInShapeHash, and claims to VerifyRegionClaims.
+func VerifyOperationShapes(block shared.Block, minerNetSettings shared.MinerNetSettings, allShapes map[string]shared.Operation) (valid bool) {
+	changed := make(map[string]shared.Operation)
+	deleted := make(map[string]bool)
+	shapeOf := func(hash string) (shared.Operation, bool) {
+		if deleted[hash] {
+			return shared.Operation{}, false
+		}
+		if shape, ok := changed[hash]; ok {
+			return shape, true
+		}
+		shape, ok := allShapes[hash]
+		return shape, ok
+	}
+
+	for _, op := range block.Operations {
+		if op.IsTransfer || op.IsClaim {
+			continue
+		}
+		if op.IsOwnerChange() {
+			shape, ok := shapeOf(op.ShapeHash)
+			if CheckOwnerChange(op, shape, ok).Code != shared.NoError {
+				return false
+			}
+			changed[op.ShapeHash] = ChangeOwners(shape, op)
+			continue
+		}
+		if op.IsModify {
+			shape, ok := shapeOf(op.ShapeHash)
+			checked, refused := CheckModify(op, shape, ok, minerNetSettings.CanvasSettings)
+			if refused.Code != shared.NoError || checked.InkCost != op.InkCost || checked.AppShapeOp != op.AppShapeOp ||
+				checked.Version != op.Version || checked.ReplacedInkCost != op.ReplacedInkCost || checked.Layer != op.Layer ||
+				!EqualPublicKey(checked.PaidBy, op.PaidBy) {
+				return false
+			}
+			changed[op.ShapeHash] = ApplyModify(shape, op)
+			continue
+		}
+		if op.IsDelete {
+			if deleted[op.ShapeHash] {
+				return false
+			}
+			shape, ok := shapeOf(op.ShapeHash)
+			if ok && (op.InkCost != shape.InkCost || !shape.OwnedBy(op.ArtNodeKey) || !EqualPublicKey(op.PaidBy, shape.Payer())) {
+				return false
+			}
+			deleted[op.ShapeHash] = true
+			continue
+		}
+
+		checked, refused := CheckShape(op, minerNetSettings.CanvasSettings)
+		if refused.Code != shared.NoError || checked.InkCost != op.InkCost || checked.AppShapeOp != op.AppShapeOp || op.PaidBy.X != nil {
+			return false
+		}
+		if _, taken := shapeOf(op.ShapeHash); taken || op.ShapeHash != op.ContentHash() {
+			return false
+		}
+		changed[op.ShapeHash] = op
+	}
+	return true
+}
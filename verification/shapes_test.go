@@ -0,0 +1,177 @@
+package verification
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"../shared"
+)
+
+var shapeSettings = shared.MinerNetSettings{CanvasSettings: shared.CanvasSettings{CanvasXMax: 100, CanvasYMax: 100}}
+
+func TestCheckShapeRebuildsOperation(t *testing.T) {
+	op := shared.Operation{DAttribute: "M 0 0 L 10 0", Fill: "transparent", Stroke: "red", AppShapeOp: "<circle/>", InkCost: 0}
+	checked, refused := CheckShape(op, shapeSettings.CanvasSettings)
+	if refused.Code != shared.NoError {
+		t.Fatal("Expected a valid shape, got", refused)
+	}
+	if checked.InkCost != 10 || checked.AppShapeOp != `<path d="M 0 0 L 10 0" stroke="red" fill="transparent"/>` {
+		t.Error("Expected the ink cost and svg string to be recomputed, got", checked.InkCost, checked.AppShapeOp)
+	}
+}
+
+func TestCheckShapeRefusals(t *testing.T) {
+	for _, c := range []struct {
+		op   shared.Operation
+		want shared.ErrorCode
+	}{
+		{shared.Operation{DAttribute: "M 0 0 L 200 0", Fill: "transparent", Stroke: "red"}, shared.OutOfBounds},
+		{shared.Operation{DAttribute: "M 0 0 L 4294967296 0", Fill: "transparent", Stroke: "red"}, shared.OutOfBounds},
+		{shared.Operation{DAttribute: "M 0 0 L 0 0", Fill: "transparent", Stroke: "red"}, shared.InvalidShapeSvgString},
+		{shared.Operation{DAttribute: "M 0 0 C 1 1", Fill: "transparent", Stroke: "red"}, shared.InvalidShapeSvgString},
+		{shared.Operation{DAttribute: "M 0 0 L 1 1", Fill: "", Stroke: "red"}, shared.InvalidShapeSvgString},
+		{shared.Operation{DAttribute: "M 0 0 L 1 1", Fill: "transparent", Stroke: `red" onload="x`}, shared.InvalidShapeSvgString},
+		{shared.Operation{DAttribute: "M 0 0 L 1 1", Fill: "transparent", Stroke: "red", ShapeType: 1}, shared.InvalidShapeSvgString},
+		{shared.Operation{DAttribute: "M 0 0" + string(make([]byte, 130)), Fill: "transparent", Stroke: "red"}, shared.ShapeSvgStringTooLong},
+	} {
+		if _, refused := CheckShape(c.op, shapeSettings.CanvasSettings); refused.Code != c.want {
+			t.Errorf("Expected %s for %q, got %s", c.want, c.op.DAttribute, refused)
+		}
+	}
+}
+
+func TestVerifyOperationShapes(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	honest := signedShape(owner, "M 0 0 L 10 0")
+	shapes := map[string]shared.Operation{honest.ShapeHash: honest}
+
+	if !VerifyOperationShapes(shared.Block{Operations: []shared.Operation{honest}}, shapeSettings, nil) {
+		t.Error("Expected an honest shape to pass")
+	}
+
+	cheap := honest
+	cheap.InkCost = 0
+	forged := honest
+	forged.AppShapeOp = `<path d="M 0 0 L 100 100" stroke="red" fill="transparent"/>`
+	outside := honest
+	outside.DAttribute = "M 0 0 L 500 0"
+	for name, op := range map[string]shared.Operation{"cheap": cheap, "forged": forged, "outside": outside} {
+		if VerifyOperationShapes(shared.Block{Operations: []shared.Operation{op}}, shapeSettings, nil) {
+			t.Error("Expected the", name, "shape to be rejected")
+		}
+	}
+
+	deletion := shared.Operation{ShapeHash: honest.ShapeHash, IsDelete: true, InkCost: honest.InkCost, ArtNodeKey: owner.PublicKey, PaidBy: owner.PublicKey}
+	if !VerifyOperationShapes(shared.Block{Operations: []shared.Operation{deletion}}, shapeSettings, shapes) {
+		t.Error("Expected the owner's delete to pass")
+	}
+	again := deletion
+	again.R, again.S = big.NewInt(1), big.NewInt(2)
+	modify, _ := CheckModify(shared.Operation{IsModify: true, DAttribute: "M 0 0 L 5 0", Fill: "transparent", Stroke: "red", ShapeHash: honest.ShapeHash, ArtNodeKey: owner.PublicKey}, honest, true, shapeSettings.CanvasSettings)
+	for name, ops := range map[string][]shared.Operation{"deleted twice": {deletion, again}, "modified after its delete": {deletion, modify}} {
+		if VerifyOperationShapes(shared.Block{Operations: ops}, shapeSettings, shapes) {
+			t.Error("Expected a shape", name, "in one block to be rejected")
+		}
+	}
+	greedy := deletion
+	greedy.InkCost = 1000
+	stolen := deletion
+	stolen.ArtNodeKey = other.PublicKey
+	redirected := deletion
+	redirected.PaidBy = other.PublicKey
+	for name, op := range map[string]shared.Operation{"greedy": greedy, "stolen": stolen, "redirected": redirected} {
+		if VerifyOperationShapes(shared.Block{Operations: []shared.Operation{op}}, shapeSettings, shapes) {
+			t.Error("Expected the", name, "delete to be rejected")
+		}
+	}
+}
+
+func TestVerifyShapeHashes(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	line := signedShape(owner, "M 0 0 L 10 0")
+	again := signedShape(owner, "M 0 0 L 10 0")
+	if again.ShapeHash == line.ShapeHash {
+		t.Fatal("Expected the same shape signed twice to get two hashes")
+	}
+	if !VerifyOperationShapes(shared.Block{Operations: []shared.Operation{line, again}}, shapeSettings, nil) {
+		t.Error("Expected the same shape signed twice to pass")
+	}
+
+	picked := line
+	picked.ShapeHash = "line"
+	copied := line
+	copied.ArtNodeKey = other.PublicKey
+	restyled, _ := CheckShape(shared.Operation{DAttribute: line.DAttribute, Fill: "red", Stroke: "red", ArtNodeKey: owner.PublicKey, ShapeHash: line.ShapeHash, R: line.R, S: line.S}, shapeSettings.CanvasSettings)
+	if VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{restyled}}) {
+		t.Error("Expected the signature of a shape not to cover it restyled")
+	}
+	for name, c := range map[string]struct {
+		ops    []shared.Operation
+		shapes map[string]shared.Operation
+	}{
+		"picked hash":      {[]shared.Operation{picked}, nil},
+		"copied signature": {[]shared.Operation{copied}, nil},
+		"restyled shape":   {[]shared.Operation{restyled}, nil},
+		"hash on canvas":   {[]shared.Operation{line}, map[string]shared.Operation{line.ShapeHash: line}},
+		"twice in block":   {[]shared.Operation{line, line}, nil},
+	} {
+		if VerifyOperationShapes(shared.Block{Operations: c.ops}, shapeSettings, c.shapes) {
+			t.Error("Expected a shape with a", name, "to be rejected")
+		}
+	}
+}
+
+func TestVerifyModify(t *testing.T) {
+	owner, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	shape, _ := CheckShape(shared.Operation{DAttribute: "M 0 0 L 10 0", Fill: "transparent", Stroke: "red", ShapeHash: "line", ArtNodeKey: owner.PublicKey}, shapeSettings.CanvasSettings)
+	shapes := map[string]shared.Operation{"line": shape}
+
+	longer, refused := CheckModify(shared.Operation{IsModify: true, DAttribute: "M 0 0 L 30 0", Fill: "transparent", Stroke: "blue", ShapeHash: "line", ArtNodeKey: owner.PublicKey}, shape, true, shapeSettings.CanvasSettings)
+	if refused.Code != shared.NoError {
+		t.Fatal("Expected the owner to be able to modify, got", refused)
+	}
+	if longer.Version != 1 || longer.ReplacedInkCost != 10 || longer.InkCost != 30 || longer.InkSpent() != 20 {
+		t.Error("Expected version 1 charged 20 more ink, got", longer.Version, longer.InkSpent())
+	}
+	modified := ApplyModify(shape, longer)
+	if modified.ShapeHash != "line" || modified.Version != 1 || modified.Stroke != "blue" || !modified.OwnedBy(owner.PublicKey) {
+		t.Error("Expected the shape to keep its hash and owner and take the new fields")
+	}
+
+	second, _ := CheckModify(shared.Operation{IsModify: true, DAttribute: "M 0 0 L 5 0", Fill: "transparent", Stroke: "blue", ShapeHash: "line", ArtNodeKey: owner.PublicKey}, modified, true, shapeSettings.CanvasSettings)
+	if !VerifyOperationShapes(shared.Block{Operations: []shared.Operation{longer, second}}, shapeSettings, shapes) {
+		t.Error("Expected two modifies in a row to pass")
+	}
+	if second.Version != 2 || second.InkSpent() != -25 {
+		t.Error("Expected version 2 refunded 25 ink, got", second.Version, second.InkSpent())
+	}
+
+	stale := longer
+	stale.ReplacedInkCost = 0
+	skipped := longer
+	skipped.Version = 5
+	stolen := longer
+	stolen.ArtNodeKey = other.PublicKey
+	for name, op := range map[string]shared.Operation{"stale": stale, "skipped": skipped, "stolen": stolen} {
+		if VerifyOperationShapes(shared.Block{Operations: []shared.Operation{op}}, shapeSettings, shapes) {
+			t.Error("Expected the", name, "modify to be rejected")
+		}
+	}
+	if _, refused := CheckModify(longer, shape, false, shapeSettings.CanvasSettings); refused.Code != shared.InvalidShapeHash {
+		t.Error("Expected InvalidShapeHash for a shape not on the canvas, got", refused)
+	}
+}
+
+// Returns the shape d checked, signed by key and hashed as miners do.
+func signedShape(key *ecdsa.PrivateKey, d string) shared.Operation {
+	op, _ := CheckShape(shared.Operation{DAttribute: d, Fill: "transparent", Stroke: "red", ArtNodeKey: key.PublicKey}, shapeSettings.CanvasSettings)
+	op.R, op.S, _ = ecdsa.Sign(rand.Reader, key, op.SignedBytes())
+	op.ShapeHash = op.ContentHash()
+	return op
+}
@@ -0,0 +1,32 @@
+package verification
+
+import (
+	"../shared"
+)
+
+// Checks a transfer on its own: it must move some ink to a usable key other
+// than the sender's, and carry no shape. Whether the sender has the ink
+// depends on the chain and is left to VerifySufficientInkForOperationsInBlock.
+func CheckTransfer(op shared.Operation) (refused shared.ReplyError) {
+	if !op.IsTransfer || op.IsDelete || op.ShapeHash == "" || op.InkCost == 0 {
+		return shared.NewReplyError(shared.InvalidTransfer, op.ShapeHash)
+	}
+	if op.DAttribute != "" || op.AppShapeOp != "" || op.Fill != "" || op.Stroke != "" {
+		return shared.NewReplyError(shared.InvalidTransfer, op.ShapeHash)
+	}
+	if !VerifyPublicKey(op.TransferTo) || EqualPublicKey(op.TransferTo, op.ArtNodeKey) {
+		return shared.NewReplyError(shared.InvalidTransfer, op.ShapeHash)
+	}
+	return refused
+}
+
+// Verifies that every transfer in block passes CheckTransfer under the ID
+// ContentHash derives.
+func VerifyTransfers(block shared.Block) (valid bool) {
+	for _, op := range block.Operations {
+		if op.IsTransfer && (CheckTransfer(op).Code != shared.NoError || op.ShapeHash != op.ContentHash()) {
+			return false
+		}
+	}
+	return true
+}
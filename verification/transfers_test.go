@@ -0,0 +1,101 @@
+package verification
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"../shared"
+)
+
+var transferSettings = shared.MinerNetSettings{InkPerOpBlock: 50, InkPerNoOpBlock: 10}
+
+func TestCheckTransferRefusals(t *testing.T) {
+	from, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	valid := shared.Operation{IsTransfer: true, ShapeHash: "gift", InkCost: 5, ArtNodeKey: from.PublicKey, TransferTo: to.PublicKey}
+	if refused := CheckTransfer(valid); refused.Code != shared.NoError {
+		t.Fatal("Expected a valid transfer, got", refused)
+	}
+
+	free := valid
+	free.InkCost = 0
+	unnamed := valid
+	unnamed.ShapeHash = ""
+	drawn := valid
+	drawn.DAttribute = "M 0 0 L 10 0"
+	deleted := valid
+	deleted.IsDelete = true
+	nobody := valid
+	nobody.TransferTo = ecdsa.PublicKey{}
+	self := valid
+	self.TransferTo = from.PublicKey
+	for name, op := range map[string]shared.Operation{"free": free, "unnamed": unnamed, "drawn": drawn, "deleted": deleted, "nobody": nobody, "self": self} {
+		if refused := CheckTransfer(op); refused.Code != shared.InvalidTransfer {
+			t.Errorf("Expected the %s transfer to be refused, got %s", name, refused)
+		}
+	}
+}
+
+func TestTransferredInkCanBeSpent(t *testing.T) {
+	from, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	mined := shared.Node{Block: shared.Block{MinerKey: from.PublicKey}}
+	transfer := shared.Operation{IsTransfer: true, ShapeHash: "gift", InkCost: 30, ArtNodeKey: from.PublicKey, TransferTo: to.PublicKey}
+	chain := shared.Node{Block: shared.Block{Operations: []shared.Operation{transfer}}, Prev: &mined}
+
+	if !CheckPublicKeyHasSufficientInk(30, to.PublicKey, chain, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the recipient to have the 30 ink transferred")
+	}
+	if CheckPublicKeyHasSufficientInk(21, from.PublicKey, chain, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the sender to have only 20 ink left")
+	}
+}
+
+func TestSufficientInkCountsWholeBlock(t *testing.T) {
+	from, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	mined := shared.Node{Block: shared.Block{MinerKey: from.PublicKey}}
+	first := shared.Operation{IsTransfer: true, ShapeHash: "first", InkCost: 30, ArtNodeKey: from.PublicKey, TransferTo: to.PublicKey}
+	second := first
+	second.ShapeHash = "second"
+
+	if !VerifySufficientInkForOperationsInBlock(shared.Block{Operations: []shared.Operation{first}}, mined, transferSettings) {
+		t.Error("Expected one transfer of 30 out of 50 ink to pass")
+	}
+	if VerifySufficientInkForOperationsInBlock(shared.Block{Operations: []shared.Operation{first, second}}, mined, transferSettings) {
+		t.Error("Expected two transfers of 30 out of 50 ink in one block to be rejected")
+	}
+}
+
+func TestTransferLargerThanBalanceDoesNotWrap(t *testing.T) {
+	from, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	mined := shared.Node{Block: shared.Block{MinerKey: from.PublicKey, IsNoopBlock: true}}
+	transfer := shared.Operation{IsTransfer: true, ShapeHash: "wrap", InkCost: 4294967291, ArtNodeKey: from.PublicKey, TransferTo: to.PublicKey}
+
+	if VerifySufficientInkForOperationsInBlock(shared.Block{Operations: []shared.Operation{transfer}}, mined, transferSettings) {
+		t.Error("Expected a transfer of 4294967291 out of 10 ink to be rejected")
+	}
+	chain := shared.Node{Block: shared.Block{Operations: []shared.Operation{transfer}}, Prev: &mined}
+	if CheckPublicKeyHasSufficientInk(1, from.PublicKey, chain, transferSettings.InkPerOpBlock, transferSettings.InkPerNoOpBlock) {
+		t.Error("Expected the sender of an overdrawn transfer to have no ink")
+	}
+}
+
+func TestVerifyTransferIDs(t *testing.T) {
+	from, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	to, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	transfer := shared.Operation{IsTransfer: true, InkCost: 5, ArtNodeKey: from.PublicKey, TransferTo: to.PublicKey}
+	transfer.R, transfer.S, _ = ecdsa.Sign(rand.Reader, from, transfer.SignedBytes())
+	transfer.ShapeHash = transfer.ContentHash()
+	if !VerifyTransfers(shared.Block{Operations: []shared.Operation{transfer}}) {
+		t.Error("Expected a transfer with the ID ContentHash derives to pass")
+	}
+	picked := transfer
+	picked.ShapeHash = "gift"
+	if VerifyTransfers(shared.Block{Operations: []shared.Operation{picked}}) {
+		t.Error("Expected a transfer with an ID its sender picked to be rejected")
+	}
+}
@@ -2,46 +2,99 @@ package verification
 
 import "crypto/ecdsa"
 import (
+	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/x509"
 	"encoding/hex"
-	"fmt"
+	"log/slog"
 	"math"
 	"math/big"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"../blockartlib"
 	"../collision"
+	"../logging"
 	"../shared"
 )
 
+// Where VerifyBlock logs why it rejected a block. Tools set it up to match
+// their own log level.
+var Logger = logging.New(os.Stderr, slog.LevelInfo, "verification")
+
 // Verifies a block, by checking that the miner had sufficient ink for the operations
 // contained in the block. In addition, may verify that the operations did indeed come from
 // that block by checking the public key.
 
 func VerifyBlock(block shared.Block, blockChain shared.Node, minerNetSettings shared.MinerNetSettings, existingBlockHashes map[string]shared.Block, allShapes map[string]shared.Operation) (verified bool) {
+	return CheckBlock(block, blockChain, minerNetSettings, existingBlockHashes, allShapes) == ""
+}
+
+// Same as VerifyBlock, but returns the name of the first check the block
+// failed, e.g. "VerifyProofOfWork", or "" if it passed all of them.
+func CheckBlock(block shared.Block, blockChain shared.Node, minerNetSettings shared.MinerNetSettings, existingBlockHashes map[string]shared.Block, allShapes map[string]shared.Operation) (failed string) {
 
 	// Verifies the proof of work, that there are the correct
 	// number of zeroes in the hash, and that the nonce + block
 	// contents hash to that hash
-	if !VerifyProofOfWork(block, minerNetSettings) {
-		fmt.Println("VerifyBlock - VerifyProofOfWork failed")
-		return false
+	if !VerifyProofOfWork(block, blockChain, minerNetSettings) {
+		Logger.Info("block rejected", "check", "VerifyProofOfWork", "block", block.Hash)
+		return "VerifyProofOfWork"
+	}
+
+	// Verifies that the block was mined on behalf of a usable key
+	if !VerifyPublicKey(block.MinerKey) {
+		Logger.Info("block rejected", "check", "VerifyPublicKey", "block", block.Hash)
+		return "VerifyPublicKey"
+	}
+
+	// Verifies that the block's timestamp, which the difficulty depends
+	// on, is plausible
+	if !VerifyTimestamp(block, blockChain) {
+		Logger.Info("block rejected", "check", "VerifyTimestamp", "block", block.Hash)
+		return "VerifyTimestamp"
 	}
 
 	// Verifies that each of the operations in the block
 	// came from the correct private key, using the
 	// the public key and signature
 	if !VerifyOperationSignatures(block) {
-		fmt.Println("VerifyBlock - VerifyOperationSignatures failed")
-		return false
+		Logger.Info("block rejected", "check", "VerifyOperationSignatures", "block", block.Hash)
+		return "VerifyOperationSignatures"
+	}
+
+	// Verifies that no operation is a copy of one already on the chain
+	if !VerifyOperationsNotReplayed(block, blockChain) {
+		Logger.Info("block rejected", "check", "VerifyOperationsNotReplayed", "block", block.Hash)
+		return "VerifyOperationsNotReplayed"
+	}
+
+	// Verifies that each transfer moves ink to another usable key
+	if !VerifyTransfers(block) {
+		Logger.Info("block rejected", "check", "VerifyTransfers", "block", block.Hash)
+		return "VerifyTransfers"
+	}
+
+	// Verifies that each shape is valid and charges or refunds the ink it
+	// should, rather than what the miner claims, and that only owners
+	// delete, give or share shapes
+	if !VerifyOperationShapes(block, minerNetSettings, allShapes) {
+		Logger.Info("block rejected", "check", "VerifyOperationShapes", "block", block.Hash)
+		return "VerifyOperationShapes"
+	}
+
+	// Verifies that each claim is valid and that no shape is drawn in a
+	// region another key holds
+	if !VerifyRegionClaims(block, blockChain, minerNetSettings.CanvasSettings) {
+		Logger.Info("block rejected", "check", "VerifyRegionClaims", "block", block.Hash)
+		return "VerifyRegionClaims"
 	}
 
 	if !VerifySufficientInkForOperationsInBlock(block, blockChain, minerNetSettings) {
-		fmt.Println("VerifyBlock - VerifySufficientInkForOperationsInBlock failed")
-		return false
+		Logger.Info("block rejected", "check", "VerifySufficientInkForOperationsInBlock", "block", block.Hash)
+		return "VerifySufficientInkForOperationsInBlock"
 	}
 
 	// Checks that the current block points to a legal previous block
@@ -55,8 +108,8 @@ func VerifyBlock(block shared.Block, blockChain shared.Node, minerNetSettings sh
 	// exists in the blockchain first
 	for _, v := range block.Operations {
 		if v.IsDelete && !ShapeExistsInShapeHash(v.ShapeHash, allShapes) {
-			fmt.Println("VerifyBlock - ShapeExistsInShapeHash failed")
-			return false
+			Logger.Info("block rejected", "check", "ShapeExistsInShapeHash", "block", block.Hash, "trace", v.TraceID)
+			return "ShapeExistsInShapeHash"
 		}
 	}
 
@@ -64,34 +117,32 @@ func VerifyBlock(block shared.Block, blockChain shared.Node, minerNetSettings sh
 	for _, v := range block.Operations {
 		collides, _ := collision.CollideWithOtherShapes(v, allShapes)
 		if !v.IsDelete && collides {
-			fmt.Println("VerifyBlock - CollideWithOtherShapes failed")
-			return false
+			Logger.Info("block rejected", "check", "CollideWithOtherShapes", "block", block.Hash, "trace", v.TraceID)
+			return "CollideWithOtherShapes"
 		}
 	}
-	return true
+	return ""
 }
 
 // Verifies the proof of work, that the nonce, along with the operations in the block, create the
 // correct hash, and that it has the same number of zeroes
-func VerifyProofOfWork(block shared.Block, minerNetSettings shared.MinerNetSettings) (valid bool) {
-	return VerifyHashDifficulty(block, minerNetSettings)
+func VerifyProofOfWork(block shared.Block, blockChain shared.Node, minerNetSettings shared.MinerNetSettings) (valid bool) {
+	return VerifyNonceMatchesHash(block, minerNetSettings) && VerifyHashDifficulty(block, blockChain, minerNetSettings)
 }
 
-// Verifies that the hash has the correct number of zeroes
-func VerifyHashDifficulty(block shared.Block, minerNetSettings shared.MinerNetSettings) (valid bool) {
+// Verifies that the hash has the number of zeroes expected of a block
+// extending blockChain
+func VerifyHashDifficulty(block shared.Block, blockChain shared.Node, minerNetSettings shared.MinerNetSettings) (valid bool) {
 	zeroes := ""
 
-	var difficulty uint8
-	if block.IsNoopBlock {
-		difficulty = minerNetSettings.PoWDifficultyNoOpBlock
-	} else {
-		difficulty = minerNetSettings.PoWDifficultyOpBlock
-
-	}
+	difficulty := ExpectedDifficulty(block, blockChain, minerNetSettings)
 
 	for i := 0; i < int(difficulty); i++ {
 		zeroes += "0"
 	}
+	if len(block.Hash) < int(difficulty) {
+		return false
+	}
 	last_string := block.Hash[len(block.Hash)-int(difficulty):]
 	return strings.Compare(zeroes, last_string) == 0
 }
@@ -108,18 +159,35 @@ func VerifyNonceMatchesHash(block shared.Block, minerNetSettings shared.MinerNet
 	return strings.Compare(block.Hash, hash) == 0
 }
 
-// Iterates through each operation and checks that the signature generated from the path came from
-// the correct Public Key
+// Iterates through each operation and checks that the signature generated from the path (or
+// the transfer, see shared.Operation.SignedBytes) came from the correct Public Key, on one of
+// the supported curves
 func VerifyOperationSignatures(block shared.Block) (valid bool) {
 	for _, v := range block.Operations {
-
-		if !ecdsa.Verify(&v.ArtNodeKey, []byte(v.DAttribute), v.R, v.S) {
+		key := NamedCurveKey(v.ArtNodeKey)
+		if !VerifyPublicKey(key) || v.R == nil || v.S == nil {
+			return false
+		}
+		if !ecdsa.Verify(&key, v.SignedBytes(), v.R, v.S) {
 			return false
 		}
 	}
 	return true
 }
 
+// Verifies that key is a point on P-256, P-384 or P-521.
+func VerifyPublicKey(key ecdsa.PublicKey) (valid bool) {
+	key = NamedCurveKey(key)
+	if key.Curve == nil || key.X == nil || key.Y == nil {
+		return false
+	}
+	if curve, ok := curves[key.Curve.Params().Name]; !ok || curve != key.Curve {
+		return false
+	}
+	_, err := key.ECDH()
+	return err == nil
+}
+
 // Checks whether a block points to an existing block in the chain by looking it up in the hashmap of existing blocks.
 // May or may not be the best implementation as we may encounter edge cases that make this verification inaccurate
 // May need to change this in the future
@@ -161,11 +229,25 @@ func ShapeExistsInShapeHash(shapeHash string, shapeHashes map[string]shared.Oper
 	return false
 }
 
-// Verifies that each operation in block has sufficient ink in the blockchain
+// Verifies that each operation in block has sufficient ink in the blockchain. Shapes and
+// transfers by the same key in block must be covered together.
 func VerifySufficientInkForOperationsInBlock(block shared.Block, blockChain shared.Node, minerNetSettings shared.MinerNetSettings) (verified bool) {
+	spent := make(map[string]int64)
 	for _, v := range block.Operations {
-		reqInk := blockartlib.CalculateInkUsed(blockartlib.PATH, v.DAttribute, v.Fill, v.Stroke)
-		if !CheckPublicKeyHasSufficientInk(int(reqInk), v.ArtNodeKey, blockChain, minerNetSettings.InkPerOpBlock, minerNetSettings.InkPerNoOpBlock) {
+		reqInk := int64(blockartlib.CalculateInkUsed(blockartlib.PATH, v.DAttribute, v.Fill, v.Stroke))
+		if v.IsTransfer || v.IsOwnerChange() || v.IsModify || v.IsClaim {
+			reqInk = v.InkSpent()
+		}
+		if !v.IsDelete {
+			key := EncodePublicKey(v.ArtNodeKey)
+			spent[key] += reqInk
+			reqInk = spent[key]
+		}
+		if reqInk < 0 {
+			// A modify that made shapes cheaper
+			reqInk = 0
+		}
+		if !CheckPublicKeyHasSufficientInk(reqInk, v.ArtNodeKey, blockChain, minerNetSettings.InkPerOpBlock, minerNetSettings.InkPerNoOpBlock) {
 			return false
 		}
 	}
@@ -176,11 +258,12 @@ func VerifySufficientInkForOperationsInBlock(block shared.Block, blockChain shar
 // Should take into account spends (minus ink) as well as deletes (which refunds ink).
 // Whenever we find a block with the same minerPubKey as our Public Key, we add
 // the reward InkPerOp or Noop block depending on the type of block.
-func CheckPublicKeyHasSufficientInk(reqInk int, minerPubKey ecdsa.PublicKey, blockChain shared.Node, inkPerOpBlock, inkPerNoOpBlock uint32) bool {
+func CheckPublicKeyHasSufficientInk(reqInk int64, minerPubKey ecdsa.PublicKey, blockChain shared.Node, inkPerOpBlock, inkPerNoOpBlock uint32) bool {
 
 	current := &blockChain
 
-	var minedInk uint32 = 0
+	// Signed so that spends larger than the balance cannot wrap around
+	var minedInk int64 = 0
 	for current != nil {
 		block := current.Block
 
@@ -189,32 +272,33 @@ func CheckPublicKeyHasSufficientInk(reqInk int, minerPubKey ecdsa.PublicKey, blo
 
 		if EqualPublicKey(block.MinerKey, minerPubKey) {
 			if block.IsNoopBlock {
-				minedInk += inkPerNoOpBlock
+				minedInk += int64(inkPerNoOpBlock)
 			} else {
-				minedInk += inkPerOpBlock
+				minedInk += int64(inkPerOpBlock)
 			}
 		}
 
 		for _, v := range block.Operations {
 			if EqualPublicKey(v.ArtNodeKey, minerPubKey) {
-				if v.IsDelete {
-					// Refunded ink to node
-					minedInk += v.InkCost
-				} else {
-					// Spent ink to draw
-					minedInk -= v.InkCost
-				}
+				// Spent ink to draw, modify or transfer, or refunded ink
+				// to node
+				minedInk -= v.InkSpent()
+			}
+			if v.IsTransfer && EqualPublicKey(v.TransferTo, minerPubKey) {
+				// Received ink from another key
+				minedInk += int64(v.InkCost)
+			}
+			if key, refund := v.InkRefunded(); EqualPublicKey(key, minerPubKey) {
+				// Refunded ink it paid for a shape another key deleted
+				// or modified
+				minedInk += refund
 			}
 		}
 
-		if current.Prev.Prev != nil {
-			current = current.Prev
-		} else {
-			break
-		}
+		current = current.Prev
 	}
 
-	return minedInk >= uint32(reqInk)
+	return reqInk <= minedInk
 }
 
 // Checks whether two signatures are equal, using r and s generated from
@@ -223,8 +307,16 @@ func EqualSignatures(r1, s1, r2, s2 *big.Int) (equals bool) {
 	return r1.Cmp(r2) == 0 && s1.Cmp(s2) == 0
 }
 
-// Checks whether two Public Keys are equal
+// Checks whether two Public Keys are equal: the same point on the same
+// curve. Empty keys, such as the miner key of the genesis block, are never
+// equal to anything.
 func EqualPublicKey(pubKey1, pubKey2 ecdsa.PublicKey) (equals bool) {
+	if pubKey1.X == nil || pubKey1.Y == nil || pubKey2.X == nil || pubKey2.Y == nil {
+		return false
+	}
+	if pubKey1.Curve == nil || pubKey2.Curve == nil || pubKey1.Curve.Params().Name != pubKey2.Curve.Params().Name {
+		return false
+	}
 	return pubKey1.X.Cmp(pubKey2.X) == 0 && pubKey1.Y.Cmp((pubKey2.Y)) == 0
 }
 
@@ -243,15 +335,36 @@ func ConvertBlockToString(b shared.Block) string {
 	for i := 0; i < len(b.Operations); i++ {
 		opString = opString + b.Operations[i].AppShapeOp + b.Operations[i].R.String() + b.Operations[i].S.String()
 	}
-	return b.PreviousBlockHash + opString + eMKey
+	return b.PreviousBlockHash + opString + eMKey + strconv.FormatInt(b.Timestamp, 10)
 }
 
 func EncodePublicKey(key ecdsa.PublicKey) string {
+	key = NamedCurveKey(key)
 	publicKeyBytes, _ := x509.MarshalPKIXPublicKey(&key)
 	encodedPubBytes := hex.EncodeToString(publicKeyBytes)
 	return encodedPubBytes
 }
 
+// Curves keys may be on, by name.
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// Returns key with its curve set to the standard implementation of the
+// named curve. Keys received over RPC only carry the curve parameters,
+// which x509 cannot marshal. Keys on other curves are returned as they are.
+func NamedCurveKey(key ecdsa.PublicKey) ecdsa.PublicKey {
+	if key.Curve == nil {
+		return key
+	}
+	if curve, ok := curves[key.Curve.Params().Name]; ok {
+		key.Curve = curve
+	}
+	return key
+}
+
 // Once we have a transaction, we can't carry it out
 func FindSecret(nonce string, n uint8) (nonce_val uint32, hash string) {
 	re := regexp.MustCompile("0{" + strconv.Itoa(int(n)) + "}")
@@ -61,7 +61,7 @@ func TestEqualPublicKeySameCurve(t *testing.T) {
 
 	pubKey1 := priv.PublicKey
 
-	pubKey2 := ecdsa.PublicKey{elliptic.P256(), pubKey1.X, pubKey1.Y}
+	pubKey2 := ecdsa.PublicKey{Curve: elliptic.P256(), X: pubKey1.X, Y: pubKey1.Y}
 
 	equals := EqualPublicKey(pubKey1, pubKey2)
 
@@ -75,7 +75,7 @@ func TestEqualPublicKeyDifferentCurve(t *testing.T) {
 
 	pubKey1 := priv.PublicKey
 
-	pubKey2 := ecdsa.PublicKey{elliptic.P384(), pubKey1.X, pubKey1.Y}
+	pubKey2 := ecdsa.PublicKey{Curve: elliptic.P384(), X: pubKey1.X, Y: pubKey1.Y}
 
 	equals := EqualPublicKey(pubKey1, pubKey2)
 
@@ -88,7 +88,7 @@ func TestVerifyHashDifficultyCorrect(t *testing.T) {
 	hash := "DSKJFSDFKJEWRJEWR0000000"
 	var numZeroes uint8 = 7
 
-	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
+	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.Node{}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
 
 	if !correct {
 		t.Error("Should have correct identified the number of zeroes at end of hash to be 7")
@@ -99,7 +99,7 @@ func TestVerifyHashDifficultyTooFewZeroes(t *testing.T) {
 	hash := "DSKJFSDFKJEWRJEWR000000"
 	var numZeroes uint8 = 7
 
-	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
+	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.Node{}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
 
 	if correct {
 		t.Error("Number of zeroes requested was 7, but passed despite only 6 zeroes")
@@ -110,7 +110,7 @@ func TestVerifyHashDifficultyNoZeroes(t *testing.T) {
 	hash := "DSKJFSDFKJEWRJEWR"
 	var numZeroes uint8 = 7
 
-	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
+	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.Node{}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
 
 	if correct {
 		t.Error("Number of zeroes requested was 7, but passed despite no zeroes")
@@ -121,7 +121,7 @@ func TestVerifyHashDifficultyTooManyZeroes(t *testing.T) {
 	hash := "DSKJFSDFKJEWRJEWR0000000000"
 	var numZeroes uint8 = 7
 
-	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
+	correct := VerifyHashDifficulty(shared.Block{Hash:hash}, shared.Node{}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes})
 
 	if !correct {
 		t.Error("Number of zeroes requested was 7, but did not pass when difficulty was higher than needed")
@@ -136,14 +136,14 @@ func TestVerifyNonceMatchesHashCorrectNoOp(t *testing.T) {
 	var r *big.Int = big.NewInt(3)
 	var s *big.Int = big.NewInt(4)
 
-	pubKey := ecdsa.PublicKey{elliptic.P384(), X, Y}
-	operation := shared.Operation{"shape", "", "", "", 1, false, ecdsa.PublicKey{}, 1, 5, "hash", r, s}
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P384(), X: X, Y: Y}
+	operation := shared.Operation{AppShapeOp: "shape", ShapeType: 1, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 	operations := []shared.Operation{operation}
 
 	var nonce uint32 = 123456
 	var difficulty uint8 = 4
 
-	block := shared.Block{"ABCD", true, operations, pubKey, nonce, ""}
+	block := shared.Block{PreviousBlockHash: "ABCD", IsNoopBlock: true, Operations: operations, MinerKey: pubKey, Nonce: nonce}
 
 	blockStr := ConvertBlockToString(block)
 
@@ -164,14 +164,14 @@ func TestVerifyNonceMatchesHashIncorrectNoOp(t *testing.T) {
 	var r *big.Int = big.NewInt(3)
 	var s *big.Int = big.NewInt(4)
 
-	pubKey := ecdsa.PublicKey{elliptic.P384(), X, Y}
-	operation := shared.Operation{"shape", "", "", "", 1, false, ecdsa.PublicKey{}, 1, 5, "hash", r, s}
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P384(), X: X, Y: Y}
+	operation := shared.Operation{AppShapeOp: "shape", ShapeType: 1, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 	operations := []shared.Operation{operation}
 
 	var nonce uint32 = 123456
 	var difficulty uint8 = 4
 
-	block := shared.Block{"ABCD", true, operations, pubKey, nonce, ""}
+	block := shared.Block{PreviousBlockHash: "ABCD", IsNoopBlock: true, Operations: operations, MinerKey: pubKey, Nonce: nonce}
 
 	block.Hash = "ABCD"
 
@@ -180,6 +180,32 @@ func TestVerifyNonceMatchesHashIncorrectNoOp(t *testing.T) {
 	}
 }
 
+func TestVerifyProofOfWorkRecomputesHash(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var difficulty uint8 = 2
+	settings := shared.MinerNetSettings{PoWDifficultyOpBlock: difficulty, PoWDifficultyNoOpBlock: difficulty}
+
+	block := shared.Block{PreviousBlockHash: "ABCD", IsNoopBlock: true, MinerKey: priv.PublicKey}
+	block.Nonce, block.Hash = FindSecret(ConvertBlockToString(block), difficulty)
+	if !VerifyProofOfWork(block, shared.Node{}, settings) {
+		t.Error("Expected a mined block to pass")
+	}
+
+	forged := block
+	forged.Hash = "fake000000"
+	if VerifyProofOfWork(forged, shared.Node{}, settings) {
+		t.Error("Expected a hash the block contents do not hash to to be rejected")
+	}
+}
+
+func TestVerifyHashDifficultyShortHash(t *testing.T) {
+	var numZeroes uint8 = 7
+
+	if VerifyHashDifficulty(shared.Block{Hash: "000"}, shared.Node{}, shared.MinerNetSettings{PoWDifficultyOpBlock: numZeroes, PoWDifficultyNoOpBlock: numZeroes}) {
+		t.Error("Expected a hash shorter than the difficulty to be rejected")
+	}
+}
+
 
 func TestVerifyOperationSignaturesCorrect(t *testing.T) {
 	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -188,7 +214,7 @@ func TestVerifyOperationSignaturesCorrect(t *testing.T) {
 
 	r, s, _ := ecdsa.Sign(rand.Reader, priv, []byte(appShapeOp))
 
-	operation := shared.Operation{appShapeOp, "", "", "", 1, false, priv.PublicKey, 1, 5, "hash", r, s}
+	operation := shared.Operation{AppShapeOp: appShapeOp, ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 
 	operations := []shared.Operation{operation}
 
@@ -210,11 +236,11 @@ func TestVerifyOperationSignaturesTwoOperationsCorrect(t *testing.T) {
 
 	r, s, _ := ecdsa.Sign(rand.Reader, priv, []byte(appShapeOp))
 
-	operation := shared.Operation{"shape", "", "", "", 1, false, priv.PublicKey, 1, 5, "hash", r, s}
+	operation := shared.Operation{AppShapeOp: "shape", ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 
 	r, s, _ = ecdsa.Sign(rand.Reader, priv, []byte(appShapeOp2))
 
-	operation2 := shared.Operation{appShapeOp2, "", "", "", 1, false, priv.PublicKey, 1, 5, "hash", r, s}
+	operation2 := shared.Operation{AppShapeOp: appShapeOp2, ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 
 
 	operations := []shared.Operation{operation, operation2}
@@ -235,7 +261,7 @@ func TestVerifyOperationSignaturesIncorrect(t *testing.T) {
 	r := big.NewInt(5)
 	s := big.NewInt(7)
 
-	operation := shared.Operation{"shape", "", "", "", 1, false, priv.PublicKey, 1, 5, "hash", r, s}
+	operation := shared.Operation{AppShapeOp: "shape", ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 
 	operations := []shared.Operation{operation}
 
@@ -258,8 +284,8 @@ func TestVerifyOperationSignaturesOneCorrectOneIncorrect(t *testing.T) {
 
 	r, s, _ = ecdsa.Sign(rand.Reader, priv, []byte(appShapeOp2))
 
-	operation := shared.Operation{"shape", "", "", "", 1, false, priv.PublicKey, 1, 5, "hash", r, s}
-	operation2 := shared.Operation{appShapeOp2, "", "", "", 1, false, priv.PublicKey, 1, 5, "hash", r, s}
+	operation := shared.Operation{AppShapeOp: "shape", ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
+	operation2 := shared.Operation{AppShapeOp: appShapeOp2, ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 5, ShapeHash: "hash", R: r, S: s}
 
 	operations := []shared.Operation{operation, operation2}
 
@@ -284,7 +310,7 @@ func TestVerifySufficientInkForOperationsInBlockEnoughInk (t *testing.T){
 
 	appShapeOp := "M 0 0 H 50 V 40 h -20 Z"
 
-	operation := shared.Operation{appShapeOp, "red", "red", "M 0 0 H 50 V 40 h -20 Z", 1, false, priv.PublicKey, 1, 1560, "shapeHash", big.NewInt(5), big.NewInt(6)}
+	operation := shared.Operation{AppShapeOp: appShapeOp, Fill: "red", Stroke: "red", DAttribute: "M 0 0 H 50 V 40 h -20 Z", ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 1560, ShapeHash: "shapeHash", R: big.NewInt(5), S: big.NewInt(6)}
 
 	operations := []shared.Operation{operation}
 	block2.Operations = operations
@@ -309,7 +335,7 @@ func TestVerifySufficientInkForOperationsInBlockNotEnoughInk (t *testing.T){
 
 	appShapeOp := "M 0 0 H 50 V 40 h -20 Z"
 
-	operation := shared.Operation{appShapeOp, "red", "red", "M 0 0 H 50 V 40 h -20 Z", 1, false, priv.PublicKey, 1, 1560, "shapeHash", big.NewInt(5), big.NewInt(6)}
+	operation := shared.Operation{AppShapeOp: appShapeOp, Fill: "red", Stroke: "red", DAttribute: "M 0 0 H 50 V 40 h -20 Z", ShapeType: 1, ArtNodeKey: priv.PublicKey, NumBlockValidate: 1, InkCost: 1560, ShapeHash: "shapeHash", R: big.NewInt(5), S: big.NewInt(6)}
 
 	operations := []shared.Operation{operation}
 	block2.Operations = operations
@@ -322,3 +348,33 @@ func TestVerifySufficientInkForOperationsInBlockNotEnoughInk (t *testing.T){
 		t.Error("Test returned correct when there was insufficient ink the blockchain for that public key/miner")
 	}
 }
+
+func TestVerifyOperationSignaturesSupportedCurves(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, _ := ecdsa.GenerateKey(curve, rand.Reader)
+		// Keys arrive over RPC with only the curve parameters
+		key := priv.PublicKey
+		key.Curve = curve.Params()
+		operation := shared.Operation{DAttribute: "M 0 0 L 20 20", ArtNodeKey: key}
+		operation.R, operation.S, _ = ecdsa.Sign(rand.Reader, priv, operation.SignedBytes())
+
+		if !VerifyOperationSignatures(shared.Block{Operations: []shared.Operation{operation}}) {
+			t.Error("Valid signature on", curve.Params().Name, "was rejected")
+		}
+	}
+}
+
+func TestVerifyPublicKeyUnsupportedCurve(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if VerifyPublicKey(priv.PublicKey) {
+		t.Error("Key on P-224 was accepted")
+	}
+
+	// A point that is not on the curve it names
+	priv, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key := priv.PublicKey
+	key.Curve = elliptic.P384().Params()
+	if VerifyPublicKey(key) {
+		t.Error("P-256 point was accepted as a P-384 key")
+	}
+}